@@ -398,6 +398,9 @@ def get_node_id_info(node_id):
     hostname, fc_wwns, iscsi_iqn = "", "", ""
     if len(split_node) == config.SUPPORTED_CONNECTIVITY_TYPES + 1:
         hostname, fc_wwns, iscsi_iqn = split_node
+    elif len(split_node) == config.SUPPORTED_CONNECTIVITY_TYPES + 2:
+        # the last field is the nvme nqn of the node, which is not used by the controller yet
+        hostname, fc_wwns, iscsi_iqn, _ = split_node
     elif len(split_node) == 2:
         hostname, fc_wwns = split_node
     else:
@@ -387,6 +387,11 @@ class TestUtils(unittest.TestCase):
         self.assertEqual(iscsi_iqn, "")
         self.assertEqual(fc_wwns, "wwn1:wwn2")
 
+        hostname, fc_wwns, iscsi_iqn = utils.get_node_id_info("hostabc;wwn1:wwn2;;nqn.ibm")
+        self.assertEqual(hostname, "hostabc")
+        self.assertEqual(iscsi_iqn, "")
+        self.assertEqual(fc_wwns, "wwn1:wwn2")
+
     def test_choose_connectivity_types(self):
         res = utils.choose_connectivity_type(["iscsi"])
         self.assertEqual(res, "iscsi")
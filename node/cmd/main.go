@@ -20,9 +20,11 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/ibm/ibm-block-csi-driver/node/logger"
 	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
 )
 
 func logVersionInfo(configFile *string) {
@@ -40,6 +42,23 @@ func main() {
 		exitAfterLogVersion = flag.Bool("version", false, "Log the version and exit.")
 		configFile          = flag.String("config-file-path", "./config.yaml", "Shared config file.")
 		hostname            = flag.String("hostname", "host-dns-name", "The name of the host the node is running on.")
+
+		orphanDevicesCollectorInterval    = flag.Duration("orphan-devices-collector-interval", 0, "Interval of removing orphaned multipath devices, 0 disables it.")
+		orphanDevicesCollectorGracePeriod = flag.Duration("orphan-devices-collector-grace-period", time.Hour, "How long a multipath device must stay orphaned before it is removed.")
+		orphanDevicesCollectorDryRun      = flag.Bool("orphan-devices-collector-dry-run", false, "Only log the orphaned multipath devices which would be removed.")
+
+		minLoggedInPortals = flag.Int("min-logged-in-portals", 1, "Minimum number of iSCSI portals of the storage which must be logged in to stage a volume.")
+
+		iscsiKeepSessionsOnUnstage     = flag.Bool("iscsi-keep-sessions-on-unstage", false, "Keep the iSCSI sessions of a target after its last volume is unstaged.")
+		iscsiDeleteNodeRecordsOnLogout = flag.Bool("iscsi-delete-node-records-on-logout", false, "Delete the iSCSI node records of a target after its sessions are logged out.")
+		iscsiLoginWorkers              = flag.Int("iscsi-login-workers", 8, "Maximum number of concurrent iSCSI discoveries or logins of a stage.")
+		iscsiLoginRetries              = flag.Int("iscsi-login-retries", 3, "Retries of an iSCSI discovery or login which failed with a transient error.")
+		iscsiLoginRetryInterval        = flag.Duration("iscsi-login-retry-interval", time.Second, "Interval before the first retry of an iSCSI discovery or login, doubled on each retry.")
+		iscsiLoginTimeout              = flag.Duration("iscsi-login-timeout", 2*time.Minute, "Deadline of the whole iSCSI discovery and login of a stage, 0 for the deadline of the request only.")
+		iscsiSessionMonitorInterval    = flag.Duration("iscsi-session-monitor-interval", 0, "Interval of checking the iSCSI sessions of the staged volumes and logging in again the ones which are gone, 0 disables it.")
+
+		fcLipMinInterval   = flag.Duration("fc-lip-min-interval", 10*time.Minute, "Minimal interval between LIPs on the same fc host of the issue_lip rescan strategy.")
+		fcLipSettleTimeout = flag.Duration("fc-lip-settle-timeout", 30*time.Second, "How long to wait for the remote ports of the storage after a LIP of the issue_lip rescan strategy.")
 	)
 
 	flag.Parse()
@@ -50,7 +69,25 @@ func main() {
 		os.Exit(0)
 	}
 
-	drv, err := driver.NewDriver(*endpoint, *configFile, *hostname)
+	collectorConfig := driver.OrphanDevicesCollectorConfig{
+		Interval:    *orphanDevicesCollectorInterval,
+		GracePeriod: *orphanDevicesCollectorGracePeriod,
+		DryRun:      *orphanDevicesCollectorDryRun,
+	}
+	iscsiConfig := device_connectivity.IscsiConfig{
+		KeepSessionsOnUnstage:     *iscsiKeepSessionsOnUnstage,
+		DeleteNodeRecordsOnLogout: *iscsiDeleteNodeRecordsOnLogout,
+		LoginWorkers:              *iscsiLoginWorkers,
+		LoginRetries:              *iscsiLoginRetries,
+		LoginRetryInterval:        *iscsiLoginRetryInterval,
+		LoginTimeout:              *iscsiLoginTimeout,
+		SessionMonitorInterval:    *iscsiSessionMonitorInterval,
+	}
+	fcConfig := device_connectivity.FcConfig{
+		LipMinInterval:   *fcLipMinInterval,
+		LipSettleTimeout: *fcLipSettleTimeout,
+	}
+	drv, err := driver.NewDriver(*endpoint, *configFile, *hostname, collectorConfig, iscsiConfig, fcConfig, *minLoggedInPortals)
 	if err != nil {
 		logger.Panicln(err)
 	}
@@ -17,29 +17,151 @@
 package device_connectivity
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ibm/ibm-block-csi-driver/node/logger"
 	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executer"
 )
 
+const (
+	FcRescanStrategyScan     = "scan"
+	FcRescanStrategyIssueLip = "issue_lip"
+	fcIssueLipFileName       = "issue_lip"
+)
+
+var fcLipSettlePollInterval = time.Second
+
+// ValidateFcRescanStrategy fails unless the rescan strategy is empty, for the default strategy, or a known strategy.
+func ValidateFcRescanStrategy(rescanStrategy string) error {
+	if rescanStrategy != "" && rescanStrategy != FcRescanStrategyScan && rescanStrategy != FcRescanStrategyIssueLip {
+		return &FcRescanStrategyError{RescanStrategy: rescanStrategy}
+	}
+	return nil
+}
+
+type FcConfig struct {
+	RescanStrategy   string        // Scan the fc hosts (default), or issue a LIP first if no array port is found
+	LipMinInterval   time.Duration // Minimal interval between LIPs on the same fc host
+	LipSettleTimeout time.Duration // How long to wait for the remote ports of the array after a LIP
+}
+
 type OsDeviceConnectivityFc struct {
 	Executer          executer.ExecuterInterface
 	HelperScsiGeneric OsDeviceConnectivityHelperScsiGenericInterface
+	Helper            OsDeviceConnectivityHelperInterface
+	Config            FcConfig
+	ZfcpUnits         bool // Attach the LUNs through zfcp units, on s390x
+	lipTimes          *fcLipTimes
 }
 
-func NewOsDeviceConnectivityFc(executer executer.ExecuterInterface) OsDeviceConnectivityInterface {
+// fcLipTimes are the times of the last LIPs by fc host, which are shared by the requests
+type fcLipTimes struct {
+	mutex      sync.Mutex
+	lastLipsAt map[string]time.Time
+}
+
+func NewOsDeviceConnectivityFc(executer executer.ExecuterInterface, config FcConfig) OsDeviceConnectivityInterface {
 	return &OsDeviceConnectivityFc{
 		Executer:          executer,
 		HelperScsiGeneric: NewOsDeviceConnectivityHelperScsiGeneric(executer),
+		Helper:            NewOsDeviceConnectivityHelperGeneric(executer),
+		Config:            config,
+		ZfcpUnits:         isZfcpArch,
+		lipTimes:          &fcLipTimes{lastLipsAt: make(map[string]time.Time)},
 	}
 }
 
-func (r OsDeviceConnectivityFc) EnsureLogin(_ map[string][]string) {
+func (r OsDeviceConnectivityFc) EnsureLogin(_ context.Context, _ map[string][]string, _ map[string]string, _ map[string]string) ([]PortalLoginResult, error) {
 	// FC doesn't require login
+	return nil, nil
 }
 
 func (r OsDeviceConnectivityFc) RescanDevices(lunId int, arrayIdentifiers []string) error {
+	if r.Config.RescanStrategy == FcRescanStrategyIssueLip && !r.isAnyArrayPortFound(arrayIdentifiers) {
+		r.issueLips(arrayIdentifiers)
+	}
+	if r.ZfcpUnits {
+		r.attachZfcpUnits(lunId, arrayIdentifiers)
+	}
 	return r.HelperScsiGeneric.RescanDevices(lunId, arrayIdentifiers)
 }
 
+func (r OsDeviceConnectivityFc) isAnyArrayPortFound(arrayIdentifiers []string) bool {
+	for _, arrayIdentifier := range arrayIdentifiers {
+		_, err := r.Helper.GetHostsIdByArrayIdentifier(arrayIdentifier)
+		if _, isNotFound := err.(*ConnectivityIdentifierStorageTargetNotFoundError); !isNotFound {
+			return true
+		}
+	}
+	return false
+}
+
+// issueLips issues a LIP on the Online fc hosts, unless a LIP was issued on them lately, so the HBAs discover the
+// newly zoned array ports, and waits for the remote ports of the array to settle.
+func (r OsDeviceConnectivityFc) issueLips(arrayIdentifiers []string) {
+	hostPaths, err := r.Executer.FilepathGlob(FcHostsPath)
+	if err != nil {
+		logger.Errorf("Failed to list the fc hosts : {%v}", err)
+		return
+	}
+	isLipIssued := false
+	for _, hostPath := range hostPaths {
+		if r.readFcAttribute(hostPath, fcPortStateFileName) != FcPortStateOnline || !r.lipTimes.start(filepath.Base(hostPath), r.Config.LipMinInterval) {
+			continue
+		}
+		lipFilename := filepath.Join(hostPath, fcIssueLipFileName)
+		logger.Infof("Issue LIP on fc host : echo 1 > %s", lipFilename)
+		if err := r.writeSysfsFile(lipFilename, "1"); err != nil {
+			logger.Errorf("Failed to issue LIP on fc host {%v} : {%v}", filepath.Base(hostPath), err)
+			continue
+		}
+		isLipIssued = true
+	}
+	if !isLipIssued {
+		return
+	}
+
+	settleDeadline := time.Now().Add(r.Config.LipSettleTimeout)
+	for !r.isAnyArrayPortFound(arrayIdentifiers) {
+		if time.Now().After(settleDeadline) {
+			logger.Warningf("Array ports {%v} were not found after the LIP", arrayIdentifiers)
+			return
+		}
+		time.Sleep(fcLipSettlePollInterval)
+	}
+}
+
+func (r OsDeviceConnectivityFc) writeSysfsFile(filename string, value string) error {
+	f, err := r.Executer.OsOpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if written, err := r.Executer.FileWriteString(f, value); err != nil {
+		return err
+	} else if written == 0 {
+		return &ErrorNothingWasWrittenToScanFileError{filename}
+	}
+	return nil
+}
+
+// start records a LIP on the host and returns true, unless the last LIP on the host is more recent than the interval
+func (t *fcLipTimes) start(host string, minInterval time.Duration) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if lastLipAt, ok := t.lastLipsAt[host]; ok && time.Since(lastLipAt) < minInterval {
+		logger.Debugf("Skipping LIP on fc host {%v}, the last LIP was at {%v}", host, lastLipAt)
+		return false
+	}
+	t.lastLipsAt[host] = time.Now()
+	return true
+}
+
 func (r OsDeviceConnectivityFc) GetMpathDevice(volumeId string) (string, error) {
 	/*
 	   Return Value: "dm-X" of the volumeID.
@@ -52,5 +174,23 @@ func (r OsDeviceConnectivityFc) FlushMultipathDevice(mpathDevice string) error {
 }
 
 func (r OsDeviceConnectivityFc) RemovePhysicalDevice(sysDevices []string) error {
-	return r.HelperScsiGeneric.RemovePhysicalDevice(sysDevices)
+	if !r.ZfcpUnits {
+		return r.HelperScsiGeneric.RemovePhysicalDevice(sysDevices)
+	}
+	// the zfcp units of the devices can't be read once the devices are removed
+	units := r.getZfcpUnits(sysDevices)
+	if err := r.HelperScsiGeneric.RemovePhysicalDevice(sysDevices); err != nil {
+		return err
+	}
+	r.detachZfcpUnits(units)
+	return nil
+}
+
+func (r OsDeviceConnectivityFc) GetMpathDeviceCondition(mpathDevice string) (bool, string, error) {
+	return r.HelperScsiGeneric.GetMpathDeviceCondition(mpathDevice)
+}
+
+func (r OsDeviceConnectivityFc) EnsureLogout(_ string, _ []string) error {
+	// FC doesn't require logout
+	return nil
 }
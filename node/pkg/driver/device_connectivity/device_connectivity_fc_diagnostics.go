@@ -0,0 +1,190 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ibm/ibm-block-csi-driver/node/logger"
+)
+
+const (
+	FcHostsPath          = "/sys/class/fc_host/host*"
+	FcRemotePortsPath    = "/sys/class/fc_remote_ports/rport-*"
+	fcPortNameFileName   = "port_name"
+	fcSpeedFileName      = "speed"
+	fcFabricNameFileName = "fabric_name"
+	fcNoFabricName       = "0x0"
+
+	FcArrayPortOnline     = "Online"
+	FcArrayPortOffline    = "Offline"
+	FcArrayPortNotVisible = "NotVisible"
+)
+
+var fcRemotePortHostRegexp = regexp.MustCompile(`rport-([0-9]+):`)
+
+type FcRemotePortReport struct {
+	Name      string `json:"name"`
+	PortName  string `json:"port_name"`
+	PortState string `json:"port_state"`
+}
+
+type FcHostReport struct {
+	Name        string               `json:"name"`
+	PortName    string               `json:"port_name"`
+	PortState   string               `json:"port_state"`
+	Speed       string               `json:"speed"`
+	FabricName  string               `json:"fabric_name"`
+	RemotePorts []FcRemotePortReport `json:"remote_ports"`
+}
+
+// FcArrayPortReport is the cross check of an array WWN against the remote ports of the fc hosts.
+type FcArrayPortReport struct {
+	Wwn         string   `json:"wwn"`
+	Status      string   `json:"status"`
+	RemotePorts []string `json:"remote_ports"` // The remote ports of the WWN, e.g. host3/rport-3:0-0 Online
+	Hint        string   `json:"hint,omitempty"`
+}
+
+type FcDiagnosticsReport struct {
+	Hosts      []FcHostReport      `json:"hosts"`
+	ArrayPorts []FcArrayPortReport `json:"array_ports"`
+}
+
+// Summary returns the array ports which are not Online with their hints, to be returned to the caller.
+func (r *FcDiagnosticsReport) Summary() string {
+	var arrayPorts []string
+	for _, arrayPort := range r.ArrayPorts {
+		if arrayPort.Status == FcArrayPortOnline {
+			continue
+		}
+		arrayPortString := fmt.Sprintf("%s %s", arrayPort.Wwn, arrayPort.Status)
+		if arrayPort.Hint != "" {
+			arrayPortString += " (" + arrayPort.Hint + ")"
+		}
+		arrayPorts = append(arrayPorts, arrayPortString)
+	}
+	if len(arrayPorts) == 0 {
+		return "FC array ports are Online"
+	}
+	return fmt.Sprintf("FC array ports: %s", strings.Join(arrayPorts, ", "))
+}
+
+// GetFcDiagnosticsReport lists the fc hosts and the remote ports they see, and cross checks them against the array WWNs.
+func (r OsDeviceConnectivityFc) GetFcDiagnosticsReport(arrayWwns []string) (*FcDiagnosticsReport, error) {
+	hostPaths, err := r.Executer.FilepathGlob(FcHostsPath)
+	if err != nil {
+		return nil, err
+	}
+	remotePortPaths, err := r.Executer.FilepathGlob(FcRemotePortsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	remotePortsByHost := make(map[string][]FcRemotePortReport)
+	for _, remotePortPath := range remotePortPaths {
+		name := filepath.Base(remotePortPath)
+		hostMatch := fcRemotePortHostRegexp.FindStringSubmatch(name)
+		if hostMatch == nil {
+			logger.Warningf("Could not find host number of remote port : {%v}", remotePortPath)
+			continue
+		}
+		hostName := "host" + hostMatch[1]
+		remotePortsByHost[hostName] = append(remotePortsByHost[hostName], FcRemotePortReport{
+			Name:      name,
+			PortName:  r.readFcAttribute(remotePortPath, fcPortNameFileName),
+			PortState: r.readFcAttribute(remotePortPath, fcPortStateFileName),
+		})
+	}
+
+	report := &FcDiagnosticsReport{}
+	for _, hostPath := range hostPaths {
+		name := filepath.Base(hostPath)
+		report.Hosts = append(report.Hosts, FcHostReport{
+			Name:        name,
+			PortName:    r.readFcAttribute(hostPath, fcPortNameFileName),
+			PortState:   r.readFcAttribute(hostPath, fcPortStateFileName),
+			Speed:       r.readFcAttribute(hostPath, fcSpeedFileName),
+			FabricName:  r.readFcAttribute(hostPath, fcFabricNameFileName),
+			RemotePorts: remotePortsByHost[name],
+		})
+	}
+	for _, arrayWwn := range arrayWwns {
+		report.ArrayPorts = append(report.ArrayPorts, report.getArrayPortReport(arrayWwn))
+	}
+	return report, nil
+}
+
+func (r *FcDiagnosticsReport) getArrayPortReport(arrayWwn string) FcArrayPortReport {
+	arrayPort := FcArrayPortReport{Wwn: arrayWwn, Status: FcArrayPortNotVisible}
+	isAnyHostOnline := false
+	isAnyHostInFabric := false
+	for _, host := range r.Hosts {
+		isHostOnline := host.PortState == FcPortStateOnline
+		isAnyHostOnline = isAnyHostOnline || isHostOnline
+		isAnyHostInFabric = isAnyHostInFabric || (isHostOnline && host.FabricName != fcNoFabricName)
+		for _, remotePort := range host.RemotePorts {
+			if !strings.EqualFold(normalizeFcWwn(remotePort.PortName), normalizeFcWwn(arrayWwn)) {
+				continue
+			}
+			arrayPort.RemotePorts = append(arrayPort.RemotePorts, fmt.Sprintf("%s/%s %s", host.Name, remotePort.Name, remotePort.PortState))
+			if isHostOnline && remotePort.PortState == FcPortStateOnline {
+				arrayPort.Status = FcArrayPortOnline
+			} else if arrayPort.Status == FcArrayPortNotVisible {
+				arrayPort.Status = FcArrayPortOffline
+			}
+		}
+	}
+
+	switch {
+	case arrayPort.Status == FcArrayPortOffline:
+		arrayPort.Hint = "the array port is visible only through ports which are not Online, check the array port and the links"
+	case arrayPort.Status == FcArrayPortNotVisible && !isAnyHostOnline:
+		arrayPort.Hint = "no fc host port is Online, check the cables of the host"
+	case arrayPort.Status == FcArrayPortNotVisible && !isAnyHostInFabric:
+		arrayPort.Hint = "no Online fc host port is logged in to a fabric, check the switch ports of the host"
+	case arrayPort.Status == FcArrayPortNotVisible:
+		arrayPort.Hint = "the array port is not visible through any fc host port, check the zoning and the array port"
+	}
+	return arrayPort
+}
+
+func (r OsDeviceConnectivityFc) readFcAttribute(portPath string, attributeFileName string) string {
+	return readSysfsValue(r.Executer, filepath.Join(portPath, attributeFileName))
+}
+
+// normalizeFcWwn removes the 0x prefix of the WWNs in sysfs, which the array WWNs don't have
+func normalizeFcWwn(wwn string) string {
+	return strings.TrimPrefix(wwn, "0x")
+}
+
+func (r OsDeviceConnectivityFc) GetDiagnostics(arrayIdentifiers []string) (string, error) {
+	report, err := r.GetFcDiagnosticsReport(arrayIdentifiers)
+	if err != nil {
+		return "", err
+	}
+	reportJson, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	logger.Infof("FC diagnostics report : %s", reportJson)
+	return report.Summary(), nil
+}
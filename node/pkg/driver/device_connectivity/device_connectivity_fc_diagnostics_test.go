@@ -0,0 +1,128 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity_test
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ibm/ibm-block-csi-driver/node/mocks"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
+)
+
+func TestGetFcDiagnosticsReport(t *testing.T) {
+	hostPaths := []string{"/sys/class/fc_host/host3", "/sys/class/fc_host/host4"}
+	remotePortPaths := []string{"/sys/class/fc_remote_ports/rport-3:0-0", "/sys/class/fc_remote_ports/rport-4:0-0"}
+	onlineHost3 := map[string]string{
+		"/sys/class/fc_host/host3/port_name":   "0x10000090fa000003\n",
+		"/sys/class/fc_host/host3/port_state":  "Online\n",
+		"/sys/class/fc_host/host3/speed":       "16 Gbit\n",
+		"/sys/class/fc_host/host3/fabric_name": "0x100000051e000001\n",
+	}
+
+	testCases := []struct {
+		name           string
+		sysfs          map[string]string
+		expStatuses    []string
+		expRemotePorts []string
+		expHintPart    string
+	}{
+		{
+			name: "Should find the array port Online",
+			sysfs: map[string]string{
+				"/sys/class/fc_remote_ports/rport-3:0-0/port_name":  "0x500507680b25c0aa\n",
+				"/sys/class/fc_remote_ports/rport-3:0-0/port_state": "Online\n",
+			},
+			expStatuses:    []string{device_connectivity.FcArrayPortOnline, device_connectivity.FcArrayPortNotVisible},
+			expRemotePorts: []string{"host3/rport-3:0-0 Online"},
+			expHintPart:    "check the zoning",
+		},
+		{
+			name: "Should find the array port Offline when its remote port is blocked",
+			sysfs: map[string]string{
+				"/sys/class/fc_remote_ports/rport-3:0-0/port_name":  "0x500507680b25c0aa\n",
+				"/sys/class/fc_remote_ports/rport-3:0-0/port_state": "Blocked\n",
+			},
+			expStatuses:    []string{device_connectivity.FcArrayPortOffline, device_connectivity.FcArrayPortNotVisible},
+			expRemotePorts: []string{"host3/rport-3:0-0 Blocked"},
+			expHintPart:    "visible only through ports which are not Online",
+		},
+		{
+			name: "Should find the array port Offline when it is visible only through a linkdown host port",
+			sysfs: map[string]string{
+				"/sys/class/fc_remote_ports/rport-4:0-0/port_name":  "0x500507680b25c0aa\n",
+				"/sys/class/fc_remote_ports/rport-4:0-0/port_state": "Online\n",
+			},
+			expStatuses:    []string{device_connectivity.FcArrayPortOffline, device_connectivity.FcArrayPortNotVisible},
+			expRemotePorts: []string{"host4/rport-4:0-0 Online"},
+			expHintPart:    "visible only through ports which are not Online",
+		},
+	}
+
+	for _, tc := range testCases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			sysfs := map[string]string{
+				"/sys/class/fc_host/host4/port_state": "Linkdown\n",
+			}
+			for path, value := range onlineHost3 {
+				sysfs[path] = value
+			}
+			for path, value := range tc.sysfs {
+				sysfs[path] = value
+			}
+			fake_executer := mocks.NewMockExecuterInterface(mockCtrl)
+			fake_executer.EXPECT().FilepathGlob(device_connectivity.FcHostsPath).Return(hostPaths, nil)
+			fake_executer.EXPECT().FilepathGlob(device_connectivity.FcRemotePortsPath).Return(remotePortPaths, nil)
+			fake_executer.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(filename string) ([]byte, error) {
+				if value, ok := sysfs[filename]; ok {
+					return []byte(value), nil
+				}
+				return nil, os.ErrNotExist
+			}).AnyTimes()
+
+			fc := device_connectivity.OsDeviceConnectivityFc{Executer: fake_executer}
+			report, err := fc.GetFcDiagnosticsReport([]string{"500507680B25C0AA", "500507680b26c0aa"})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if len(report.Hosts) != 2 || report.Hosts[0].Speed != "16 Gbit" || report.Hosts[1].PortState != "Linkdown" {
+				t.Fatalf("Expected the fc hosts host3 and host4, got %+v", report.Hosts)
+			}
+			var statuses []string
+			for _, arrayPort := range report.ArrayPorts {
+				statuses = append(statuses, arrayPort.Status)
+			}
+			if !reflect.DeepEqual(statuses, tc.expStatuses) {
+				t.Fatalf("Expected array port statuses %v, got %v", tc.expStatuses, statuses)
+			}
+			if !reflect.DeepEqual(report.ArrayPorts[0].RemotePorts, tc.expRemotePorts) {
+				t.Fatalf("Expected remote ports %v, got %v", tc.expRemotePorts, report.ArrayPorts[0].RemotePorts)
+			}
+			if !strings.Contains(report.Summary(), tc.expHintPart) {
+				t.Fatalf("Expected report to contain {%v}, got {%v}", tc.expHintPart, report.Summary())
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ibm/ibm-block-csi-driver/node/mocks"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
+)
+
+func TestFcRescanDevicesIssueLip(t *testing.T) {
+	arrayWwns := []string{"500507680b25c0aa"}
+	notFoundErr := &device_connectivity.ConnectivityIdentifierStorageTargetNotFoundError{StorageTargetName: arrayWwns[0]}
+
+	testCases := []struct {
+		name           string
+		rescanStrategy string
+		isFound        bool
+		expLipHosts    []string // The LIPs of the first and the second rescan
+	}{
+		{
+			name:           "Should only rescan with the scan strategy",
+			rescanStrategy: device_connectivity.FcRescanStrategyScan,
+		},
+		{
+			name:           "Should not issue LIP when the array port is found",
+			rescanStrategy: device_connectivity.FcRescanStrategyIssueLip,
+			isFound:        true,
+		},
+		{
+			name:           "Should issue LIP once on the Online fc hosts when the array port is not found",
+			rescanStrategy: device_connectivity.FcRescanStrategyIssueLip,
+			expLipHosts:    []string{"/sys/class/fc_host/host3/issue_lip"},
+		},
+	}
+
+	for _, tc := range testCases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			fake_executer := mocks.NewMockExecuterInterface(mockCtrl)
+			fake_helper := mocks.NewMockOsDeviceConnectivityHelperInterface(mockCtrl)
+			fake_helper_scsi := mocks.NewMockOsDeviceConnectivityHelperScsiGenericInterface(mockCtrl)
+			config := device_connectivity.FcConfig{RescanStrategy: tc.rescanStrategy, LipMinInterval: time.Hour}
+			fc := device_connectivity.NewOsDeviceConnectivityFc(fake_executer, config).(*device_connectivity.OsDeviceConnectivityFc)
+			fc.Helper = fake_helper
+			fc.HelperScsiGeneric = fake_helper_scsi
+
+			if tc.rescanStrategy == device_connectivity.FcRescanStrategyIssueLip {
+				if tc.isFound {
+					fake_helper.EXPECT().GetHostsIdByArrayIdentifier(arrayWwns[0]).Return([]int{3}, nil).Times(2)
+				} else {
+					fake_helper.EXPECT().GetHostsIdByArrayIdentifier(arrayWwns[0]).Return(nil, notFoundErr).Times(3)
+				}
+			}
+			if len(tc.expLipHosts) != 0 {
+				fake_executer.EXPECT().FilepathGlob(device_connectivity.FcHostsPath).Return(
+					[]string{"/sys/class/fc_host/host3", "/sys/class/fc_host/host4"}, nil).Times(2)
+				fake_executer.EXPECT().IoutilReadFile("/sys/class/fc_host/host3/port_state").Return([]byte("Online\n"), nil).Times(2)
+				fake_executer.EXPECT().IoutilReadFile("/sys/class/fc_host/host4/port_state").Return([]byte("Linkdown\n"), nil).Times(2)
+				for _, lipHost := range tc.expLipHosts {
+					fake_executer.EXPECT().OsOpenFile(lipHost, os.O_APPEND|os.O_WRONLY, os.FileMode(0200)).Return(nil, nil)
+					fake_executer.EXPECT().FileWriteString(nil, "1").Return(1, nil)
+				}
+			}
+			fake_helper_scsi.EXPECT().RescanDevices(1, arrayWwns).Return(nil).Times(2)
+
+			// the second rescan is within the minimal interval of the LIPs of the first rescan
+			for i := 0; i < 2; i++ {
+				if err := fc.RescanDevices(1, arrayWwns); err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetZfcpLun(t *testing.T) {
+	testCases := map[int]string{
+		0:       "0x0000000000000000",
+		1:       "0x0001000000000000",
+		0x4010:  "0x4010000000000000",
+		0x10000: "0x0000000100000000",
+	}
+	for lunId, expFcpLun := range testCases {
+		if fcpLun := device_connectivity.GetZfcpLun(lunId); fcpLun != expFcpLun {
+			t.Fatalf("Expected FCP LUN %v of LUN %v, got %v", expFcpLun, lunId, fcpLun)
+		}
+	}
+}
+
+func TestFcZfcpUnits(t *testing.T) {
+	arrayWwns := []string{"500507680B25C0AA"}
+	fcpLun := "0x0001000000000000"
+	portPaths := []string{"/sys/bus/ccw/drivers/zfcp/0.0.1900/0x500507680b25c0aa", "/sys/bus/ccw/drivers/zfcp/0.0.1940/0x500507680b25c0aa"}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	fake_executer := mocks.NewMockExecuterInterface(mockCtrl)
+	fake_helper_scsi := mocks.NewMockOsDeviceConnectivityHelperScsiGenericInterface(mockCtrl)
+	fc := device_connectivity.NewOsDeviceConnectivityFc(fake_executer, device_connectivity.FcConfig{}).(*device_connectivity.OsDeviceConnectivityFc)
+	fc.HelperScsiGeneric = fake_helper_scsi
+	fc.ZfcpUnits = true
+
+	// the unit is added only through the FCP device which it is not attached through yet
+	fake_executer.EXPECT().FilepathGlob("/sys/bus/ccw/drivers/zfcp/*/0x500507680b25c0aa").Return(portPaths, nil)
+	fake_executer.EXPECT().FilepathGlob(portPaths[0]+"/"+fcpLun).Return([]string{portPaths[0] + "/" + fcpLun}, nil)
+	fake_executer.EXPECT().FilepathGlob(portPaths[1]+"/"+fcpLun).Return(nil, nil)
+	fake_executer.EXPECT().OsOpenFile(portPaths[1]+"/unit_add", os.O_APPEND|os.O_WRONLY, os.FileMode(0200)).Return(nil, nil)
+	fake_executer.EXPECT().FileWriteString(nil, fcpLun).Return(len(fcpLun), nil)
+	fake_helper_scsi.EXPECT().RescanDevices(1, arrayWwns).Return(nil)
+
+	if err := fc.RescanDevices(1, arrayWwns); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// the units are read before the devices are removed, the device which is not a zfcp device is skipped
+	sysfs := map[string]string{
+		"/sys/block/sdb/device/hba_id":  "0.0.1940\n",
+		"/sys/block/sdb/device/wwpn":    "0x500507680b25c0aa\n",
+		"/sys/block/sdb/device/fcp_lun": fcpLun + "\n",
+	}
+	readCall := fake_executer.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(filename string) ([]byte, error) {
+		if value, ok := sysfs[filename]; ok {
+			return []byte(value), nil
+		}
+		return nil, os.ErrNotExist
+	}).Times(6)
+	removeCall := fake_helper_scsi.EXPECT().RemovePhysicalDevice([]string{"sdb", "sdc"}).Return(nil).After(readCall)
+	fake_executer.EXPECT().FilepathGlob(portPaths[1]+"/"+fcpLun).Return([]string{portPaths[1] + "/" + fcpLun}, nil).After(removeCall)
+	fake_executer.EXPECT().OsOpenFile(portPaths[1]+"/unit_remove", os.O_APPEND|os.O_WRONLY, os.FileMode(0200)).Return(nil, nil)
+	fake_executer.EXPECT().FileWriteString(nil, fcpLun).Return(len(fcpLun), nil)
+
+	if err := fc.RemovePhysicalDevice([]string{"sdb", "sdc"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
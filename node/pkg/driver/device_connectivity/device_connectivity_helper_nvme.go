@@ -0,0 +1,324 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ibm/ibm-block-csi-driver/node/logger"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executer"
+)
+
+const (
+	NvmeSubsystemControllersPath    = "/sys/class/nvme-subsystem/nvme-subsys*/nvme*/transport"
+	NvmeSubsystemNamespacesPath     = "/sys/class/nvme-subsystem/nvme-subsys*/nvme*n*/wwid"
+	NvmeControllerNamespacesPath    = "/sys/class/nvme-subsystem/nvme-subsys*/nvme*/nvme*n*/wwid"
+	NvmeNativeMultipathParamPath    = "/sys/module/nvme_core/parameters/multipath"
+	NvmeTransportFC                 = "fc"
+	NvmeControllerStateLive         = "live"
+	nvmeAddressSeparator            = ","
+	nvmeAddressKeyValueSeparator    = "="
+	nvmeAddressTargetAddressKey     = "traddr"
+	nvmeFcPortNamePrefix            = "pn-0x"
+	nvmeNativeMultipathEnabledValue = "Y"
+)
+
+var nvmeNamespaceRegex = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+
+// IsNvmeNativeDevice returns true for a native NVMe multipath device (e.g /dev/nvme0n1 or nvme0n1)
+func IsNvmeNativeDevice(device string) bool {
+	return nvmeNamespaceRegex.MatchString(filepath.Base(device))
+}
+
+type NvmeController struct {
+	Name          string // e.g nvme0
+	SubsystemPath string // e.g /sys/class/nvme-subsystem/nvme-subsys0
+	SubsystemNqn  string
+	Transport     string
+	Address       map[string]string
+	State         string
+}
+
+//go:generate mockgen -destination=../../../mocks/mock_OsDeviceConnectivityHelperNvmeInterface.go -package=mocks github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity OsDeviceConnectivityHelperNvmeInterface
+
+type OsDeviceConnectivityHelperNvmeInterface interface {
+	/*
+		This is helper interface for the NVMe connectivity types.
+		It finds controllers and namespaces through /sys/class/nvme-subsystem and supports both
+		native NVMe multipath and dm-multipath on top of the NVMe namespaces.
+	*/
+	GetControllers(transport string) ([]NvmeController, error)
+	RescanControllers(controllers []NvmeController) error
+	WaitForNamespace(controllers []NvmeController, namespaceId int) error
+	GetMpathDevice(volumeId string) (string, error)
+	IsNativeMultipath() bool
+	GetNativeMpathDeviceCondition(namespace string) (bool, string, error)
+}
+
+type OsDeviceConnectivityHelperNvme struct {
+	Executer executer.ExecuterInterface
+}
+
+func NewOsDeviceConnectivityHelperNvme(executer executer.ExecuterInterface) OsDeviceConnectivityHelperNvmeInterface {
+	return &OsDeviceConnectivityHelperNvme{
+		Executer: executer,
+	}
+}
+
+func parseNvmeAddress(address string) map[string]string {
+	// e.g traddr=nn-0x500507680b00c0aa:pn-0x500507680b21c0aa,host_traddr=nn-0x20000090fa9f5a8c:pn-0x10000090fa9f5a8c
+	parsedAddress := make(map[string]string)
+	for _, part := range strings.Split(address, nvmeAddressSeparator) {
+		keyValue := strings.SplitN(strings.TrimSpace(part), nvmeAddressKeyValueSeparator, 2)
+		if len(keyValue) == 2 {
+			parsedAddress[keyValue[0]] = keyValue[1]
+		}
+	}
+	return parsedAddress
+}
+
+func (r OsDeviceConnectivityHelperNvme) GetControllers(transport string) ([]NvmeController, error) {
+	matches, err := r.Executer.FilepathGlob(NvmeSubsystemControllersPath)
+	if err != nil {
+		logger.Errorf("Error while Glob NVMe controllers : {%v}. err : {%v}", NvmeSubsystemControllersPath, err)
+		return nil, err
+	}
+
+	var controllers []NvmeController
+	for _, transportPath := range matches {
+		controllerPath := filepath.Dir(transportPath)
+		if readSysfsValue(r.Executer, transportPath) != transport {
+			continue
+		}
+		subsystemPath := filepath.Dir(controllerPath)
+		controller := NvmeController{
+			Name:          filepath.Base(controllerPath),
+			SubsystemPath: subsystemPath,
+			SubsystemNqn:  readSysfsValue(r.Executer, filepath.Join(subsystemPath, "subsysnqn")),
+			Transport:     transport,
+			Address:       parseNvmeAddress(readSysfsValue(r.Executer, filepath.Join(controllerPath, "address"))),
+			State:         readSysfsValue(r.Executer, filepath.Join(controllerPath, "state")),
+		}
+		logger.Debugf("Found NVMe controller : {%+v}", controller)
+		controllers = append(controllers, controller)
+	}
+	return controllers, nil
+}
+
+func (r OsDeviceConnectivityHelperNvme) RescanControllers(controllers []NvmeController) error {
+	for _, controller := range controllers {
+		filename := fmt.Sprintf("/sys/class/nvme/%s/rescan_controller", controller.Name)
+		f, err := r.Executer.OsOpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200)
+		if err != nil {
+			logger.Errorf("Rescan Error: could not open filename : {%v}. err : {%v}", filename, err)
+			return err
+		}
+
+		defer f.Close()
+
+		logger.Debugf("Rescan NVMe controller : echo 1 > %s", filename)
+		if written, err := r.Executer.FileWriteString(f, "1"); err != nil {
+			logger.Errorf("Rescan Error: could not write to rescan file :{%v}, error : {%v}", filename, err)
+			return err
+		} else if written == 0 {
+			e := &ErrorNothingWasWrittenToScanFileError{filename}
+			logger.Errorf(e.Error())
+			return e
+		}
+	}
+	return nil
+}
+
+func (r OsDeviceConnectivityHelperNvme) getSubsystemNamespaceIds(subsystemPaths map[string]bool) map[int]bool {
+	namespaceIds := make(map[int]bool)
+	for subsystemPath := range subsystemPaths {
+		patterns := []string{
+			filepath.Join(subsystemPath, "nvme*n*", "nsid"),
+			filepath.Join(subsystemPath, "nvme*", "nvme*n*", "nsid"),
+		}
+		for _, pattern := range patterns {
+			matches, err := r.Executer.FilepathGlob(pattern)
+			if err != nil {
+				logger.Warningf("Error while Glob NVMe namespaces : {%v}. err : {%v}", pattern, err)
+				continue
+			}
+			for _, nsidPath := range matches {
+				nsid, err := strconv.Atoi(readSysfsValue(r.Executer, nsidPath))
+				if err == nil {
+					namespaceIds[nsid] = true
+				}
+			}
+		}
+	}
+	return namespaceIds
+}
+
+func (r OsDeviceConnectivityHelperNvme) WaitForNamespace(controllers []NvmeController, namespaceId int) error {
+	subsystemPaths := make(map[string]bool)
+	for _, controller := range controllers {
+		subsystemPaths[controller.SubsystemPath] = true
+	}
+
+	for i := 0; i < WaitForMpathRetries; i++ {
+		if r.getSubsystemNamespaceIds(subsystemPaths)[namespaceId] {
+			logger.Debugf("Namespace ID {%v} was found in NVMe subsystems {%v}", namespaceId, subsystemPaths)
+			return nil
+		}
+		time.Sleep(time.Second * time.Duration(WaitForMpathWaitIntervalSec))
+	}
+	return &NvmeNamespaceNotFoundError{NamespaceId: namespaceId}
+}
+
+func (r OsDeviceConnectivityHelperNvme) IsNativeMultipath() bool {
+	return readSysfsValue(r.Executer, NvmeNativeMultipathParamPath) == nvmeNativeMultipathEnabledValue
+}
+
+func getVolumeUuid(volumeId string) string {
+	volumeIdParts := strings.Split(volumeId, VolumeIdDelimiter)
+	return strings.ToLower(volumeIdParts[len(volumeIdParts)-1])
+}
+
+func (r OsDeviceConnectivityHelperNvme) getNamespacesWwids(patterns []string) (map[string]string, error) {
+	wwidsByNamespace := make(map[string]string)
+	for _, pattern := range patterns {
+		matches, err := r.Executer.FilepathGlob(pattern)
+		if err != nil {
+			logger.Errorf("Error while Glob NVMe namespaces : {%v}. err : {%v}", pattern, err)
+			return nil, err
+		}
+		for _, wwidPath := range matches {
+			namespace := filepath.Base(filepath.Dir(wwidPath))
+			// skip the hidden per path devices (e.g nvme0c1n2) of native NVMe multipath
+			if !nvmeNamespaceRegex.MatchString(namespace) {
+				continue
+			}
+			if _, ok := wwidsByNamespace[namespace]; !ok {
+				wwidsByNamespace[namespace] = strings.ToLower(readSysfsValue(r.Executer, wwidPath))
+			}
+		}
+	}
+	return wwidsByNamespace, nil
+}
+
+func (r OsDeviceConnectivityHelperNvme) getNamespacesByVolumeUuid(volumeUuid string) ([]string, error) {
+	wwidsByNamespace, err := r.getNamespacesWwids([]string{NvmeSubsystemNamespacesPath, NvmeControllerNamespacesPath})
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces []string
+	for namespace, wwid := range wwidsByNamespace {
+		if strings.Contains(wwid, volumeUuid) {
+			logger.Infof("GetMpathDevice: NVMe namespace found: %s with wwid %s", namespace, wwid)
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces, nil
+}
+
+func (r OsDeviceConnectivityHelperNvme) getNamespacesHolders(namespaces []string) (map[string]bool, error) {
+	dms := make(map[string]bool)
+	for _, namespace := range namespaces {
+		pattern := filepath.Join(SysBlockPath, namespace, "holders", "dm-*")
+		matches, err := r.Executer.FilepathGlob(pattern)
+		if err != nil {
+			logger.Errorf("Error while Glob holders of NVMe namespace : {%v}. err : {%v}", pattern, err)
+			return nil, err
+		}
+		for _, holder := range matches {
+			dms[filepath.Join(DevPath, filepath.Base(holder))] = true
+		}
+	}
+	return dms, nil
+}
+
+func (r OsDeviceConnectivityHelperNvme) GetMpathDevice(volumeId string) (string, error) {
+	/*
+		Return Value: "/dev/dm-X" when the namespaces are managed by dm-multipath,
+		or "/dev/nvmeXnY" when native NVMe multipath is in use.
+	*/
+	logger.Infof("GetMpathDevice: Searching NVMe devices for volume : [%s] ", volumeId)
+
+	namespaces, err := r.getNamespacesByVolumeUuid(getVolumeUuid(volumeId))
+	if err != nil {
+		return "", err
+	}
+	if len(namespaces) == 0 {
+		return "", &MultipathDeviceNotFoundForVolumeError{volumeId}
+	}
+
+	if r.IsNativeMultipath() {
+		if len(namespaces) > 1 {
+			return "", &MultipleNvmeNamespacesError{volumeId, namespaces}
+		}
+		return filepath.Join(DevPath, namespaces[0]), nil
+	}
+
+	for i := 0; i < WaitForMpathRetries; i++ {
+		dms, err := r.getNamespacesHolders(namespaces)
+		if err != nil {
+			return "", err
+		}
+		if len(dms) > 1 {
+			return "", &MultipleDmDevicesError{volumeId, dms}
+		}
+		for dm := range dms {
+			logger.Infof("GetMpathDevice: DM found: %s for volume %s", dm, volumeId)
+			return dm, nil
+		}
+		time.Sleep(time.Second * time.Duration(WaitForMpathWaitIntervalSec))
+	}
+	return "", &MultipathDeviceNotFoundForVolumeError{volumeId}
+}
+
+func (r OsDeviceConnectivityHelperNvme) GetNativeMpathDeviceCondition(namespace string) (bool, string, error) {
+	subsystemNamespacePattern := filepath.Join(filepath.Dir(filepath.Dir(NvmeSubsystemNamespacesPath)), namespace)
+	matches, err := r.Executer.FilepathGlob(subsystemNamespacePattern)
+	if err != nil {
+		logger.Errorf("Error while Glob NVMe subsystem of namespace : {%v}. err : {%v}", subsystemNamespacePattern, err)
+		return false, "", err
+	}
+	if len(matches) == 0 {
+		return true, fmt.Sprintf("NVMe namespace %s was not found in any NVMe subsystem", namespace), nil
+	}
+
+	statePattern := filepath.Join(filepath.Dir(matches[0]), "nvme*", "state")
+	statePaths, err := r.Executer.FilepathGlob(statePattern)
+	if err != nil {
+		logger.Errorf("Error while Glob NVMe controllers state : {%v}. err : {%v}", statePattern, err)
+		return false, "", err
+	}
+
+	var unhealthyPaths []string
+	for _, statePath := range statePaths {
+		controller := filepath.Base(filepath.Dir(statePath))
+		if state := readSysfsValue(r.Executer, statePath); state != NvmeControllerStateLive {
+			logger.Warningf("Controller {%v} of NVMe namespace {%v} is not live: state {%v}", controller, namespace, state)
+			unhealthyPaths = append(unhealthyPaths, controller)
+		}
+	}
+
+	isReadOnly := isDeviceReadOnly(r.Executer, filepath.Join(SysBlockPath, namespace, "ro"))
+	abnormal, message := buildMpathDeviceCondition(namespace, len(statePaths), unhealthyPaths, isReadOnly)
+	return abnormal, message, nil
+}
@@ -0,0 +1,139 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ibm/ibm-block-csi-driver/node/mocks"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
+)
+
+func TestNvmeGetMpathDevice(t *testing.T) {
+	volumeId := "SVC:6005076810810261F800000000000A5B"
+	wwid := "eui.6005076810810261f800000000000a5b"
+	testCases := []struct {
+		name               string
+		subsystemWwids     map[string]string
+		controllerWwids    map[string]string
+		nativeMultipath    string
+		holders            map[string][]string
+		expErrType         reflect.Type
+		expMpathDevicePath string
+	}{
+		{
+			name:            "Should fail when no namespace has the volume wwid",
+			subsystemWwids:  map[string]string{"/sys/class/nvme-subsystem/nvme-subsys0/nvme0n1/wwid": "eui.0000"},
+			controllerWwids: map[string]string{},
+			expErrType:      reflect.TypeOf(&device_connectivity.MultipathDeviceNotFoundForVolumeError{}),
+		},
+		{
+			name: "Should return the namespace head device when native multipath is enabled",
+			subsystemWwids: map[string]string{
+				"/sys/class/nvme-subsystem/nvme-subsys0/nvme0n1/wwid":   wwid,
+				"/sys/class/nvme-subsystem/nvme-subsys0/nvme0c1n1/wwid": wwid,
+			},
+			controllerWwids:    map[string]string{},
+			nativeMultipath:    "Y",
+			expMpathDevicePath: "/dev/nvme0n1",
+		},
+		{
+			name:           "Should return the dm device holding the namespaces when native multipath is disabled",
+			subsystemWwids: map[string]string{},
+			controllerWwids: map[string]string{
+				"/sys/class/nvme-subsystem/nvme-subsys0/nvme0/nvme0n1/wwid": wwid,
+				"/sys/class/nvme-subsystem/nvme-subsys0/nvme1/nvme1n1/wwid": wwid,
+			},
+			nativeMultipath: "N",
+			holders: map[string][]string{
+				"/sys/block/nvme0n1/holders/dm-*": {"/sys/block/nvme0n1/holders/dm-3"},
+				"/sys/block/nvme1n1/holders/dm-*": {"/sys/block/nvme1n1/holders/dm-3"},
+			},
+			expMpathDevicePath: "/dev/dm-3",
+		},
+		{
+			name:           "Should fail when the namespaces are held by more than one dm device",
+			subsystemWwids: map[string]string{},
+			controllerWwids: map[string]string{
+				"/sys/class/nvme-subsystem/nvme-subsys0/nvme0/nvme0n1/wwid": wwid,
+				"/sys/class/nvme-subsystem/nvme-subsys0/nvme1/nvme1n1/wwid": wwid,
+			},
+			nativeMultipath: "N",
+			holders: map[string][]string{
+				"/sys/block/nvme0n1/holders/dm-*": {"/sys/block/nvme0n1/holders/dm-3"},
+				"/sys/block/nvme1n1/holders/dm-*": {"/sys/block/nvme1n1/holders/dm-4"},
+			},
+			expErrType: reflect.TypeOf(&device_connectivity.MultipleDmDevicesError{}),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+
+			globs := map[string][]string{
+				device_connectivity.NvmeSubsystemNamespacesPath:  keys(tc.subsystemWwids),
+				device_connectivity.NvmeControllerNamespacesPath: keys(tc.controllerWwids),
+			}
+			for pattern, matches := range tc.holders {
+				globs[pattern] = matches
+			}
+			files := map[string]string{device_connectivity.NvmeNativeMultipathParamPath: tc.nativeMultipath}
+			for path, value := range tc.subsystemWwids {
+				files[path] = value
+			}
+			for path, value := range tc.controllerWwids {
+				files[path] = value
+			}
+
+			fakeExecuter.EXPECT().FilepathGlob(gomock.Any()).DoAndReturn(func(pattern string) ([]string, error) {
+				return globs[pattern], nil
+			}).AnyTimes()
+			fakeExecuter.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(path string) ([]byte, error) {
+				return []byte(files[path] + "\n"), nil
+			}).AnyTimes()
+
+			helperNvme := device_connectivity.NewOsDeviceConnectivityHelperNvme(fakeExecuter)
+			mpathDevicePath, err := helperNvme.GetMpathDevice(volumeId)
+
+			if tc.expErrType != nil {
+				if reflect.TypeOf(err) != tc.expErrType {
+					t.Fatalf("Wrong error type: expected %v, got %v", tc.expErrType, reflect.TypeOf(err))
+				}
+			} else if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if mpathDevicePath != tc.expMpathDevicePath {
+				t.Fatalf("Wrong mpath device: expected %v, got %v", tc.expMpathDevicePath, mpathDevicePath)
+			}
+		})
+	}
+}
+
+func keys(m map[string]string) []string {
+	var result []string
+	for key := range m {
+		result = append(result, key)
+	}
+	return result
+}
@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,6 +44,7 @@ type OsDeviceConnectivityHelperScsiGenericInterface interface {
 	GetMpathDevice(volumeId string) (string, error)
 	FlushMultipathDevice(mpathDevice string) error
 	RemovePhysicalDevice(sysDevices []string) error
+	GetMpathDeviceCondition(mpathDevice string) (bool, string, error)
 }
 
 type OsDeviceConnectivityHelperScsiGeneric struct {
@@ -51,6 +53,40 @@ type OsDeviceConnectivityHelperScsiGeneric struct {
 	MutexMultipathF *sync.Mutex
 }
 
+const (
+	fcScsiTargetIdFileName       = "scsi_target_id"
+	iscsiSessionTargetIdFileName = "target_id"
+	ScsiWildcardId               = -1
+)
+
+// ScsiTarget is a scsi target of a host, its channel and target are wildcards if they are ScsiWildcardId.
+type ScsiTarget struct {
+	HostId   int
+	Channel  int
+	TargetId int
+}
+
+// getScanCommand returns the "C T L" command of the scan file of the host, with "-" for the wildcards.
+func (t ScsiTarget) getScanCommand(lunId int) string {
+	return fmt.Sprintf("%s %s %d", getScsiScanId(t.Channel), getScsiScanId(t.TargetId), lunId)
+}
+
+func getScsiScanId(id int) string {
+	if id == ScsiWildcardId {
+		return "-"
+	}
+	return strconv.Itoa(id)
+}
+
+// arrayTargetPath is a targetname file of an iSCSI session, or a port_name file of an FC remote port, of the array.
+type arrayTargetPath struct {
+	hostNumber int
+	path       string
+	isIscsi    bool
+}
+
+var fcRemotePortChannelRegexp = regexp.MustCompile(`rport-[0-9]+:([0-9]+)-`)
+
 type WaitForMpathResult struct {
 	devicesPaths []string
 	err          error
@@ -65,14 +101,26 @@ const (
 	DevPath                     = "/dev"
 	ConnectionTypeISCSI         = "iscsi"
 	ConnectionTypeFC            = "fc"
+	ConnectionTypeNVMEoFC       = "nvmeofc"
 	WaitForMpathRetries         = 5
 	WaitForMpathWaitIntervalSec = 1
 	FC_HOST_SYSFS_PATH          = "/sys/class/fc_remote_ports/rport-*/port_name"
+	FcHostPortStatePath         = "/sys/class/fc_host/host%d/port_state"
+	fcPortStateFileName         = "port_state"
+	FcPortStateOnline           = "Online"
 	IscsiHostRexExPath          = "/sys/class/iscsi_host/host*/device/session*/iscsi_session/session*/targetname"
 	MpathdSeparator             = ","
+	mpathdDmWildcard            = "%d"
+	mpathdWwidWildcard          = "%w"
+	mpathdVendorWildcard        = "%v"
+	ibmVendor                   = "IBM"
 	multipathdCmd               = "multipathd"
 	multipathCmd                = "multipath"
 	VolumeIdDelimiter           = ":"
+	SysBlockPath                = "/sys/block"
+	mpathPathStateFailed        = "failed"
+	mpathPathCheckerFaulty      = "faulty"
+	mpathPathDevStateOffline    = "offline"
 )
 
 func NewOsDeviceConnectivityHelperScsiGeneric(executer executer.ExecuterInterface) OsDeviceConnectivityHelperScsiGenericInterface {
@@ -85,7 +133,7 @@ func NewOsDeviceConnectivityHelperScsiGeneric(executer executer.ExecuterInterfac
 
 func (r OsDeviceConnectivityHelperScsiGeneric) RescanDevices(lunId int, arrayIdentifiers []string) error {
 	logger.Debugf("Rescan : Start rescan on specific lun, on lun : {%v}, with array identifiers : {%v}", lunId, arrayIdentifiers)
-	var hostIDs []int
+	var scsiTargets []ScsiTarget
 	var errStrings []string
 	if len(arrayIdentifiers) == 0 {
 		e := &ErrorNotFoundArrayIdentifiers{lunId}
@@ -93,21 +141,31 @@ func (r OsDeviceConnectivityHelperScsiGeneric) RescanDevices(lunId int, arrayIde
 		return e
 	}
 
+	offlineErr := &StorageTargetsOfflineError{}
 	for _, arrayIdentifier := range arrayIdentifiers {
-		hostsId, e := r.Helper.GetHostsIdByArrayIdentifier(arrayIdentifier)
+		arrayScsiTargets, e := r.Helper.GetScsiTargetsByArrayIdentifier(arrayIdentifier)
 		if e != nil {
 			logger.Errorf(e.Error())
 			errStrings = append(errStrings, e.Error())
+			if targetOfflineErr, isOffline := e.(*ConnectivityStorageTargetOfflineError); isOffline {
+				offlineErr.OfflineTargets = append(offlineErr.OfflineTargets, targetOfflineErr)
+			} else {
+				offlineErr.NotFoundTargets = append(offlineErr.NotFoundTargets, arrayIdentifier)
+			}
 		}
-		hostIDs = append(hostIDs, hostsId...)
+		scsiTargets = append(scsiTargets, arrayScsiTargets...)
+	}
+	if len(scsiTargets) == 0 && len(offlineErr.OfflineTargets) != 0 {
+		// the storage is visible, so its offline ports are reported rather than the targets which are not found
+		return offlineErr
 	}
-	if len(hostIDs) == 0 && len(errStrings) != 0 {
+	if len(scsiTargets) == 0 && len(errStrings) != 0 {
 		err := errors.New(strings.Join(errStrings, ","))
 		return err
 	}
-	for _, hostNumber := range hostIDs {
+	for _, scsiTarget := range scsiTargets {
 
-		filename := fmt.Sprintf("/sys/class/scsi_host/host%d/scan", hostNumber)
+		filename := fmt.Sprintf("/sys/class/scsi_host/host%d/scan", scsiTarget.HostId)
 		f, err := r.Executer.OsOpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200)
 		if err != nil {
 			logger.Errorf("Rescan Error: could not open filename : {%v}. err : {%v}", filename, err)
@@ -116,7 +174,7 @@ func (r OsDeviceConnectivityHelperScsiGeneric) RescanDevices(lunId int, arrayIde
 
 		defer f.Close()
 
-		scanCmd := fmt.Sprintf("- - %d", lunId)
+		scanCmd := scsiTarget.getScanCommand(lunId)
 		logger.Debugf("Rescan host device : echo %s > %s", scanCmd, filename)
 		if written, err := r.Executer.FileWriteString(f, scanCmd); err != nil {
 			logger.Errorf("Rescan Error: could not write to rescan file :{%v}, error : {%v}", filename, err)
@@ -241,6 +299,97 @@ func (r OsDeviceConnectivityHelperScsiGeneric) RemovePhysicalDevice(sysDevices [
 	return nil
 }
 
+func (r OsDeviceConnectivityHelperScsiGeneric) GetMpathDeviceCondition(mpathDevice string) (bool, string, error) {
+	/*
+		Return Value: abnormal, message describing the condition of the multipath device, error.
+		The condition is based on the state of the paths of the multipath device (failed, faulty or offline paths)
+		and on the read only flag of the device.
+	*/
+	baseDevice := filepath.Base(mpathDevice)
+	logger.Debugf("Checking condition of mpath device : {%v}", baseDevice)
+
+	slavesPattern := filepath.Join(SysBlockPath, baseDevice, "slaves", "*")
+	slavesPaths, err := r.Executer.FilepathGlob(slavesPattern)
+	if err != nil {
+		logger.Errorf("Error while Glob slaves of mpath device : {%v}. err : {%v}", slavesPattern, err)
+		return false, "", err
+	}
+	slaves := make(map[string]bool)
+	for _, slavePath := range slavesPaths {
+		slaves[filepath.Base(slavePath)] = true
+	}
+
+	formatTemplate := strings.Join([]string{"%d", "%t", "%T", "%o"}, MpathdSeparator)
+	args := []string{"show", "paths", "raw", "format", "\"", formatTemplate, "\""}
+	out, err := r.Executer.ExecuteWithTimeout(TimeOutMultipathdCmd, multipathdCmd, args)
+	if err != nil {
+		return false, "", err
+	}
+
+	var unhealthyPaths []string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		lineParts := strings.Split(scanner.Text(), MpathdSeparator)
+		if len(lineParts) < 4 {
+			continue
+		}
+		dev, dmState, checkerState, devState := strings.TrimSpace(lineParts[0]), strings.TrimSpace(lineParts[1]),
+			strings.TrimSpace(lineParts[2]), strings.TrimSpace(lineParts[3])
+		if !slaves[dev] {
+			continue
+		}
+		if dmState == mpathPathStateFailed || checkerState == mpathPathCheckerFaulty || devState == mpathPathDevStateOffline {
+			logger.Warningf("Path {%v} of mpath device {%v} is not healthy: dm state {%v}, checker state {%v}, device state {%v}",
+				dev, baseDevice, dmState, checkerState, devState)
+			unhealthyPaths = append(unhealthyPaths, dev)
+		}
+	}
+
+	roFile := filepath.Join(SysBlockPath, baseDevice, "ro")
+	isReadOnly := isDeviceReadOnly(r.Executer, roFile)
+
+	abnormal, message := buildMpathDeviceCondition(baseDevice, len(slaves), unhealthyPaths, isReadOnly)
+	return abnormal, message, nil
+}
+
+func isDeviceReadOnly(executer executer.ExecuterInterface, roFile string) bool {
+	ro, err := executer.IoutilReadFile(roFile)
+	if err != nil {
+		logger.Warningf("Could not read read only flag from file : {%v}, error : {%v}", roFile, err)
+		return false
+	}
+	return strings.TrimSpace(string(ro)) == "1"
+}
+
+// readSysfsValue returns the trimmed value of a sysfs file, or an empty string if it cannot be read.
+func readSysfsValue(executer executer.ExecuterInterface, path string) string {
+	value, err := executer.IoutilReadFile(path)
+	if err != nil {
+		logger.Debugf("Could not read file : {%v}, error : {%v}", path, err)
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+func buildMpathDeviceCondition(device string, pathsCount int, unhealthyPaths []string, isReadOnly bool) (bool, string) {
+	var problems []string
+	if pathsCount == 0 {
+		problems = append(problems, "no paths were found")
+	} else if len(unhealthyPaths) > 0 {
+		sort.Strings(unhealthyPaths)
+		problems = append(problems, fmt.Sprintf("%d of %d paths are failed or faulty %v, the device is degraded",
+			len(unhealthyPaths), pathsCount, unhealthyPaths))
+	}
+	if isReadOnly {
+		problems = append(problems, "the device is read only")
+	}
+
+	if len(problems) > 0 {
+		return true, fmt.Sprintf("Multipath device %s is abnormal: %s", device, strings.Join(problems, ", "))
+	}
+	return false, fmt.Sprintf("Multipath device %s is healthy, all %d paths are active", device, pathsCount)
+}
+
 // ============== OsDeviceConnectivityHelperInterface ==========================
 
 //go:generate mockgen -destination=../../../mocks/mock_OsDeviceConnectivityHelperInterface.go -package=mocks github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity OsDeviceConnectivityHelperInterface
@@ -251,9 +400,11 @@ type OsDeviceConnectivityHelperInterface interface {
 		Mainly for writting clean unit testing, so we can Mock this interface in order to unit test OsDeviceConnectivityHelperGeneric logic.
 	*/
 	GetHostsIdByArrayIdentifier(arrayIdentifier string) ([]int, error)
+	GetScsiTargetsByArrayIdentifier(arrayIdentifier string) ([]ScsiTarget, error)
 	GetDmsPath(volumeId string) (string, error)
 	GetWwnByScsiInq(dev string) (string, error)
 	ReloadMultipath() error
+	GetIbmDms() (map[string]string, error)
 }
 
 type OsDeviceConnectivityHelperGeneric struct {
@@ -273,7 +424,74 @@ func (o OsDeviceConnectivityHelperGeneric) GetHostsIdByArrayIdentifier(arrayIden
 		Description:
 			This function find all the hosts IDs under directory /sys/class/fc_host/ or /sys/class/iscsi_host"
 			So the function goes over all the above hosts and return back only the host numbers as a list.
+			For FC, only the hosts whose port and remote port of the array are Online are returned.
+			The hosts of iSER sessions are under /sys/class/iscsi_host as well as the hosts of TCP sessions.
 	*/
+	targetPaths, err := o.getArrayTargetPaths(arrayIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	var HostIDs []int
+	for _, targetPath := range targetPaths {
+		HostIDs = append(HostIDs, targetPath.hostNumber)
+	}
+	return HostIDs, nil
+}
+
+// GetScsiTargetsByArrayIdentifier returns the scsi targets of the array identifier, with a wildcard channel and target
+// on the hosts whose scsi target of the array can't be resolved.
+func (o OsDeviceConnectivityHelperGeneric) GetScsiTargetsByArrayIdentifier(arrayIdentifier string) ([]ScsiTarget, error) {
+	targetPaths, err := o.getArrayTargetPaths(arrayIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	var scsiTargets []ScsiTarget
+	isScsiTargetFound := make(map[ScsiTarget]bool)
+	for _, targetPath := range targetPaths {
+		scsiTarget, err := o.getScsiTarget(targetPath)
+		if err != nil {
+			logger.Warningf("Could not resolve the scsi target of {%v}, falling back to all the channels and targets of host {%v} : {%v}",
+				targetPath.path, targetPath.hostNumber, err)
+			scsiTarget = ScsiTarget{HostId: targetPath.hostNumber, Channel: ScsiWildcardId, TargetId: ScsiWildcardId}
+		}
+		if !isScsiTargetFound[scsiTarget] {
+			isScsiTargetFound[scsiTarget] = true
+			scsiTargets = append(scsiTargets, scsiTarget)
+		}
+	}
+	return scsiTargets, nil
+}
+
+// getScsiTarget returns the scsi target of the remote port of FC, by its scsi_target_id, or of the session of iSCSI,
+// by its target_id. The channel of an iSCSI session is always 0.
+func (o OsDeviceConnectivityHelperGeneric) getScsiTarget(targetPath arrayTargetPath) (ScsiTarget, error) {
+	scsiTarget := ScsiTarget{HostId: targetPath.hostNumber}
+	targetIdPath := filepath.Join(filepath.Dir(targetPath.path), iscsiSessionTargetIdFileName)
+	if !targetPath.isIscsi {
+		targetIdPath = filepath.Join(filepath.Dir(targetPath.path), fcScsiTargetIdFileName)
+		channelMatch := fcRemotePortChannelRegexp.FindStringSubmatch(targetPath.path)
+		if channelMatch == nil {
+			return scsiTarget, fmt.Errorf("could not find the channel of remote port %s", targetPath.path)
+		}
+		scsiTarget.Channel, _ = strconv.Atoi(channelMatch[1])
+	}
+	targetId, err := o.Executer.IoutilReadFile(targetIdPath)
+	if err != nil {
+		return scsiTarget, err
+	}
+	scsiTarget.TargetId, err = strconv.Atoi(strings.TrimSpace(string(targetId)))
+	if err != nil {
+		return scsiTarget, err
+	}
+	if scsiTarget.TargetId < 0 {
+		// the remote port is not a scsi target, e.g. while it is blocked
+		return scsiTarget, fmt.Errorf("no scsi target id in %s", targetIdPath)
+	}
+	return scsiTarget, nil
+}
+
+// getArrayTargetPaths returns the targetname or port_name files which match the array identifier, with their hosts.
+func (o OsDeviceConnectivityHelperGeneric) getArrayTargetPaths(arrayIdentifier string) ([]arrayTargetPath, error) {
 	//arrayIdentifier is wwn, value is 500507680b25c0aa
 	var targetFilePath string
 	var regexpValue string
@@ -290,7 +508,8 @@ func (o OsDeviceConnectivityHelperGeneric) GetHostsIdByArrayIdentifier(arrayIden
 		regexpValue = "rport-([0-9]+)"
 	}
 
-	var HostIDs []int
+	var targetPaths []arrayTargetPath
+	var offlinePorts []string
 	matches, err := o.Executer.FilepathGlob(targetFilePath)
 	if err != nil {
 		logger.Errorf("Error while Glob targetFilePath : {%v}. err : {%v}", targetFilePath, err)
@@ -329,19 +548,53 @@ func (o OsDeviceConnectivityHelperGeneric) GetHostsIdByArrayIdentifier(arrayIden
 				}
 			}
 
-			HostIDs = append(HostIDs, hostNumber)
+			if !isIscsi {
+				if offlinePort := o.getFcOfflinePort(targetPath, hostNumber); offlinePort != "" {
+					logger.Warningf("Skipping host ID {%v} of storage target (%s), since %s", hostNumber, arrayIdentifier, offlinePort)
+					offlinePorts = append(offlinePorts, offlinePort)
+					continue
+				}
+			}
+
+			targetPaths = append(targetPaths, arrayTargetPath{hostNumber: hostNumber, path: targetPath, isIscsi: isIscsi})
 			logger.Debugf("portState path (%s) was found. Adding host ID {%v} to the id list.", targetPath, hostNumber)
 		}
 	}
 
-	if len(HostIDs) == 0 {
-		return []int{}, &ConnectivityIdentifierStorageTargetNotFoundError{StorageTargetName: arrayIdentifier, DirectoryPath: targetFilePath}
+	if len(targetPaths) == 0 && len(offlinePorts) != 0 {
+		return nil, &ConnectivityStorageTargetOfflineError{StorageTargetName: arrayIdentifier, OfflinePorts: offlinePorts}
+	}
+	if len(targetPaths) == 0 {
+		return nil, &ConnectivityIdentifierStorageTargetNotFoundError{StorageTargetName: arrayIdentifier, DirectoryPath: targetFilePath}
 	}
 
-	return HostIDs, nil
+	return targetPaths, nil
 
 }
 
+// getFcOfflinePort returns which port of the path through the remote port is not Online, either the remote port or the
+// port of its host, or an empty string if both are Online.
+func (o OsDeviceConnectivityHelperGeneric) getFcOfflinePort(rportPortNamePath string, hostNumber int) string {
+	rportPath := filepath.Dir(rportPortNamePath)
+	if state := o.readFcPortState(filepath.Join(rportPath, fcPortStateFileName)); state != FcPortStateOnline {
+		return fmt.Sprintf("%s is %s", filepath.Base(rportPath), state)
+	}
+	if state := o.readFcPortState(fmt.Sprintf(FcHostPortStatePath, hostNumber)); state != FcPortStateOnline {
+		return fmt.Sprintf("host%d is %s", hostNumber, state)
+	}
+	return ""
+}
+
+func (o OsDeviceConnectivityHelperGeneric) readFcPortState(portStatePath string) string {
+	portState, err := o.Executer.IoutilReadFile(portStatePath)
+	if err != nil {
+		// the state of the port is unknown, so the port is not skipped
+		logger.Warningf("Could not read port state from file : {%v}, error : {%v}", portStatePath, err)
+		return FcPortStateOnline
+	}
+	return strings.TrimSpace(string(portState))
+}
+
 func (o OsDeviceConnectivityHelperGeneric) GetWwnByScsiInq(dev string) (string, error) {
 	/* scsi inq example
 	$> sg_inq -p 0x83 /dev/mapper/mpathhe
@@ -486,10 +739,35 @@ func (o OsDeviceConnectivityHelperGeneric) GetDmsPath(volumeId string) (string,
 	return dm, nil
 }
 
+func (o OsDeviceConnectivityHelperGeneric) GetIbmDms() (map[string]string, error) {
+	/*
+		Return Value: the wwids of the multipath devices of IBM storage by their "dm-X" names.
+	*/
+	mpathdOutput, err := o.Helper.ShowMaps(mpathdDmWildcard, mpathdWwidWildcard, mpathdVendorWildcard)
+	if err != nil {
+		return nil, err
+	}
+
+	wwidsByDm := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(mpathdOutput))
+	for scanner.Scan() {
+		lineParts := strings.Split(scanner.Text(), MpathdSeparator)
+		if len(lineParts) != 3 {
+			continue
+		}
+		dm, wwid, vendor := strings.TrimSpace(lineParts[0]), strings.TrimSpace(lineParts[1]), strings.TrimSpace(lineParts[2])
+		if vendor == ibmVendor {
+			wwidsByDm[filepath.Base(dm)] = strings.ToLower(wwid)
+		}
+	}
+	return wwidsByDm, nil
+}
+
 //go:generate mockgen -destination=../../../mocks/mock_GetDmsPathHelperInterface.go -package=mocks github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity GetDmsPathHelperInterface
 
 type GetDmsPathHelperInterface interface {
 	WaitForDmToExist(volumeUuid string, maxRetries int, intervalSeconds int) (string, error)
+	ShowMaps(formatWildcards ...string) (string, error)
 }
 
 type GetDmsPathHelperGeneric struct {
@@ -500,18 +778,21 @@ func NewGetDmsPathHelperGeneric(executer executer.ExecuterInterface) GetDmsPathH
 	return &GetDmsPathHelperGeneric{executer: executer}
 }
 
-func (o GetDmsPathHelperGeneric) WaitForDmToExist(volumeUuid string, maxRetries int, intervalSeconds int) (string, error) {
-
-	formatTemplate := strings.Join([]string{"%d", "%w"}, MpathdSeparator)
+func (o GetDmsPathHelperGeneric) ShowMaps(formatWildcards ...string) (string, error) {
+	formatTemplate := strings.Join(formatWildcards, MpathdSeparator)
 	args := []string{"show", "maps", "raw", "format", "\"", formatTemplate, "\""}
+	out, err := o.executer.ExecuteWithTimeout(TimeOutMultipathdCmd, multipathdCmd, args)
+	return string(out), err
+}
+
+func (o GetDmsPathHelperGeneric) WaitForDmToExist(volumeUuid string, maxRetries int, intervalSeconds int) (string, error) {
 	var err error
 	for i := 0; i < maxRetries; i++ {
 		err = nil
-		out, err := o.executer.ExecuteWithTimeout(TimeOutMultipathdCmd, multipathdCmd, args)
+		dms, err := o.ShowMaps(mpathdDmWildcard, mpathdWwidWildcard)
 		if err != nil {
 			return "", err
 		}
-		dms := string(out)
 		if !strings.Contains(dms, volumeUuid) {
 			err = os.ErrNotExist
 		} else {
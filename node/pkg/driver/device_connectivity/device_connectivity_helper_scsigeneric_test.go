@@ -22,6 +22,7 @@ import (
 	"github.com/ibm/ibm-block-csi-driver/node/mocks"
 	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
 	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executer"
+	"os"
 	"reflect"
 	"strings"
 	"sync"
@@ -725,11 +726,31 @@ func TestGetHostsIdByArrayIdentifier(t *testing.T) {
 					data:          []byte("fakeWWN"),
 					err:           nil,
 				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-33:0-0/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_host/host33/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
 				ioutilReadFileReturn{
 					ReadFileParam: "/sys/class/fc_remote_ports/rport-34:0-0/port_name",
 					data:          []byte("0xfakeWWN"),
 					err:           nil,
 				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-34:0-0/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_host/host34/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
 				ioutilReadFileReturn{
 					ReadFileParam: "/sys/class/fc_remote_ports/rport-35:0-0/port_name",
 					data:          []byte("fakeWWN_other"),
@@ -763,11 +784,31 @@ func TestGetHostsIdByArrayIdentifier(t *testing.T) {
 					data:          []byte("0xfakeWWN"),
 					err:           nil,
 				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-5:0-0/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_host/host5/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
 				ioutilReadFileReturn{
 					ReadFileParam: "/sys/class/fc_remote_ports/rport-6:0-0/port_name",
 					data:          []byte("fakeWWN"),
 					err:           nil,
 				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-6:0-0/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_host/host6/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
 			},
 			arrayIdentifier: "fakeWWN",
 
@@ -780,6 +821,94 @@ func TestGetHostsIdByArrayIdentifier(t *testing.T) {
 			expErrType:  nil,
 			expHostList: []int{5, 6},
 		},
+
+		{
+			name: "Should skip host7 when its remote port is blocked and host8 when its port is linkdown",
+			ioutilReadFileReturns: []ioutilReadFileReturn{
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-7:0-0/port_name",
+					data:          []byte("fakeWWN"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-7:0-0/port_state",
+					data:          []byte("Blocked\n"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-8:0-0/port_name",
+					data:          []byte("fakeWWN"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-8:0-0/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_host/host8/port_state",
+					data:          []byte("Linkdown\n"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-9:0-0/port_name",
+					data:          []byte("fakeWWN"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-9:0-0/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_host/host9/port_state",
+					data:          []byte("Online\n"),
+					err:           nil,
+				},
+			},
+			arrayIdentifier: "fakeWWN",
+
+			globReturnMatches: []string{
+				"/sys/class/fc_remote_ports/rport-7:0-0/port_name",
+				"/sys/class/fc_remote_ports/rport-8:0-0/port_name",
+				"/sys/class/fc_remote_ports/rport-9:0-0/port_name",
+			},
+			globReturnErr: nil,
+
+			expErrType:  nil,
+			expHostList: []int{9},
+		},
+
+		{
+			name: "Should fail with offline error when the array WWN is visible only through ports which are not Online",
+			ioutilReadFileReturns: []ioutilReadFileReturn{
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-7:0-0/port_name",
+					data:          []byte("fakeWWN"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-7:0-0/port_state",
+					data:          []byte("Not Present\n"),
+					err:           nil,
+				},
+				ioutilReadFileReturn{
+					ReadFileParam: "/sys/class/fc_remote_ports/rport-8:0-0/port_name",
+					data:          []byte("fakeWWN_other"),
+					err:           nil,
+				},
+			},
+			arrayIdentifier: "fakeWWN",
+
+			globReturnMatches: []string{
+				"/sys/class/fc_remote_ports/rport-7:0-0/port_name",
+				"/sys/class/fc_remote_ports/rport-8:0-0/port_name",
+			},
+			globReturnErr: nil,
+
+			expErrType:  reflect.TypeOf(&device_connectivity.ConnectivityStorageTargetOfflineError{}),
+			expHostList: nil,
+		},
 	}
 
 	for _, tc := range testCasesFc {
@@ -826,3 +955,273 @@ func TestGetHostsIdByArrayIdentifier(t *testing.T) {
 		})
 	}
 }
+
+func TestGetScsiTargetsByArrayIdentifier(t *testing.T) {
+	testCases := []struct {
+		name            string
+		arrayIdentifier string
+		globPath        string
+		globMatches     []string
+		sysfs           map[string]string
+		expScsiTargets  []device_connectivity.ScsiTarget
+	}{
+		{
+			name:            "Should resolve the scsi targets of the FC remote ports, and fall back to the wildcards without a target id",
+			arrayIdentifier: "500507680b25c0aa",
+			globPath:        device_connectivity.FC_HOST_SYSFS_PATH,
+			globMatches: []string{
+				"/sys/class/fc_remote_ports/rport-3:0-1/port_name",
+				"/sys/class/fc_remote_ports/rport-4:0-1/port_name",
+			},
+			sysfs: map[string]string{
+				"/sys/class/fc_remote_ports/rport-3:0-1/port_name":      "0x500507680b25c0aa\n",
+				"/sys/class/fc_remote_ports/rport-3:0-1/scsi_target_id": "2\n",
+				"/sys/class/fc_remote_ports/rport-4:0-1/port_name":      "0x500507680b25c0aa\n",
+				"/sys/class/fc_remote_ports/rport-4:0-1/scsi_target_id": "-1\n",
+			},
+			expScsiTargets: []device_connectivity.ScsiTarget{
+				{HostId: 3, Channel: 0, TargetId: 2},
+				{HostId: 4, Channel: device_connectivity.ScsiWildcardId, TargetId: device_connectivity.ScsiWildcardId},
+			},
+		},
+		{
+			name:            "Should resolve the scsi targets of the iSCSI sessions",
+			arrayIdentifier: "iqn.1986-03.com.ibm:2145.v7k194.node2",
+			globPath:        device_connectivity.IscsiHostRexExPath,
+			globMatches: []string{
+				"/sys/class/iscsi_host/host1/device/session1/iscsi_session/session1/targetname",
+				"/sys/class/iscsi_host/host2/device/session2/iscsi_session/session2/targetname",
+			},
+			sysfs: map[string]string{
+				"/sys/class/iscsi_host/host1/device/session1/iscsi_session/session1/targetname": "iqn.1986-03.com.ibm:2145.v7k194.node2\n",
+				"/sys/class/iscsi_host/host1/device/session1/iscsi_session/session1/target_id":  "0\n",
+				"/sys/class/iscsi_host/host2/device/session2/iscsi_session/session2/targetname": "iqn.1986-03.com.ibm:2145.v7k194.node2\n",
+				"/sys/class/iscsi_host/host2/device/session2/iscsi_session/session2/target_id":  "0\n",
+			},
+			expScsiTargets: []device_connectivity.ScsiTarget{
+				{HostId: 1, Channel: 0, TargetId: 0},
+				{HostId: 2, Channel: 0, TargetId: 0},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			fake_executer := mocks.NewMockExecuterInterface(mockCtrl)
+			fake_executer.EXPECT().FilepathGlob(tc.globPath).Return(tc.globMatches, nil)
+			fake_executer.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(filename string) ([]byte, error) {
+				if value, ok := tc.sysfs[filename]; ok {
+					return []byte(value), nil
+				}
+				// the unknown port states don't skip the remote ports
+				return nil, os.ErrNotExist
+			}).AnyTimes()
+
+			helperGeneric := device_connectivity.NewOsDeviceConnectivityHelperGeneric(fake_executer)
+
+			scsiTargets, err := helperGeneric.GetScsiTargetsByArrayIdentifier(tc.arrayIdentifier)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(scsiTargets, tc.expScsiTargets) {
+				t.Fatalf("Expected scsi targets %v, got %v", tc.expScsiTargets, scsiTargets)
+			}
+		})
+	}
+}
+
+func TestHelperRescanDevices(t *testing.T) {
+	offlineErr := &device_connectivity.ConnectivityStorageTargetOfflineError{StorageTargetName: "wwn1", OfflinePorts: []string{"rport-3:0-0 is Blocked"}}
+	notFoundErr := &device_connectivity.ConnectivityIdentifierStorageTargetNotFoundError{StorageTargetName: "wwn2", DirectoryPath: device_connectivity.FC_HOST_SYSFS_PATH}
+
+	testCases := []struct {
+		name           string
+		hostsErrs      map[string]error
+		scsiTargets    []device_connectivity.ScsiTarget
+		expScanCmds    map[string]string
+		expOfflineErr  bool
+		expNotFoundErr bool
+	}{
+		{
+			name:      "Should scan the channel and target of the array, and all of them where they are not resolved",
+			hostsErrs: map[string]error{"wwn1": nil, "wwn2": notFoundErr},
+			scsiTargets: []device_connectivity.ScsiTarget{
+				{HostId: 3, Channel: 0, TargetId: 2},
+				{HostId: 4, Channel: device_connectivity.ScsiWildcardId, TargetId: device_connectivity.ScsiWildcardId},
+			},
+			expScanCmds: map[string]string{
+				"/sys/class/scsi_host/host3/scan": "0 2 1",
+				"/sys/class/scsi_host/host4/scan": "- - 1",
+			},
+		},
+		{
+			name:          "Should fail with offline error when the visible targets are offline",
+			hostsErrs:     map[string]error{"wwn1": offlineErr, "wwn2": notFoundErr},
+			expOfflineErr: true,
+		},
+		{
+			name:           "Should fail with not found error when no target is visible",
+			hostsErrs:      map[string]error{"wwn1": notFoundErr, "wwn2": notFoundErr},
+			expNotFoundErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			fake_executer := mocks.NewMockExecuterInterface(mockCtrl)
+			fake_helper := mocks.NewMockOsDeviceConnectivityHelperInterface(mockCtrl)
+			for arrayIdentifier, hostsErr := range tc.hostsErrs {
+				var scsiTargets []device_connectivity.ScsiTarget
+				if hostsErr == nil {
+					scsiTargets = tc.scsiTargets
+				}
+				fake_helper.EXPECT().GetScsiTargetsByArrayIdentifier(arrayIdentifier).Return(scsiTargets, hostsErr)
+			}
+			for filename, scanCmd := range tc.expScanCmds {
+				fake_executer.EXPECT().OsOpenFile(filename, os.O_APPEND|os.O_WRONLY, os.FileMode(0200)).Return(nil, nil)
+				fake_executer.EXPECT().FileWriteString(nil, scanCmd).Return(len(scanCmd), nil)
+			}
+
+			helperScsiGeneric := NewOsDeviceConnectivityHelperScsiGenericForTest(fake_executer, fake_helper, &sync.Mutex{})
+
+			err := helperScsiGeneric.RescanDevices(1, []string{"wwn1", "wwn2"})
+			if len(tc.expScanCmds) != 0 {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Expected to fail with error, got success.")
+			}
+			targetsOfflineErr, isOffline := err.(*device_connectivity.StorageTargetsOfflineError)
+			if isOffline != tc.expOfflineErr {
+				t.Fatalf("Expected offline error %v, got %v", tc.expOfflineErr, err)
+			}
+			if isOffline && !reflect.DeepEqual(targetsOfflineErr.NotFoundTargets, []string{"wwn2"}) {
+				t.Fatalf("Expected not found targets [wwn2], got %v", targetsOfflineErr.NotFoundTargets)
+			}
+			if tc.expNotFoundErr && !strings.Contains(err.Error(), notFoundErr.Error()) {
+				t.Fatalf("Expected error to contain {%v}, got {%v}", notFoundErr, err)
+			}
+		})
+	}
+}
+
+func TestGetMpathDeviceCondition(t *testing.T) {
+	testCases := []struct {
+		name             string
+		slavesPaths      []string
+		pathsOutput      string
+		pathsErr         error
+		roContent        string
+		expAbnormal      bool
+		expMessagePrefix string
+		expErr           error
+	}{
+		{
+			name:        "Should fail when multipathd return error",
+			slavesPaths: []string{"/sys/block/dm-2/slaves/sdb"},
+			pathsErr:    fmt.Errorf("error"),
+			expErr:      fmt.Errorf("error"),
+		},
+		{
+			name:             "Should succeed with all paths active",
+			slavesPaths:      []string{"/sys/block/dm-2/slaves/sdb", "/sys/block/dm-2/slaves/sdc"},
+			pathsOutput:      "sda,active,ready,running\nsdb,active,ready,running\nsdc,active,ready,running",
+			roContent:        "0\n",
+			expAbnormal:      false,
+			expMessagePrefix: "Multipath device dm-2 is healthy",
+		},
+		{
+			name:             "Should be abnormal when path is failed or faulty",
+			slavesPaths:      []string{"/sys/block/dm-2/slaves/sdb", "/sys/block/dm-2/slaves/sdc", "/sys/block/dm-2/slaves/sdd"},
+			pathsOutput:      "sda,failed,faulty,running\nsdb,failed,ready,running\nsdc,active,faulty,running\nsdd,active,ready,running",
+			roContent:        "0\n",
+			expAbnormal:      true,
+			expMessagePrefix: "Multipath device dm-2 is abnormal: 2 of 3 paths are failed or faulty [sdb sdc]",
+		},
+		{
+			name:             "Should be abnormal when device is read only",
+			slavesPaths:      []string{"/sys/block/dm-2/slaves/sdb"},
+			pathsOutput:      "sdb,active,ready,running",
+			roContent:        "1\n",
+			expAbnormal:      true,
+			expMessagePrefix: "Multipath device dm-2 is abnormal: the device is read only",
+		},
+		{
+			name:             "Should be abnormal when device has no paths",
+			slavesPaths:      []string{},
+			pathsOutput:      "sdb,active,ready,running",
+			roContent:        "0\n",
+			expAbnormal:      true,
+			expMessagePrefix: "Multipath device dm-2 is abnormal: no paths were found",
+		},
+	}
+
+	for _, tc := range testCases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			fake_executer := mocks.NewMockExecuterInterface(mockCtrl)
+			args := []string{"show", "paths", "raw", "format", "\"", "%d,%t,%T,%o", "\""}
+			fake_executer.EXPECT().FilepathGlob("/sys/block/dm-2/slaves/*").Return(tc.slavesPaths, nil)
+			fake_executer.EXPECT().ExecuteWithTimeout(device_connectivity.TimeOutMultipathdCmd, "multipathd", args).Return([]byte(tc.pathsOutput), tc.pathsErr)
+			if tc.pathsErr == nil {
+				fake_executer.EXPECT().IoutilReadFile("/sys/block/dm-2/ro").Return([]byte(tc.roContent), nil)
+			}
+
+			helperScsiGeneric := NewOsDeviceConnectivityHelperScsiGenericForTest(fake_executer, nil, &sync.Mutex{})
+
+			abnormal, message, err := helperScsiGeneric.GetMpathDeviceCondition("/dev/dm-2")
+			if tc.expErr != nil {
+				if err == nil || err.Error() != tc.expErr.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if abnormal != tc.expAbnormal {
+				t.Fatalf("Expected abnormal %v, got %v", tc.expAbnormal, abnormal)
+			}
+			if !strings.HasPrefix(message, tc.expMessagePrefix) {
+				t.Fatalf("Expected message to start with {%v}, got {%v}", tc.expMessagePrefix, message)
+			}
+		})
+	}
+}
+
+func TestGetIbmDms(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	fake_executer := mocks.NewMockExecuterInterface(mockCtrl)
+	fake_helper := mocks.NewMockGetDmsPathHelperInterface(mockCtrl)
+	fake_helper.EXPECT().ShowMaps("%d", "%w", "%v").Return(
+		"dm-1,36005076810810261F800000000000A5B,IBM\n dm-2,360a98000383035537824474d3936556a,NETAPP\ndm-3,36005076810810261f800000000000a5c,IBM", nil)
+
+	helperGeneric := NewOsDeviceConnectivityHelperGenericForTest(fake_executer, fake_helper)
+	wwidsByDm, err := helperGeneric.GetIbmDms()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expWwidsByDm := map[string]string{
+		"dm-1": "36005076810810261f800000000000a5b",
+		"dm-3": "36005076810810261f800000000000a5c",
+	}
+	if !reflect.DeepEqual(wwidsByDm, expWwidsByDm) {
+		t.Fatalf("wrong IBM dms: expected %v, got %v", expWwidsByDm, wwidsByDm)
+	}
+}
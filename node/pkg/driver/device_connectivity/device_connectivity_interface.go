@@ -16,12 +16,24 @@
 
 package device_connectivity
 
+import "context"
+
 //go:generate mockgen -destination=../../../mocks/mock_OsDeviceConnectivityInterface.go -package=mocks github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity OsDeviceConnectivityInterface
 
 type OsDeviceConnectivityInterface interface {
-	EnsureLogin(ipsByArrayIdentifier map[string][]string)    // For iSCSI login
-	RescanDevices(lunId int, arrayIdentifier []string) error // For NVME lunID will be namespace ID.
+	EnsureLogin(ctx context.Context, ipsByArrayIdentifier map[string][]string, secrets, volumeContext map[string]string) ([]PortalLoginResult, error) // For iSCSI login
+	RescanDevices(lunId int, arrayIdentifier []string) error                                                                                          // For NVME lunID will be namespace ID.
 	GetMpathDevice(volumeId string) (string, error)
 	FlushMultipathDevice(mpathDevice string) error
 	RemovePhysicalDevice(sysDevices []string) error
+	GetMpathDeviceCondition(mpathDevice string) (bool, string, error) // Returns abnormal, message
+	EnsureLogout(volumeId string, arrayIdentifiers []string) error    // For iSCSI logout
+}
+
+// PortalLoginResult is the login result of a portal of a storage target, its error is nil if the portal is logged in.
+type PortalLoginResult struct {
+	ArrayIdentifier string
+	Portal          string
+	Iface           string // The iSCSI iface which the portal is logged in through, empty for the default iface
+	Err             error
 }
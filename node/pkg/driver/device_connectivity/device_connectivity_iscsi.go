@@ -17,53 +17,529 @@
 package device_connectivity
 
 import (
+	"context"
 	"errors"
 	"github.com/ibm/ibm-block-csi-driver/node/logger"
 	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executer"
+	"net"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	iscsiCmdTimeout     = 30 * time.Second
-	iscsiPort           = 3260
-	iSCSIErrNoObjsFound = 21
+	iscsiCmdTimeout            = 30 * time.Second
+	iscsiDefaultPort           = 3260
+	maxPortNumber              = 65535
+	iSCSIErrNoObjsFound        = 21
+	iSCSIErrSessionExists      = 15
+	iSCSIErrLoginAuthFailed    = 24
+	iscsiAuthMethodChap        = "CHAP"
+	iscsiNodeAuthPrefix        = "node.session.auth"
+	iscsiDiscoveryAuthPrefix   = "discovery.sendtargets.auth"
+	IscsiSessionsPath          = "/sys/class/iscsi_session/session*"
+	iscsiSessionAddressPath    = "device/connection*/iscsi_connection/connection*/persistent_address"
+	iscsiSessionPortFileName   = "persistent_port"
+	iscsiSessionDisksPath      = "device/target*/*/block/*"
+	iscsiSessionIfaceFileName  = "ifacename"
+	iscsiIfaceNetNameSetting   = "iface.net_ifacename"
+	iscsiIfaceTransportSetting = "iface.transport_name"
+	iscsiIserIfaceName         = "iser" // The iSER iface of the default iface, which open-iscsi creates by default
+	iscsiIserIfaceSuffix       = "-iser"
+	iscsiIfaceEmptyValue       = "<empty>"
+	IscsiSessionStateLoggedIn  = "LOGGED_IN"
+	IscsiSessionStateFailed    = "FAILED" // The connection is lost, iscsid tries to recover it
+	IscsiSessionStateFree      = "FREE"   // The session is not logged in, e.g. its recovery timed out
+
+	IscsiChapUsernameSecretKey       = "iscsi_chap_username"
+	IscsiChapPasswordSecretKey       = "iscsi_chap_password"
+	IscsiMutualChapUsernameSecretKey = "iscsi_mutual_chap_username"
+	IscsiMutualChapPasswordSecretKey = "iscsi_mutual_chap_password"
+
+	IscsiDiscoveryVolumeContextKey = "iscsi_discovery"
+	IscsiDiscoverySendTargets      = "sendtargets" // The targets of the portals are discovered by SendTargets
+	IscsiDiscoveryStatic           = "static"      // The node records are created from the publish context
+
+	IscsiTransportVolumeContextKey = "iscsi_transport"
+	IscsiTransportTcp              = "tcp"
+	IscsiTransportIser             = "iser" // Falls back to TCP for the portals which fail to login over iSER
+
+	IscsiSessionReplacementTimeoutParameter = "node.session.timeo.replacement_timeout"
+	IscsiNoopOutIntervalParameter           = "node.conn[0].timeo.noop_out_interval"
+	IscsiQueueDepthParameter                = "node.session.queue_depth"
+	IscsiStartupParameter                   = "node.startup"
 )
 
+// iscsiSessionParameterValidators are the validators of the session parameters which may be set on the node records,
+// by the names of the parameters
+var iscsiSessionParameterValidators = map[string]func(string) bool{
+	IscsiSessionReplacementTimeoutParameter: isIscsiNumber(0),
+	IscsiNoopOutIntervalParameter:           isIscsiNumber(0),
+	IscsiQueueDepthParameter:                isIscsiNumber(1),
+	IscsiStartupParameter: func(value string) bool {
+		return value == "automatic" || value == "manual" || value == "onboot"
+	},
+}
+
+func isIscsiNumber(min int) func(string) bool {
+	return func(value string) bool {
+		number, err := strconv.Atoi(value)
+		return err == nil && number >= min
+	}
+}
+
+// ValidateIscsiSessionParameters fails unless all the parameters are supported session parameters with valid values.
+func ValidateIscsiSessionParameters(parameters map[string]string) error {
+	for name, value := range parameters {
+		if isValid, isSupported := iscsiSessionParameterValidators[name]; !isSupported || !isValid(value) {
+			return &IscsiSessionParameterError{Name: name, Value: value}
+		}
+	}
+	return nil
+}
+
+// iscsiIfaceNetSettings are the settings of an iface which bind it to a network interface
+var iscsiIfaceNetSettings = []string{iscsiIfaceNetNameSetting, "iface.hwaddress", "iface.ipaddress"}
+
+// ValidateIscsiDiscovery fails unless the discovery is empty, for the default discovery, or a known discovery.
+func ValidateIscsiDiscovery(discovery string) error {
+	if discovery != "" && discovery != IscsiDiscoverySendTargets && discovery != IscsiDiscoveryStatic {
+		return &IscsiDiscoveryError{Discovery: discovery}
+	}
+	return nil
+}
+
+// ValidateIscsiTransport fails unless the transport is empty, for the default transport, or a known transport.
+func ValidateIscsiTransport(transport string) error {
+	if transport != "" && transport != IscsiTransportTcp && transport != IscsiTransportIser {
+		return &IscsiTransportError{Transport: transport}
+	}
+	return nil
+}
+
+// GetIscsiPortalWithPort returns the portal as ip:port, or [ipv6]:port for IPv6, with the default iSCSI port if the
+// portal has no port, e.g. for 1.1.1.1, 1.1.1.1:3260, fe80::1, [fe80::1] or [fe80::1]:3260.
+func GetIscsiPortalWithPort(portal string) (string, error) {
+	host, port, ok := splitPortal(portal, iscsiDefaultPort)
+	if !ok {
+		return "", &IscsiPortalError{Portal: portal}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// splitPortal returns the host and the port of the portal, with the default port if the portal has no port,
+// or false if the portal is not valid.
+func splitPortal(portal string, defaultPort int) (string, string, bool) {
+	host, port, err := net.SplitHostPort(portal)
+	if err != nil {
+		// the portal has no port
+		host, port = strings.Trim(portal, "[]"), strconv.Itoa(defaultPort)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	portNumber, err := strconv.Atoi(port)
+	if host == "" || err != nil || portNumber <= 0 || portNumber > maxPortNumber {
+		return "", "", false
+	}
+	return host, port, true
+}
+
+type iscsiSetting struct {
+	name  string
+	value string
+}
+
+type iscsiChapCredentials struct {
+	username       string
+	password       string
+	mutualUsername string
+	mutualPassword string
+}
+
+func getIscsiChapCredentials(secrets map[string]string) (*iscsiChapCredentials, error) {
+	/*
+		Return nil if the secrets have no CHAP credentials. Mutual CHAP, where the initiator authenticates
+		the target too, is optional on top of CHAP.
+	*/
+	credentials := &iscsiChapCredentials{
+		username:       secrets[IscsiChapUsernameSecretKey],
+		password:       secrets[IscsiChapPasswordSecretKey],
+		mutualUsername: secrets[IscsiMutualChapUsernameSecretKey],
+		mutualPassword: secrets[IscsiMutualChapPasswordSecretKey],
+	}
+	if credentials.username == "" && credentials.password == "" {
+		if credentials.mutualUsername != "" || credentials.mutualPassword != "" {
+			return nil, &IscsiChapCredentialsError{Message: "mutual CHAP credentials are given without CHAP credentials"}
+		}
+		return nil, nil
+	}
+	if credentials.username == "" || credentials.password == "" {
+		return nil, &IscsiChapCredentialsError{Message: "both CHAP username and password are required"}
+	}
+	if (credentials.mutualUsername == "") != (credentials.mutualPassword == "") {
+		return nil, &IscsiChapCredentialsError{Message: "both mutual CHAP username and password are required"}
+	}
+	return credentials, nil
+}
+
+// iscsiLoginSettings are the settings of the stage which are applied to the records of its discoveries and logins.
+type iscsiLoginSettings struct {
+	credentials       *iscsiChapCredentials
+	sessionParameters []iscsiSetting
+}
+
+// getIscsiSessionParameters returns the session parameters of the volume context, and of the config for the
+// parameters which the volume context has not.
+func getIscsiSessionParameters(volumeContext map[string]string, configParameters map[string]string) ([]iscsiSetting, error) {
+	parameters := make(map[string]string)
+	for name, value := range configParameters {
+		parameters[name] = value
+	}
+	for name, value := range volumeContext {
+		if _, isSupported := iscsiSessionParameterValidators[name]; isSupported {
+			parameters[name] = value
+		}
+	}
+	if err := ValidateIscsiSessionParameters(parameters); err != nil {
+		return nil, err
+	}
+	settings := make([]iscsiSetting, 0, len(parameters))
+	for name, value := range parameters {
+		settings = append(settings, iscsiSetting{name: name, value: value})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].name < settings[j].name })
+	return settings, nil
+}
+
+func (c *iscsiChapCredentials) getAuthSettings(authPrefix string) []iscsiSetting {
+	settings := []iscsiSetting{
+		{name: authPrefix + ".authmethod", value: iscsiAuthMethodChap},
+		{name: authPrefix + ".username", value: c.username},
+		{name: authPrefix + ".password", value: c.password},
+	}
+	if c.mutualUsername != "" {
+		settings = append(settings,
+			iscsiSetting{name: authPrefix + ".username_in", value: c.mutualUsername},
+			iscsiSetting{name: authPrefix + ".password_in", value: c.mutualPassword},
+		)
+	}
+	return settings
+}
+
+// iscsiTransientErrorCodes are the iscsiadm exit codes of errors which a retry may overcome
+var iscsiTransientErrorCodes = map[int]bool{
+	4:  true, // ISCSI_ERR_TRANS
+	5:  true, // ISCSI_ERR_LOGIN
+	8:  true, // ISCSI_ERR_TRANS_TIMEOUT
+	11: true, // ISCSI_ERR_PDU_TIMEOUT
+	18: true, // ISCSI_ERR_ISCSID_COMM_ERR
+	20: true, // ISCSI_ERR_ISCSID_NOTCONN
+	28: true, // ISCSI_ERR_BUSY
+	29: true, // ISCSI_ERR_AGAIN
+}
+
+type IscsiConfig struct {
+	KeepSessionsOnUnstage     bool              // Keep the sessions of a target after the last volume of the target is unstaged
+	DeleteNodeRecordsOnLogout bool              // Delete the node records of a target after its sessions are logged out
+	LoginWorkers              int               // Maximum number of concurrent discoveries or logins
+	LoginRetries              int               // Retries of a discovery or login which failed with a transient error
+	LoginRetryInterval        time.Duration     // Interval before the first retry, doubled on each retry
+	LoginTimeout              time.Duration     // Deadline of the whole discovery and login of a stage, 0 for no deadline
+	Ifaces                    []string          // Existing ifaces to discover and login through, instead of the default iface
+	IfaceNics                 []string          // NICs to discover and login through, by ifaces which are named after them
+	Discovery                 string            // Discovery of the targets unless the volume context has one, SendTargets by default
+	SessionMonitorInterval    time.Duration     // Interval of checking the sessions of the staged volumes, 0 disables it
+	Transport                 string            // Transport of the logins unless the volume context has one, TCP by default
+	SessionParameters         map[string]string // Session parameters of the node records, unless the volume context has them
+}
+
+// iscsiPath is a path to a portal of a target through an iface.
+type iscsiPath struct {
+	targetName string
+	portal     string
+	iface      string
+}
+
 type OsDeviceConnectivityIscsi struct {
 	Executer          executer.ExecuterInterface
 	HelperScsiGeneric OsDeviceConnectivityHelperScsiGenericInterface
+	Config            IscsiConfig
 }
 
-func NewOsDeviceConnectivityIscsi(executer executer.ExecuterInterface) OsDeviceConnectivityInterface {
+func NewOsDeviceConnectivityIscsi(executer executer.ExecuterInterface, config IscsiConfig) OsDeviceConnectivityInterface {
 	return &OsDeviceConnectivityIscsi{
 		Executer:          executer,
 		HelperScsiGeneric: NewOsDeviceConnectivityHelperScsiGeneric(executer),
+		Config:            config,
 	}
 }
 
 func (r OsDeviceConnectivityIscsi) iscsiCmd(args ...string) (string, error) {
-	out, err := r.Executer.ExecuteWithTimeout(int(iscsiCmdTimeout.Seconds()*1000), "iscsiadm", args)
+	return r.iscsiCmdWithTimeout(iscsiCmdTimeout, args...)
+}
+
+func (r OsDeviceConnectivityIscsi) iscsiCmdWithTimeout(timeout time.Duration, args ...string) (string, error) {
+	out, err := r.Executer.ExecuteWithTimeout(int(timeout.Seconds()*1000), "iscsiadm", args)
 	return string(out), err
 }
 
-func (r OsDeviceConnectivityIscsi) iscsiDiscover(portal string) error {
-	output, err := r.iscsiCmd("-m", "discoverydb", "-t", "sendtargets", "-p", portal, "--discover")
+// getCmdTimeout returns the timeout of a command which must end before the deadline of the context.
+func getCmdTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if untilDeadline := time.Until(deadline); untilDeadline < iscsiCmdTimeout {
+			return untilDeadline
+		}
+	}
+	return iscsiCmdTimeout
+}
+
+func isIscsiTransientError(err error) bool {
+	if err == context.DeadlineExceeded {
+		// the command timed out
+		return true
+	}
+	exitError, isExitError := err.(*exec.ExitError)
+	return isExitError && iscsiTransientErrorCodes[exitError.ExitCode()]
+}
+
+// retryTransientErrors runs the operation until it succeeds, fails with an error which is not transient,
+// runs out of retries or the context is done. The interval between the retries is doubled on each retry.
+func (r OsDeviceConnectivityIscsi) retryTransientErrors(ctx context.Context, operation func() error) error {
+	retryInterval := r.Config.LoginRetryInterval
+	for retry := 0; ; retry++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := operation()
+		if err == nil || !isIscsiTransientError(err) || retry >= r.Config.LoginRetries {
+			return err
+		}
+		logger.Warningf("Retrying in {%v} after transient iSCSI error : {%v}", retryInterval, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retryInterval):
+		}
+		retryInterval *= 2
+	}
+}
+
+// runConcurrently runs the jobs by at most the given number of workers, and waits for all of them to end.
+func runConcurrently(workers int, jobs []func()) {
+	if workers < 1 {
+		workers = 1
+	}
+	workersSemaphore := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		workersSemaphore <- struct{}{}
+		go func(job func()) {
+			defer wg.Done()
+			defer func() { <-workersSemaphore }()
+			job()
+		}(job)
+	}
+	wg.Wait()
+}
+
+func (r OsDeviceConnectivityIscsi) iscsiUpdateSettings(recordArgs []string, settings []iscsiSetting) error {
+	for _, setting := range settings {
+		args := append(append([]string{}, recordArgs...), "-o", "update", "-n", setting.name, "-v", setting.value)
+		// the settings may hold CHAP secrets, so neither the args nor the output are logged
+		_, err := r.Executer.ExecuteWithTimeoutSilently(int(iscsiCmdTimeout.Seconds()*1000), "iscsiadm", args)
+		if err != nil {
+			logger.Errorf("Failed to update iSCSI setting {%s}, error: {%s}", setting.name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// getLoginSetting returns the setting of the volume context, or else of the config, or else the default.
+func getLoginSetting(volumeContext map[string]string, key, configValue, defaultValue string, validate func(string) error) (string, error) {
+	for _, value := range []string{volumeContext[key], configValue} {
+		if err := validate(value); err != nil {
+			return "", err
+		}
+		if value != "" {
+			return value, nil
+		}
+	}
+	return defaultValue, nil
+}
+
+// getIfaceArgs returns the iscsiadm args which bind a discovery or login to the iface, none for the default iface.
+func getIfaceArgs(iface string) []string {
+	if iface == "" {
+		return nil
+	}
+	return []string{"-I", iface}
+}
+
+// getLoginIfaces returns the configured ifaces, or a single empty iface for the default iface.
+func (r OsDeviceConnectivityIscsi) getLoginIfaces() []string {
+	ifaces := append(append([]string{}, r.Config.Ifaces...), r.Config.IfaceNics...)
+	if len(ifaces) == 0 {
+		return []string{""}
+	}
+	return ifaces
+}
+
+// getIserIfaceName returns the name of the iSER iface of the iface.
+func getIserIfaceName(iface string) string {
+	if iface == "" {
+		return iscsiIserIfaceName
+	}
+	return iface + iscsiIserIfaceSuffix
+}
+
+// ensureIface creates the iface if it is missing, and updates its settings.
+func (r OsDeviceConnectivityIscsi) ensureIface(iface string, settings []iscsiSetting) error {
+	recordArgs := []string{"-m", "iface", "-I", iface}
+	if _, err := r.iscsiCmd(recordArgs...); err != nil {
+		logger.Infof("Creating iSCSI iface {%v}", iface)
+		if output, err := r.iscsiCmd(append(recordArgs, "-o", "new")...); err != nil {
+			logger.Errorf("Failed to create iSCSI iface: {%s}, error: {%s}", output, err)
+			return err
+		}
+	}
+	for _, setting := range settings {
+		output, err := r.iscsiCmd(append(recordArgs, "-o", "update", "-n", setting.name, "-v", setting.value)...)
+		if err != nil {
+			logger.Errorf("Failed to update iSCSI iface setting {%s}: {%s}, error: {%s}", setting.name, output, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (r OsDeviceConnectivityIscsi) ensureNicIfaces() error {
+	for _, nic := range r.Config.IfaceNics {
+		if err := r.ensureIface(nic, []iscsiSetting{{name: iscsiIfaceNetNameSetting, value: nic}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getIfaceNetSettings returns the network settings of the iface which have a value.
+func (r OsDeviceConnectivityIscsi) getIfaceNetSettings(iface string) ([]iscsiSetting, error) {
+	output, err := r.iscsiCmd("-m", "iface", "-I", iface)
+	if err != nil {
+		logger.Errorf("Failed to get iSCSI iface: {%s}, error: {%s}", output, err)
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		// e.g. iface.net_ifacename = eth1
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	var settings []iscsiSetting
+	for _, name := range iscsiIfaceNetSettings {
+		if value := values[name]; value != "" && value != iscsiIfaceEmptyValue {
+			settings = append(settings, iscsiSetting{name: name, value: value})
+		}
+	}
+	return settings, nil
+}
+
+// ensureIserIface returns the iSER iface of the iface, which is bound to the same network interface as the iface.
+func (r OsDeviceConnectivityIscsi) ensureIserIface(iface string) (string, error) {
+	settings := []iscsiSetting{{name: iscsiIfaceTransportSetting, value: IscsiTransportIser}}
+	if iface != "" {
+		netSettings, err := r.getIfaceNetSettings(iface)
+		if err != nil {
+			return "", err
+		}
+		settings = append(settings, netSettings...)
+	}
+	iserIface := getIserIfaceName(iface)
+	if err := r.ensureIface(iserIface, settings); err != nil {
+		return "", err
+	}
+	return iserIface, nil
+}
+
+func (r OsDeviceConnectivityIscsi) iscsiDiscover(ctx context.Context, targetName, portal, iface string, credentials *iscsiChapCredentials) error {
+	recordArgs := []string{"-m", "discoverydb", "-t", "sendtargets", "-p", portal}
+	if credentials != nil {
+		// the record may already exist, a real failure is reported by the update
+		_, _ = r.iscsiCmd(append(recordArgs, "-o", "new")...)
+		if err := r.iscsiUpdateSettings(recordArgs, credentials.getAuthSettings(iscsiDiscoveryAuthPrefix)); err != nil {
+			return err
+		}
+	}
+	var output string
+	err := r.retryTransientErrors(ctx, func() error {
+		var err error
+		args := append(append(append([]string{}, recordArgs...), getIfaceArgs(iface)...), "--discover")
+		output, err = r.iscsiCmdWithTimeout(getCmdTimeout(ctx), args...)
+		return err
+	})
 	if err != nil {
 		logger.Errorf("Failed to discover iSCSI: {%s}, error: {%s}", output, err)
+		if isIscsiAuthFailure(err) {
+			return &IscsiAuthenticationFailedError{TargetName: targetName, Portal: portal}
+		}
+		return err
+	}
+	return nil
+}
+
+func (r OsDeviceConnectivityIscsi) iscsiNewNodeRecord(targetName, portal, iface string) error {
+	output, err := r.iscsiCmd(append(getNodeRecordArgs(targetName, portal, iface), "-o", "new")...)
+	if err != nil {
+		logger.Errorf("Failed to create iSCSI node record: {%s}, error: {%s}", output, err)
 		return err
 	}
 	return nil
 }
 
-func (r OsDeviceConnectivityIscsi) iscsiLogin(targetName, portal string) {
-	portalWithPort := portal + ":" + strconv.Itoa(iscsiPort)
-	output, err := r.iscsiCmd("-m", "node", "-p", portalWithPort, "-T", targetName, "--login")
+func getNodeRecordArgs(targetName, portal, iface string) []string {
+	return append([]string{"-m", "node", "-p", portal, "-T", targetName}, getIfaceArgs(iface)...)
+}
+
+func (r OsDeviceConnectivityIscsi) iscsiLogin(ctx context.Context, targetName, portal, iface string, settings iscsiLoginSettings) error {
+	recordArgs := getNodeRecordArgs(targetName, portal, iface)
+	var nodeSettings []iscsiSetting
+	if settings.credentials != nil {
+		nodeSettings = settings.credentials.getAuthSettings(iscsiNodeAuthPrefix)
+	}
+	nodeSettings = append(nodeSettings, settings.sessionParameters...)
+	if err := r.iscsiUpdateSettings(recordArgs, nodeSettings); err != nil {
+		return err
+	}
+	var output string
+	err := r.retryTransientErrors(ctx, func() error {
+		var err error
+		output, err = r.iscsiCmdWithTimeout(getCmdTimeout(ctx), append(recordArgs, "--login")...)
+		return err
+	})
+	if exitError, isExitError := err.(*exec.ExitError); isExitError && exitError.ExitCode() == iSCSIErrSessionExists {
+		logger.Debugf("iSCSI session of target {%v} portal {%v} iface {%v} already exists", targetName, portal, iface)
+		return nil
+	}
 	if err != nil {
 		logger.Errorf("Failed to login iSCSI: {%s}, error: {%s}", output, err)
+		if isIscsiAuthFailure(err) {
+			return &IscsiAuthenticationFailedError{TargetName: targetName, Portal: portal}
+		}
+		return err
 	}
+	return nil
+}
+
+func isIscsiAuthFailure(err error) bool {
+	exitError, isExitError := err.(*exec.ExitError)
+	return isExitError && exitError.ExitCode() == iSCSIErrLoginAuthFailed
 }
 
 func (r OsDeviceConnectivityIscsi) iscsiGetRawSessions() ([]string, error) {
@@ -80,75 +556,320 @@ func (r OsDeviceConnectivityIscsi) iscsiGetRawSessions() ([]string, error) {
 	return lines, nil
 }
 
-func (r OsDeviceConnectivityIscsi) getAllSessions() (map[string]map[string]bool, error) {
+func (r OsDeviceConnectivityIscsi) getAllSessions() (map[iscsiPath]bool, error) {
 	lines, err := r.iscsiGetRawSessions()
 	if err != nil {
 		return nil, err
 	}
 	parseErr := errors.New("failed to parse iSCSI sessions")
-	portalsByTarget := make(map[string]map[string]bool)
+	sessions := make(map[iscsiPath]bool)
 	for _, line := range lines {
 		parts := strings.Fields(line)
 		if len(parts) < 4 {
 			return nil, parseErr
 		}
-		portalInfo, targetName := parts[2], parts[3]
-		ipPortSeparatorIndex := strings.LastIndex(portalInfo, ":")
-		if ipPortSeparatorIndex < 0 {
+		// e.g. tcp: [1] 1.1.1.1:3260,1 iqn.1986-03.com.ibm:2145.v7k1.node1 (non-flash)
+		transport, portalInfo, targetName := strings.TrimSuffix(parts[0], ":"), parts[2], parts[3]
+		portalGroupSeparatorIndex := strings.LastIndex(portalInfo, ",")
+		if portalGroupSeparatorIndex < 0 {
+			return nil, parseErr
+		}
+		portal, err := GetIscsiPortalWithPort(portalInfo[:portalGroupSeparatorIndex])
+		if err != nil {
 			return nil, parseErr
 		}
-		ip := portalInfo[:ipPortSeparatorIndex]
-		if set := portalsByTarget[targetName]; set == nil {
-			portalsByTarget[targetName] = make(map[string]bool)
+		// the sessions over iSER are logged in through the iSER iface of the default iface
+		iface := ""
+		if transport == IscsiTransportIser {
+			iface = getIserIfaceName(iface)
 		}
-		portalsByTarget[targetName][ip] = true
+		sessions[iscsiPath{targetName: targetName, portal: portal, iface: iface}] = true
 	}
-	return portalsByTarget, nil
+	return sessions, nil
 }
 
-func (r OsDeviceConnectivityIscsi) filterLoggedIn(portalsByTarget map[string][]string) (map[string][]string, error) {
-	loggedInPortalsByTarget, err := r.getAllSessions()
+func (r OsDeviceConnectivityIscsi) getAllIfaceSessions() (map[iscsiPath]bool, error) {
+	/*
+		The sessions list of iscsiadm has no ifaces, so the sessions are read from sysfs, which has the iface
+		of each session.
+	*/
+	sessionPaths, err := r.Executer.FilepathGlob(IscsiSessionsPath)
 	if err != nil {
+		logger.Errorf("Error while Glob iSCSI sessions : {%v}. err : {%v}", IscsiSessionsPath, err)
 		return nil, err
 	}
-	filteredPortalsByTarget := make(map[string][]string)
+	sessions := make(map[iscsiPath]bool)
+	for _, sessionPath := range sessionPaths {
+		portal, err := GetIscsiPortalWithPort(r.getSessionPortal(sessionPath))
+		if err != nil {
+			logger.Debugf("iSCSI session {%v} has no connection, skipping it", filepath.Base(sessionPath))
+			continue
+		}
+		sessions[iscsiPath{
+			targetName: readSysfsValue(r.Executer, filepath.Join(sessionPath, "targetname")),
+			portal:     portal,
+			iface:      readSysfsValue(r.Executer, filepath.Join(sessionPath, iscsiSessionIfaceFileName)),
+		}] = true
+	}
+	return sessions, nil
+}
+
+func (r OsDeviceConnectivityIscsi) filterLoggedIn(portalsByTarget map[string][]string, ifaces []string) ([]PortalLoginResult, []PortalLoginResult, error) {
+	/*
+		Return the paths which are not logged in yet, and the results of the paths which are already logged in
+		or invalid. A path is a portal through an iface.
+	*/
+	getSessions := r.getAllSessions
+	if len(r.Config.Ifaces) > 0 || len(r.Config.IfaceNics) > 0 {
+		getSessions = r.getAllIfaceSessions
+	}
+	sessions, err := getSessions()
+	if err != nil {
+		return nil, nil, err
+	}
+	var paths, results []PortalLoginResult
 	for targetName, portals := range portalsByTarget {
-		for _, portal := range portals {
-			if !loggedInPortalsByTarget[targetName][portal] {
-				portals := filteredPortalsByTarget[targetName]
-				filteredPortalsByTarget[targetName] = append(portals, portal)
+		for _, rawPortal := range portals {
+			portal, err := GetIscsiPortalWithPort(rawPortal)
+			if err != nil {
+				results = append(results, PortalLoginResult{ArrayIdentifier: targetName, Portal: rawPortal, Err: err})
+				continue
+			}
+			for _, iface := range ifaces {
+				path := PortalLoginResult{ArrayIdentifier: targetName, Portal: portal, Iface: iface}
+				// a path which is logged in over iSER has a session through the iSER iface of its iface
+				if sessions[iscsiPath{targetName: targetName, portal: portal, iface: iface}] {
+					results = append(results, path)
+				} else if iserIface := getIserIfaceName(iface); sessions[iscsiPath{targetName: targetName, portal: portal, iface: iserIface}] {
+					path.Iface = iserIface
+					results = append(results, path)
+				} else {
+					paths = append(paths, path)
+				}
 			}
 		}
 	}
-	return filteredPortalsByTarget, nil
+	return paths, results, nil
 }
 
-func (r OsDeviceConnectivityIscsi) iscsiDiscoverAny(portals []string) bool {
+func (r OsDeviceConnectivityIscsi) iscsiDiscoverAny(ctx context.Context, targetName string, portals []string, iface string, credentials *iscsiChapCredentials) error {
+	var err error
 	for _, portal := range portals {
-		if err := r.iscsiDiscover(portal); err == nil {
-			return true
+		if err = r.iscsiDiscover(ctx, targetName, portal, iface, credentials); err == nil {
+			return nil
 		}
 	}
-	return false
+	return err
 }
 
-func (r OsDeviceConnectivityIscsi) discoverAndLogin(portalsByTarget map[string][]string) {
-	for targetName, portals := range portalsByTarget {
-		if ok := r.iscsiDiscoverAny(portals); ok {
-			for _, portal := range portals {
-				r.iscsiLogin(targetName, portal)
+func (r OsDeviceConnectivityIscsi) staticLogin(ctx context.Context, paths []PortalLoginResult, settings iscsiLoginSettings) []PortalLoginResult {
+	/*
+		The node records of the paths are created without a discovery, and then the paths are logged in
+		concurrently.
+	*/
+	results := append([]PortalLoginResult{}, paths...)
+	var loginJobs []func()
+	for resultIndex := range results {
+		result := &results[resultIndex]
+		loginJobs = append(loginJobs, func() {
+			if result.Err = r.iscsiNewNodeRecord(result.ArrayIdentifier, result.Portal, result.Iface); result.Err == nil {
+				result.Err = r.iscsiLogin(ctx, result.ArrayIdentifier, result.Portal, result.Iface, settings)
+			}
+		})
+	}
+	runConcurrently(r.Config.LoginWorkers, loginJobs)
+	return results
+}
+
+func (r OsDeviceConnectivityIscsi) discoverAndLogin(ctx context.Context, paths []PortalLoginResult, settings iscsiLoginSettings) []PortalLoginResult {
+	/*
+		The targets are discovered concurrently through each iface, and then the paths of all the discovered
+		targets are logged in concurrently.
+	*/
+	discoveryIndexes := make(map[iscsiPath]int)
+	var discoveries []iscsiPath
+	var portalsByDiscovery [][]string
+	for _, path := range paths {
+		discovery := iscsiPath{targetName: path.ArrayIdentifier, iface: path.Iface}
+		discoveryIndex, ok := discoveryIndexes[discovery]
+		if !ok {
+			discoveryIndex = len(discoveries)
+			discoveryIndexes[discovery] = discoveryIndex
+			discoveries = append(discoveries, discovery)
+			portalsByDiscovery = append(portalsByDiscovery, nil)
+		}
+		portalsByDiscovery[discoveryIndex] = append(portalsByDiscovery[discoveryIndex], path.Portal)
+	}
+	var discoveryJobs []func()
+	discoveryErrs := make([]error, len(discoveries))
+	for discoveryIndex, discovery := range discoveries {
+		discoveryIndex, discovery := discoveryIndex, discovery
+		discoveryJobs = append(discoveryJobs, func() {
+			discoveryErrs[discoveryIndex] = r.iscsiDiscoverAny(ctx, discovery.targetName, portalsByDiscovery[discoveryIndex],
+				discovery.iface, settings.credentials)
+		})
+	}
+	runConcurrently(r.Config.LoginWorkers, discoveryJobs)
+
+	results := append([]PortalLoginResult{}, paths...)
+	var loginJobs []func()
+	for resultIndex := range results {
+		result := &results[resultIndex]
+		result.Err = discoveryErrs[discoveryIndexes[iscsiPath{targetName: result.ArrayIdentifier, iface: result.Iface}]]
+		if result.Err != nil {
+			continue
+		}
+		loginJobs = append(loginJobs, func() {
+			result.Err = r.iscsiLogin(ctx, result.ArrayIdentifier, result.Portal, result.Iface, settings)
+		})
+	}
+	runConcurrently(r.Config.LoginWorkers, loginJobs)
+	return results
+}
+
+func (r OsDeviceConnectivityIscsi) iserLogin(ctx context.Context, paths []PortalLoginResult, settings iscsiLoginSettings,
+	login func(context.Context, []PortalLoginResult, iscsiLoginSettings) []PortalLoginResult) []PortalLoginResult {
+	/*
+		The paths are logged in through the iSER ifaces of their ifaces, and the paths which fail to login over
+		iSER are logged in over TCP through their own ifaces.
+	*/
+	iserIfaces := make(map[string]string)
+	for _, path := range paths {
+		if _, ok := iserIfaces[path.Iface]; ok {
+			continue
+		}
+		iserIface, err := r.ensureIserIface(path.Iface)
+		if err != nil {
+			logger.Warningf("Failed to prepare the iSER iface of iface {%v}, falling back to TCP : {%v}", path.Iface, err)
+			iserIface = path.Iface
+		}
+		iserIfaces[path.Iface] = iserIface
+	}
+	iserPaths := make([]PortalLoginResult, 0, len(paths))
+	for _, path := range paths {
+		path.Iface = iserIfaces[path.Iface]
+		iserPaths = append(iserPaths, path)
+	}
+
+	var results, tcpPaths []PortalLoginResult
+	for pathIndex, result := range login(ctx, iserPaths, settings) {
+		if result.Err == nil || result.Iface == paths[pathIndex].Iface {
+			results = append(results, result)
+			continue
+		}
+		logger.Warningf("Failed to login target {%v} portal {%v} over iSER, falling back to TCP : {%v}",
+			result.ArrayIdentifier, result.Portal, result.Err)
+		tcpPaths = append(tcpPaths, paths[pathIndex])
+	}
+	return append(results, login(ctx, tcpPaths, settings)...)
+}
+
+// getNodeRecordSettings returns the values of the settings of the node record by their names.
+func (r OsDeviceConnectivityIscsi) getNodeRecordSettings(recordArgs []string) (map[string]string, error) {
+	// the record may hold CHAP secrets, so the output is not logged
+	args := append(append([]string{}, recordArgs...), "-o", "show")
+	output, err := r.Executer.ExecuteWithTimeoutSilently(int(iscsiCmdTimeout.Seconds()*1000), "iscsiadm", args)
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		// e.g. node.session.timeo.replacement_timeout = 120
+		nameValue := strings.SplitN(line, "=", 2)
+		if len(nameValue) == 2 {
+			settings[strings.TrimSpace(nameValue[0])] = strings.TrimSpace(nameValue[1])
+		}
+	}
+	return settings, nil
+}
+
+func (r OsDeviceConnectivityIscsi) updateLoggedInNodeRecords(results []PortalLoginResult, sessionParameters []iscsiSetting) {
+	/*
+		The session parameters of the node records apply to the sessions of the next logins, so the running
+		sessions of the paths which are already logged in keep their parameters until they are logged in again.
+		Only the parameters which differ from the node record are updated. The node records are per target,
+		portal and iface, so the parameters of a volume apply to the other volumes of its target too.
+	*/
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		recordArgs := getNodeRecordArgs(result.ArrayIdentifier, result.Portal, result.Iface)
+		recordSettings, err := r.getNodeRecordSettings(recordArgs)
+		if err != nil {
+			logger.Warningf("Failed to read the node record of target {%v} portal {%v} iface {%v} : {%v}",
+				result.ArrayIdentifier, result.Portal, result.Iface, err)
+			continue
+		}
+		var changedParameters []iscsiSetting
+		var names []string
+		for _, parameter := range sessionParameters {
+			if recordSettings[parameter.name] != parameter.value {
+				changedParameters = append(changedParameters, parameter)
+				names = append(names, parameter.name)
 			}
 		}
+		if len(changedParameters) == 0 {
+			continue
+		}
+		if err := r.iscsiUpdateSettings(recordArgs, changedParameters); err != nil {
+			logger.Warningf("Failed to update the session parameters of the node record of target {%v} portal {%v} : {%v}",
+				result.ArrayIdentifier, result.Portal, err)
+			continue
+		}
+		logger.Warningf("iSCSI session parameters {%v} are not applied to the running session of target {%v} portal {%v} iface {%v}, "+
+			"they apply on its next login", names, result.ArrayIdentifier, result.Portal, result.Iface)
 	}
 }
 
-func (r OsDeviceConnectivityIscsi) EnsureLogin(allPortalsByTarget map[string][]string) {
-	portalsByTarget, err := r.filterLoggedIn(allPortalsByTarget)
-	if err == nil {
-		r.discoverAndLogin(portalsByTarget)
-	} else {
+func (r OsDeviceConnectivityIscsi) EnsureLogin(ctx context.Context, allPortalsByTarget map[string][]string, secrets map[string]string,
+	volumeContext map[string]string) ([]PortalLoginResult, error) {
+	credentials, err := getIscsiChapCredentials(secrets)
+	if err != nil {
+		return nil, err
+	}
+	discovery, err := getLoginSetting(volumeContext, IscsiDiscoveryVolumeContextKey, r.Config.Discovery,
+		IscsiDiscoverySendTargets, ValidateIscsiDiscovery)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := getLoginSetting(volumeContext, IscsiTransportVolumeContextKey, r.Config.Transport,
+		IscsiTransportTcp, ValidateIscsiTransport)
+	if err != nil {
+		return nil, err
+	}
+	sessionParameters, err := getIscsiSessionParameters(volumeContext, r.Config.SessionParameters)
+	if err != nil {
+		return nil, err
+	}
+	settings := iscsiLoginSettings{credentials: credentials, sessionParameters: sessionParameters}
+	paths, results, err := r.filterLoggedIn(allPortalsByTarget, r.getLoginIfaces())
+	if err != nil {
 		logger.Errorf("Failed to filter logged in iSCSI portals: {%v}", err)
+		return nil, err
+	}
+	if len(sessionParameters) > 0 {
+		r.updateLoggedInNodeRecords(results, sessionParameters)
+	}
+	if len(paths) == 0 {
+		return results, nil
+	}
+	if err := r.ensureNicIfaces(); err != nil {
+		return nil, err
 	}
+	if r.Config.LoginTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Config.LoginTimeout)
+		defer cancel()
+	}
+	login := r.discoverAndLogin
+	if discovery == IscsiDiscoveryStatic {
+		login = r.staticLogin
+	}
+	if transport == IscsiTransportIser {
+		return append(results, r.iserLogin(ctx, paths, settings, login)...), nil
+	}
+	return append(results, login(ctx, paths, settings)...), nil
 }
 
 func (r OsDeviceConnectivityIscsi) RescanDevices(lunId int, arrayIdentifiers []string) error {
@@ -169,3 +890,180 @@ func (r OsDeviceConnectivityIscsi) FlushMultipathDevice(mpathDevice string) erro
 func (r OsDeviceConnectivityIscsi) RemovePhysicalDevice(sysDevices []string) error {
 	return r.HelperScsiGeneric.RemovePhysicalDevice(sysDevices)
 }
+
+func (r OsDeviceConnectivityIscsi) GetMpathDeviceCondition(mpathDevice string) (bool, string, error) {
+	return r.HelperScsiGeneric.GetMpathDeviceCondition(mpathDevice)
+}
+
+func (r OsDeviceConnectivityIscsi) iscsiLogout(targetName string) error {
+	output, err := r.iscsiCmd("-m", "node", "-T", targetName, "--logout")
+	if err != nil {
+		if exitError, isExitError := err.(*exec.ExitError); isExitError && exitError.ExitCode() == iSCSIErrNoObjsFound {
+			logger.Debugf("No iSCSI sessions of target {%v} to logout", targetName)
+			return nil
+		}
+		logger.Errorf("Failed to logout iSCSI: {%s}, error: {%s}", output, err)
+		return err
+	}
+	return nil
+}
+
+func (r OsDeviceConnectivityIscsi) iscsiDeleteNodeRecord(targetName string) error {
+	output, err := r.iscsiCmd("-m", "node", "-T", targetName, "-o", "delete")
+	if err != nil {
+		logger.Errorf("Failed to delete iSCSI node record: {%s}, error: {%s}", output, err)
+		return err
+	}
+	return nil
+}
+
+func (r OsDeviceConnectivityIscsi) getSessionPathsByTarget(targetNames []string) (map[string][]string, error) {
+	sessionPaths, err := r.Executer.FilepathGlob(IscsiSessionsPath)
+	if err != nil {
+		logger.Errorf("Error while Glob iSCSI sessions : {%v}. err : {%v}", IscsiSessionsPath, err)
+		return nil, err
+	}
+	targets := make(map[string]bool)
+	for _, targetName := range targetNames {
+		targets[targetName] = true
+	}
+	sessionPathsByTarget := make(map[string][]string)
+	for _, sessionPath := range sessionPaths {
+		targetName := readSysfsValue(r.Executer, filepath.Join(sessionPath, "targetname"))
+		if targets[targetName] {
+			sessionPathsByTarget[targetName] = append(sessionPathsByTarget[targetName], sessionPath)
+		}
+	}
+	return sessionPathsByTarget, nil
+}
+
+func (r OsDeviceConnectivityIscsi) isSessionUsed(sessionPath string) (bool, error) {
+	/*
+		A session is used as long as it has any disk. A disk with a multipath device is a path of a staged volume,
+		and a disk without a multipath device may be a path of a volume which is being staged.
+	*/
+	disks, err := r.Executer.FilepathGlob(filepath.Join(sessionPath, iscsiSessionDisksPath))
+	if err != nil {
+		return false, err
+	}
+	if len(disks) == 0 {
+		return false, nil
+	}
+	logger.Debugf("iSCSI session {%v} is still used by disks {%v}", filepath.Base(sessionPath), disks)
+	return true, nil
+}
+
+func (r OsDeviceConnectivityIscsi) GetTargetsOfDevices(sysDevices []string) ([]string, error) {
+	/*
+		Return the targets of the sessions which the devices are disks of, e.g. for the volumes which were staged
+		without recording their targets.
+	*/
+	diskPaths, err := r.Executer.FilepathGlob(filepath.Join(IscsiSessionsPath, iscsiSessionDisksPath))
+	if err != nil {
+		logger.Errorf("Error while Glob iSCSI session disks : {%v}. err : {%v}", IscsiSessionsPath, err)
+		return nil, err
+	}
+	devices := make(map[string]bool)
+	for _, sysDevice := range sysDevices {
+		devices[sysDevice] = true
+	}
+	var targetNames []string
+	foundTargets := make(map[string]bool)
+	for _, diskPath := range diskPaths {
+		if !devices[filepath.Base(diskPath)] {
+			continue
+		}
+		// e.g. /sys/class/iscsi_session/session1/device/target3:0:0/3:0:0:1/block/sdb
+		sessionPath := diskPath[:strings.Index(diskPath, "/device/")]
+		targetName := readSysfsValue(r.Executer, filepath.Join(sessionPath, "targetname"))
+		if targetName != "" && !foundTargets[targetName] {
+			foundTargets[targetName] = true
+			targetNames = append(targetNames, targetName)
+		}
+	}
+	return targetNames, nil
+}
+
+func (r OsDeviceConnectivityIscsi) EnsureLogout(_ string, arrayIdentifiers []string) error {
+	/*
+		Logout of the targets whose sessions are not used by any device anymore, after the devices of the volume
+		were removed.
+	*/
+	if r.Config.KeepSessionsOnUnstage {
+		return nil
+	}
+	sessionPathsByTarget, err := r.getSessionPathsByTarget(arrayIdentifiers)
+	if err != nil {
+		return err
+	}
+	for targetName, sessionPaths := range sessionPathsByTarget {
+		isUsed := false
+		for _, sessionPath := range sessionPaths {
+			if isUsed, err = r.isSessionUsed(sessionPath); err != nil {
+				return err
+			}
+			if isUsed {
+				break
+			}
+		}
+		if isUsed {
+			continue
+		}
+
+		logger.Infof("Logout iSCSI target {%v} which is not used by any device", targetName)
+		if err := r.iscsiLogout(targetName); err != nil {
+			return err
+		}
+		if r.Config.DeleteNodeRecordsOnLogout {
+			if err := r.iscsiDeleteNodeRecord(targetName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r OsDeviceConnectivityIscsi) getSessionPortal(sessionPath string) string {
+	addressPaths, err := r.Executer.FilepathGlob(filepath.Join(sessionPath, iscsiSessionAddressPath))
+	if err != nil || len(addressPaths) == 0 {
+		return ""
+	}
+	address := readSysfsValue(r.Executer, addressPaths[0])
+	port := readSysfsValue(r.Executer, filepath.Join(filepath.Dir(addressPaths[0]), iscsiSessionPortFileName))
+	if port == "" {
+		port = strconv.Itoa(iscsiDefaultPort)
+	}
+	return net.JoinHostPort(address, port)
+}
+
+func (r OsDeviceConnectivityIscsi) GetDownSessions(arrayIdentifiers []string) (map[string][]string, error) {
+	/*
+		Return the portals of the sessions to the targets which are not logged in, e.g. in FAILED state
+		while iscsid tries to recover them.
+	*/
+	sessionPaths, err := r.Executer.FilepathGlob(IscsiSessionsPath)
+	if err != nil {
+		logger.Errorf("Error while Glob iSCSI sessions : {%v}. err : {%v}", IscsiSessionsPath, err)
+		return nil, err
+	}
+
+	targets := make(map[string]bool)
+	for _, targetName := range arrayIdentifiers {
+		targets[targetName] = true
+	}
+	portalsByTarget := make(map[string][]string)
+	for _, sessionPath := range sessionPaths {
+		targetName := readSysfsValue(r.Executer, filepath.Join(sessionPath, "targetname"))
+		if !targets[targetName] {
+			continue
+		}
+		state := readSysfsValue(r.Executer, filepath.Join(sessionPath, "state"))
+		if state == IscsiSessionStateLoggedIn {
+			continue
+		}
+		portal := r.getSessionPortal(sessionPath)
+		logger.Debugf("iSCSI session {%v} of target {%v} portal {%v} is in state {%v}", filepath.Base(sessionPath), targetName, portal, state)
+		portalsByTarget[targetName] = append(portalsByTarget[targetName], portal)
+	}
+	return portalsByTarget, nil
+}
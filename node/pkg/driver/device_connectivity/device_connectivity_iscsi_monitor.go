@@ -0,0 +1,226 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ibm/ibm-block-csi-driver/node/logger"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executer"
+)
+
+const (
+	iscsiNodeRecordPortalPrefix = "Portal:"
+	iscsiNodeRecordIfacePrefix  = "Iface Name:"
+)
+
+// IscsiSessionMonitor polls the iSCSI sessions of the targets which the staged volumes depend on. It reports the
+// sessions which go down, which iscsid keeps recovering on its own, and logs in again the paths whose sessions are
+// gone on two polls in a row while their node records are left, e.g. after they were logged out outside of the driver.
+// A session is never logged out by the monitor, so the disks of a session are never lost.
+type IscsiSessionMonitor struct {
+	Interval        time.Duration // The monitor is disabled if the interval is 0
+	Iscsi           OsDeviceConnectivityIscsi
+	GetTargets      func() ([]string, error) // Returns the targets of the staged volumes
+	sessionStates   map[string]string
+	sessions        map[iscsiPath]bool // The paths of the targets which had a session on the last poll
+	missingSessions map[iscsiPath]bool // The paths whose sessions were gone on the last poll
+}
+
+func NewIscsiSessionMonitor(executer executer.ExecuterInterface, config IscsiConfig, getTargets func() ([]string, error)) *IscsiSessionMonitor {
+	return &IscsiSessionMonitor{
+		Interval:        config.SessionMonitorInterval,
+		Iscsi:           OsDeviceConnectivityIscsi{Executer: executer, Config: config},
+		GetTargets:      getTargets,
+		sessionStates:   make(map[string]string),
+		sessions:        make(map[iscsiPath]bool),
+		missingSessions: make(map[iscsiPath]bool),
+	}
+}
+
+func (m *IscsiSessionMonitor) Run(stopCh <-chan struct{}) {
+	logger.Infof("iSCSI session monitor started, interval : {%v}", m.Interval)
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			logger.Infof("iSCSI session monitor stopped")
+			return
+		case <-ticker.C:
+			m.Poll()
+		}
+	}
+}
+
+// Poll reports the state changes of the sessions of the targets, and logs in again the paths whose sessions were
+// gone on the previous poll too.
+func (m *IscsiSessionMonitor) Poll() {
+	logger.Debugf(">>>> IscsiSessionMonitor.Poll")
+	defer logger.Debugf("<<<< IscsiSessionMonitor.Poll")
+
+	targetNames, err := m.GetTargets()
+	if err != nil {
+		logger.Errorf("Failed to get the iSCSI targets of the staged volumes : {%v}", err)
+		return
+	}
+	sessionPathsByTarget, err := m.Iscsi.getSessionPathsByTarget(targetNames)
+	if err != nil {
+		logger.Errorf("Failed to get the iSCSI sessions : {%v}", err)
+		return
+	}
+	m.reportSessionStates(sessionPathsByTarget)
+	m.loginMissingSessions(targetNames)
+}
+
+func (m *IscsiSessionMonitor) reportSessionStates(sessionPathsByTarget map[string][]string) {
+	sessionStates := make(map[string]string)
+	for targetName, sessionPaths := range sessionPathsByTarget {
+		for _, sessionPath := range sessionPaths {
+			sessionName := filepath.Base(sessionPath)
+			state := readSysfsValue(m.Iscsi.Executer, filepath.Join(sessionPath, "state"))
+			sessionStates[sessionName] = state
+
+			previousState, isKnown := m.sessionStates[sessionName]
+			if isKnown && previousState == state {
+				continue
+			}
+			switch state {
+			case IscsiSessionStateLoggedIn:
+				if isKnown {
+					logger.Infof("iSCSI session {%v} of target {%v} recovered from state {%v}", sessionName, targetName, previousState)
+				}
+			case IscsiSessionStateFailed, IscsiSessionStateFree:
+				logger.Warningf("iSCSI session {%v} of target {%v} portal {%v} is in state {%v}", sessionName, targetName,
+					m.Iscsi.getSessionPortal(sessionPath), state)
+			}
+		}
+	}
+	m.sessionStates = sessionStates
+}
+
+func (m *IscsiSessionMonitor) loginMissingSessions(targetNames []string) {
+	/*
+		Only the paths which had a session are logged in again, since the discovery creates node records of portals
+		which were never logged in. The node record keeps the settings of the stage, e.g. the CHAP credentials.
+	*/
+	allSessions, err := m.Iscsi.getAllIfaceSessions()
+	if err != nil {
+		logger.Errorf("Failed to get the iSCSI sessions : {%v}", err)
+		return
+	}
+	targets := make(map[string]bool)
+	for _, targetName := range targetNames {
+		targets[targetName] = true
+	}
+	sessions := make(map[iscsiPath]bool)
+	for path := range allSessions {
+		if targets[path.targetName] {
+			sessions[path] = true
+		}
+	}
+
+	missingSessions := make(map[iscsiPath]bool)
+	nodeRecordsByTarget := make(map[string]map[iscsiPath]bool)
+	for _, previousPaths := range []map[iscsiPath]bool{m.sessions, m.missingSessions} {
+		for path := range previousPaths {
+			if sessions[path] || !targets[path.targetName] || missingSessions[path] {
+				continue
+			}
+			if !m.missingSessions[path] {
+				logger.Warningf("iSCSI session of target {%v} portal {%v} iface {%v} is gone", path.targetName, path.portal, path.iface)
+				missingSessions[path] = true
+				continue
+			}
+			nodeRecords, ok := nodeRecordsByTarget[path.targetName]
+			if !ok {
+				if nodeRecords, err = m.Iscsi.getNodeRecords(path.targetName); err != nil {
+					logger.Errorf("Failed to get the iSCSI node records of target {%v} : {%v}", path.targetName, err)
+				}
+				nodeRecordsByTarget[path.targetName] = nodeRecords
+			}
+			if nodeRecords == nil {
+				// the node records could not be listed, the login is tried again on the next poll
+				missingSessions[path] = true
+				continue
+			}
+			if !nodeRecords[path] {
+				logger.Infof("iSCSI node record of target {%v} portal {%v} iface {%v} was deleted, not logging it in again",
+					path.targetName, path.portal, path.iface)
+				continue
+			}
+			if err := m.login(path); err != nil {
+				logger.Errorf("Failed to login again iSCSI target {%v} portal {%v} iface {%v} : {%v}",
+					path.targetName, path.portal, path.iface, err)
+				missingSessions[path] = true
+			}
+		}
+	}
+	m.sessions = sessions
+	m.missingSessions = missingSessions
+}
+
+func (m *IscsiSessionMonitor) login(path iscsiPath) error {
+	logger.Warningf("Logging in again iSCSI target {%v} portal {%v} iface {%v}", path.targetName, path.portal, path.iface)
+	ctx := context.Background()
+	if m.Iscsi.Config.LoginTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Iscsi.Config.LoginTimeout)
+		defer cancel()
+	}
+	return m.Iscsi.iscsiLogin(ctx, path.targetName, path.portal, path.iface, iscsiLoginSettings{})
+}
+
+func (r OsDeviceConnectivityIscsi) getNodeRecords(targetName string) (map[iscsiPath]bool, error) {
+	/*
+		Return the portal and iface of each node record of the target, from the tree of the records, e.g.
+		Target: iqn.1986-03.com.ibm:2145.v7k1.node1
+			Portal: 1.1.1.1:3260,1
+				Iface Name: default
+	*/
+	output, err := r.iscsiCmd("-m", "node", "-T", targetName, "-P", "1")
+	if err != nil {
+		if exitError, isExitError := err.(*exec.ExitError); isExitError && exitError.ExitCode() == iSCSIErrNoObjsFound {
+			return map[iscsiPath]bool{}, nil
+		}
+		logger.Errorf("Failed to list iSCSI node records: {%s}, error: {%s}", output, err)
+		return nil, err
+	}
+	nodeRecords := make(map[iscsiPath]bool)
+	portal := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, iscsiNodeRecordPortalPrefix) {
+			portalInfo := strings.TrimSpace(strings.TrimPrefix(line, iscsiNodeRecordPortalPrefix))
+			if portalGroupSeparatorIndex := strings.LastIndex(portalInfo, ","); portalGroupSeparatorIndex >= 0 {
+				portalInfo = portalInfo[:portalGroupSeparatorIndex]
+			}
+			if portal, err = GetIscsiPortalWithPort(portalInfo); err != nil {
+				logger.Warningf("Failed to parse the portal of iSCSI node record {%v}, skipping it", line)
+				portal = ""
+			}
+		} else if strings.HasPrefix(line, iscsiNodeRecordIfacePrefix) && portal != "" {
+			iface := strings.TrimSpace(strings.TrimPrefix(line, iscsiNodeRecordIfacePrefix))
+			nodeRecords[iscsiPath{targetName: targetName, portal: portal, iface: iface}] = true
+		}
+	}
+	return nodeRecords, nil
+}
@@ -0,0 +1,124 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ibm/ibm-block-csi-driver/node/mocks"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
+)
+
+func TestIscsiSessionMonitorPoll(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	session2AddressPath := "/sys/class/iscsi_session/session2/device/connection2:0/iscsi_connection/connection2:0/persistent_address"
+	nodeRecordsArgs := []string{"-m", "node", "-T", target, "-P", "1"}
+	loginArgs := []string{"-m", "node", "-p", "2.2.2.2:3260", "-T", target, "-I", "default", "--login"}
+	nodeRecords := "Target: " + target + "\n\tPortal: 1.1.1.1:3260,1\n\t\tIface Name: default\n" +
+		"\tPortal: 2.2.2.2:3260,1\n\t\tIface Name: default\n"
+
+	testCases := []struct {
+		name                   string
+		session2States         []string // The state of session2 on each poll, none if the session is gone
+		nodeRecords            string
+		expNodeRecordsListings int
+		expLoginErrs           []error // The results of the logins of the gone session2, on the polls after it was gone twice
+	}{
+		{
+			name:           "Should only report a failed session and never log it out",
+			session2States: []string{"LOGGED_IN", "FAILED", "FAILED", "FREE", "LOGGED_IN"},
+		},
+		{
+			name:                   "Should login again a gone session whose node record is left, until the login succeeds",
+			session2States:         []string{"LOGGED_IN", "", "", "", ""},
+			nodeRecords:            nodeRecords,
+			expNodeRecordsListings: 2,
+			expLoginErrs:           []error{errors.New("iscsiadm: Could not login"), nil},
+		},
+		{
+			name:                   "Should not login again a gone session whose node record was deleted",
+			session2States:         []string{"LOGGED_IN", "", "", ""},
+			expNodeRecordsListings: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			sysfs := map[string]string{
+				"/sys/class/iscsi_session/session1/targetname":                                                             target,
+				"/sys/class/iscsi_session/session1/state":                                                                  "LOGGED_IN\n",
+				"/sys/class/iscsi_session/session1/ifacename":                                                              "default\n",
+				"/sys/class/iscsi_session/session1/device/connection1:0/iscsi_connection/connection1:0/persistent_address": "1.1.1.1\n",
+				"/sys/class/iscsi_session/session2/targetname":                                                             target,
+				"/sys/class/iscsi_session/session2/ifacename":                                                              "default\n",
+				session2AddressPath: "2.2.2.2\n",
+			}
+			var sessionPaths []string
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+			fakeExecuter.EXPECT().FilepathGlob(gomock.Any()).DoAndReturn(func(pattern string) ([]string, error) {
+				if pattern == device_connectivity.IscsiSessionsPath {
+					return sessionPaths, nil
+				}
+				var matches []string
+				for path := range sysfs {
+					if isMatch, _ := filepath.Match(pattern, path); isMatch {
+						matches = append(matches, path)
+					}
+				}
+				return matches, nil
+			}).AnyTimes()
+			fakeExecuter.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(filename string) ([]byte, error) {
+				if value, ok := sysfs[filename]; ok {
+					return []byte(value), nil
+				}
+				return nil, os.ErrNotExist
+			}).AnyTimes()
+
+			// the gone session is only reported on the first poll it is gone, and logged in again from the next poll
+			if tc.expNodeRecordsListings > 0 {
+				var nodeRecordsErr error
+				if tc.nodeRecords == "" {
+					nodeRecordsErr = newExitError(21)
+				}
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", nodeRecordsArgs).Return(
+					[]byte(tc.nodeRecords), nodeRecordsErr).Times(tc.expNodeRecordsListings)
+			}
+			for _, loginErr := range tc.expLoginErrs {
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", loginArgs).Return([]byte{}, loginErr)
+			}
+
+			monitor := device_connectivity.NewIscsiSessionMonitor(fakeExecuter, device_connectivity.IscsiConfig{}, func() ([]string, error) {
+				return []string{target}, nil
+			})
+			for _, session2State := range tc.session2States {
+				sessionPaths = []string{"/sys/class/iscsi_session/session1"}
+				if session2State != "" {
+					sessionPaths = append(sessionPaths, "/sys/class/iscsi_session/session2")
+					sysfs["/sys/class/iscsi_session/session2/state"] = session2State + "\n"
+				}
+				monitor.Poll()
+			}
+		})
+	}
+}
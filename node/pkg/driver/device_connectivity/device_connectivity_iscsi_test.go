@@ -0,0 +1,704 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ibm/ibm-block-csi-driver/node/mocks"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
+)
+
+func TestIscsiGetDownSessions(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	otherTarget := "iqn.1986-03.com.ibm:2145.v7k2.node1"
+	sysfs := map[string]string{
+		"/sys/class/iscsi_session/session1/targetname":                                                             target,
+		"/sys/class/iscsi_session/session1/state":                                                                  "LOGGED_IN\n",
+		"/sys/class/iscsi_session/session1/device/connection1:0/iscsi_connection/connection1:0/persistent_address": "1.1.1.1\n",
+		"/sys/class/iscsi_session/session2/targetname":                                                             target,
+		"/sys/class/iscsi_session/session2/state":                                                                  "FAILED\n",
+		"/sys/class/iscsi_session/session2/device/connection2:0/iscsi_connection/connection2:0/persistent_address": "2.2.2.2\n",
+		"/sys/class/iscsi_session/session3/targetname":                                                             otherTarget,
+		"/sys/class/iscsi_session/session3/state":                                                                  "FAILED\n",
+		"/sys/class/iscsi_session/session3/device/connection3:0/iscsi_connection/connection3:0/persistent_address": "3.3.3.3\n",
+	}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+	fakeExecuter.EXPECT().FilepathGlob(device_connectivity.IscsiSessionsPath).Return([]string{
+		"/sys/class/iscsi_session/session1", "/sys/class/iscsi_session/session2", "/sys/class/iscsi_session/session3",
+	}, nil)
+	fakeExecuter.EXPECT().FilepathGlob(
+		"/sys/class/iscsi_session/session2/device/connection*/iscsi_connection/connection*/persistent_address").Return(
+		[]string{"/sys/class/iscsi_session/session2/device/connection2:0/iscsi_connection/connection2:0/persistent_address"}, nil)
+	fakeExecuter.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(filename string) ([]byte, error) {
+		if value, ok := sysfs[filename]; ok {
+			return []byte(value), nil
+		}
+		return nil, os.ErrNotExist
+	}).AnyTimes()
+
+	osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{Executer: fakeExecuter}
+	portalsByTarget, err := osDeviceConnectivity.GetDownSessions([]string{target})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expPortalsByTarget := map[string][]string{target: {"2.2.2.2:3260"}}
+	if !reflect.DeepEqual(portalsByTarget, expPortalsByTarget) {
+		t.Fatalf("wrong down sessions: expected %v, got %v", expPortalsByTarget, portalsByTarget)
+	}
+}
+
+func newExitError(exitCode int) error {
+	return exec.Command("sh", "-c", fmt.Sprintf("exit %d", exitCode)).Run()
+}
+
+func TestIscsiEnsureLogin(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	portal := "1.1.1.1"
+	otherSession := "tcp: [1] 9.9.9.9:3260,1 iqn.1986-03.com.ibm:2145.v7k2.node1 (non-flash)"
+	chapSecrets := map[string]string{
+		device_connectivity.IscsiChapUsernameSecretKey: "initiator-user",
+		device_connectivity.IscsiChapPasswordSecretKey: "initiator-password",
+	}
+	mutualChapSecrets := map[string]string{
+		device_connectivity.IscsiChapUsernameSecretKey:       "initiator-user",
+		device_connectivity.IscsiChapPasswordSecretKey:       "initiator-password",
+		device_connectivity.IscsiMutualChapUsernameSecretKey: "target-user",
+		device_connectivity.IscsiMutualChapPasswordSecretKey: "target-password",
+	}
+	discoveryArgs := []string{"-m", "discoverydb", "-t", "sendtargets", "-p", portal + ":3260"}
+	nodeArgs := []string{"-m", "node", "-p", portal + ":3260", "-T", target}
+	updateArgs := func(recordArgs []string, name, value string) []string {
+		return append(append([]string{}, recordArgs...), "-o", "update", "-n", name, "-v", value)
+	}
+
+	testCases := []struct {
+		name             string
+		secrets          map[string]string
+		expUpdates       [][]string
+		loginErr         error
+		expErrType       reflect.Type
+		expResultErrType reflect.Type
+		expNoIscsiCmds   bool
+	}{
+		{
+			name: "Should login without authentication when there are no secrets",
+		},
+		{
+			name:    "Should set CHAP on the discovery and node records before login",
+			secrets: chapSecrets,
+			expUpdates: [][]string{
+				updateArgs(discoveryArgs, "discovery.sendtargets.auth.authmethod", "CHAP"),
+				updateArgs(discoveryArgs, "discovery.sendtargets.auth.username", "initiator-user"),
+				updateArgs(discoveryArgs, "discovery.sendtargets.auth.password", "initiator-password"),
+				updateArgs(nodeArgs, "node.session.auth.authmethod", "CHAP"),
+				updateArgs(nodeArgs, "node.session.auth.username", "initiator-user"),
+				updateArgs(nodeArgs, "node.session.auth.password", "initiator-password"),
+			},
+		},
+		{
+			name:    "Should set mutual CHAP on the discovery and node records before login",
+			secrets: mutualChapSecrets,
+			expUpdates: [][]string{
+				updateArgs(discoveryArgs, "discovery.sendtargets.auth.authmethod", "CHAP"),
+				updateArgs(discoveryArgs, "discovery.sendtargets.auth.username", "initiator-user"),
+				updateArgs(discoveryArgs, "discovery.sendtargets.auth.password", "initiator-password"),
+				updateArgs(discoveryArgs, "discovery.sendtargets.auth.username_in", "target-user"),
+				updateArgs(discoveryArgs, "discovery.sendtargets.auth.password_in", "target-password"),
+				updateArgs(nodeArgs, "node.session.auth.authmethod", "CHAP"),
+				updateArgs(nodeArgs, "node.session.auth.username", "initiator-user"),
+				updateArgs(nodeArgs, "node.session.auth.password", "initiator-password"),
+				updateArgs(nodeArgs, "node.session.auth.username_in", "target-user"),
+				updateArgs(nodeArgs, "node.session.auth.password_in", "target-password"),
+			},
+		},
+		{
+			name:           "Should fail on CHAP username without password",
+			secrets:        map[string]string{device_connectivity.IscsiChapUsernameSecretKey: "initiator-user"},
+			expErrType:     reflect.TypeOf(&device_connectivity.IscsiChapCredentialsError{}),
+			expNoIscsiCmds: true,
+		},
+		{
+			name: "Should fail on mutual CHAP without CHAP",
+			secrets: map[string]string{
+				device_connectivity.IscsiMutualChapUsernameSecretKey: "target-user",
+				device_connectivity.IscsiMutualChapPasswordSecretKey: "target-password",
+			},
+			expErrType:     reflect.TypeOf(&device_connectivity.IscsiChapCredentialsError{}),
+			expNoIscsiCmds: true,
+		},
+		{
+			name:             "Should report the portal when the authentication of the login fails",
+			loginErr:         newExitError(24),
+			expResultErrType: reflect.TypeOf(&device_connectivity.IscsiAuthenticationFailedError{}),
+		},
+		{
+			name:             "Should report the portal when the login fails",
+			loginErr:         newExitError(8),
+			expResultErrType: reflect.TypeOf(&exec.ExitError{}),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+
+			if !tc.expNoIscsiCmds {
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "session"}).Return([]byte(otherSession), nil)
+				if len(tc.expUpdates) > 0 {
+					fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", append(discoveryArgs, "-o", "new")).Return([]byte{}, nil)
+				}
+				for _, args := range tc.expUpdates {
+					fakeExecuter.EXPECT().ExecuteWithTimeoutSilently(gomock.Any(), "iscsiadm", args).Return([]byte{}, nil)
+				}
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", append(discoveryArgs, "--discover")).Return([]byte{}, nil)
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", append(nodeArgs, "--login")).Return([]byte{}, tc.loginErr)
+			}
+
+			osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{Executer: fakeExecuter}
+			results, err := osDeviceConnectivity.EnsureLogin(context.TODO(), map[string][]string{target: {portal}}, tc.secrets, nil)
+			if tc.expErrType != nil {
+				if reflect.TypeOf(err) != tc.expErrType {
+					t.Fatalf("Expected error type %v, got %v", tc.expErrType, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(results) != 1 || results[0].ArrayIdentifier != target || results[0].Portal != portal+":3260" {
+				t.Fatalf("wrong login results: got %v", results)
+			}
+			if reflect.TypeOf(results[0].Err) != tc.expResultErrType {
+				t.Fatalf("Expected login error type %v, got %v", tc.expResultErrType, results[0].Err)
+			}
+		})
+	}
+}
+
+func TestGetIscsiPortalWithPort(t *testing.T) {
+	testCases := []struct {
+		portal    string
+		expPortal string
+		expErr    bool
+	}{
+		{portal: "1.1.1.1", expPortal: "1.1.1.1:3260"},
+		{portal: "1.1.1.1:3261", expPortal: "1.1.1.1:3261"},
+		{portal: "fe80::1", expPortal: "[fe80::1]:3260"},
+		{portal: "[fe80::1]", expPortal: "[fe80::1]:3260"},
+		{portal: "[FE80:0:0::1]:3261", expPortal: "[fe80::1]:3261"},
+		{portal: "1.1.1.1:port", expErr: true},
+		{portal: "[fe80::1]:70000", expErr: true},
+		{portal: "", expErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.portal, func(t *testing.T) {
+			portal, err := device_connectivity.GetIscsiPortalWithPort(tc.portal)
+			if tc.expErr {
+				if _, ok := err.(*device_connectivity.IscsiPortalError); !ok {
+					t.Fatalf("Expected IscsiPortalError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if portal != tc.expPortal {
+				t.Fatalf("wrong portal: expected %v, got %v", tc.expPortal, portal)
+			}
+		})
+	}
+}
+
+func TestIscsiEnsureLoginIPv6(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	sessions := "tcp: [1] [fe80::1]:3260,1 " + target + " (non-flash)"
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+	fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "session"}).Return([]byte(sessions), nil)
+	fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+		[]string{"-m", "discoverydb", "-t", "sendtargets", "-p", "[fe80::2]:3261", "--discover"}).Return([]byte{}, nil)
+	fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+		[]string{"-m", "node", "-p", "[fe80::2]:3261", "-T", target, "--login"}).Return([]byte{}, nil)
+
+	osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{Executer: fakeExecuter}
+	results, err := osDeviceConnectivity.EnsureLogin(context.TODO(), map[string][]string{target: {"[fe80::1]", "[fe80::2]:3261"}}, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expResults := []device_connectivity.PortalLoginResult{
+		{ArrayIdentifier: target, Portal: "[fe80::1]:3260"},
+		{ArrayIdentifier: target, Portal: "[fe80::2]:3261"},
+	}
+	if !reflect.DeepEqual(results, expResults) {
+		t.Fatalf("wrong login results: expected %v, got %v", expResults, results)
+	}
+}
+
+func TestIscsiEnsureLoginIfaces(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	sessionPath := "/sys/class/iscsi_session/session1"
+	addressPath := sessionPath + "/device/connection1:0/iscsi_connection/connection1:0/persistent_address"
+	sysfsValues := map[string]string{
+		sessionPath + "/targetname": target,
+		sessionPath + "/ifacename":  "iface0",
+		addressPath:                 "1.1.1.1",
+		sessionPath + "/device/connection1:0/iscsi_connection/connection1:0/persistent_port": "3260",
+	}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+	fakeExecuter.EXPECT().FilepathGlob(device_connectivity.IscsiSessionsPath).Return([]string{sessionPath}, nil)
+	fakeExecuter.EXPECT().FilepathGlob(sessionPath+"/device/connection*/iscsi_connection/connection*/persistent_address").Return([]string{addressPath}, nil)
+	fakeExecuter.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(filename string) ([]byte, error) {
+		return []byte(sysfsValues[filename] + "\n"), nil
+	}).Times(4)
+	fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "iface", "-I", "eth1"}).Return(nil, newExitError(21))
+	fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "iface", "-I", "eth1", "-o", "new"}).Return([]byte{}, nil)
+	fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+		[]string{"-m", "iface", "-I", "eth1", "-o", "update", "-n", "iface.net_ifacename", "-v", "eth1"}).Return([]byte{}, nil)
+	fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+		[]string{"-m", "discoverydb", "-t", "sendtargets", "-p", "1.1.1.1:3260", "-I", "eth1", "--discover"}).Return([]byte{}, nil)
+	fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+		[]string{"-m", "node", "-p", "1.1.1.1:3260", "-T", target, "-I", "eth1", "--login"}).Return([]byte{}, nil)
+
+	osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{
+		Executer: fakeExecuter,
+		Config:   device_connectivity.IscsiConfig{Ifaces: []string{"iface0"}, IfaceNics: []string{"eth1"}},
+	}
+	results, err := osDeviceConnectivity.EnsureLogin(context.TODO(), map[string][]string{target: {"1.1.1.1"}}, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expResults := []device_connectivity.PortalLoginResult{
+		{ArrayIdentifier: target, Portal: "1.1.1.1:3260", Iface: "iface0"},
+		{ArrayIdentifier: target, Portal: "1.1.1.1:3260", Iface: "eth1"},
+	}
+	if !reflect.DeepEqual(results, expResults) {
+		t.Fatalf("wrong login results: expected %v, got %v", expResults, results)
+	}
+}
+
+func TestIscsiEnsureLoginDiscovery(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	testCases := []struct {
+		name          string
+		discovery     string
+		volumeContext map[string]string
+		expStatic     bool
+		expErr        error
+	}{
+		{
+			name: "Should discover the targets by SendTargets by default",
+		},
+		{
+			name:      "Should create the node records when configured to static discovery",
+			discovery: device_connectivity.IscsiDiscoveryStatic,
+			expStatic: true,
+		},
+		{
+			name:          "Should create the node records when the volume context has static discovery",
+			volumeContext: map[string]string{device_connectivity.IscsiDiscoveryVolumeContextKey: device_connectivity.IscsiDiscoveryStatic},
+			expStatic:     true,
+		},
+		{
+			name:          "Should discover the targets by SendTargets of the volume context over the config",
+			discovery:     device_connectivity.IscsiDiscoveryStatic,
+			volumeContext: map[string]string{device_connectivity.IscsiDiscoveryVolumeContextKey: device_connectivity.IscsiDiscoverySendTargets},
+		},
+		{
+			name:          "Should fail on an unknown discovery in the volume context",
+			volumeContext: map[string]string{device_connectivity.IscsiDiscoveryVolumeContextKey: "isns"},
+			expErr:        &device_connectivity.IscsiDiscoveryError{Discovery: "isns"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+
+			if tc.expErr == nil {
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "session"}).Return(nil, newExitError(21))
+				if tc.expStatic {
+					fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+						[]string{"-m", "node", "-p", "1.1.1.1:3260", "-T", target, "-o", "new"}).Return([]byte{}, nil)
+				} else {
+					fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+						[]string{"-m", "discoverydb", "-t", "sendtargets", "-p", "1.1.1.1:3260", "--discover"}).Return([]byte{}, nil)
+				}
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+					[]string{"-m", "node", "-p", "1.1.1.1:3260", "-T", target, "--login"}).Return([]byte{}, nil)
+			}
+
+			osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{
+				Executer: fakeExecuter,
+				Config:   device_connectivity.IscsiConfig{Discovery: tc.discovery},
+			}
+			results, err := osDeviceConnectivity.EnsureLogin(context.TODO(), map[string][]string{target: {"1.1.1.1"}}, nil, tc.volumeContext)
+			if !reflect.DeepEqual(err, tc.expErr) {
+				t.Fatalf("wrong error: expected %v, got %v", tc.expErr, err)
+			}
+			if tc.expErr == nil && (len(results) != 1 || results[0].Err != nil) {
+				t.Fatalf("Expected the portal to be logged in, got %v", results)
+			}
+		})
+	}
+}
+
+func TestIscsiEnsureLoginIser(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	testCases := []struct {
+		name           string
+		iserLoginErr   error
+		expResultIface string
+	}{
+		{
+			name:           "Should login over iSER through the iSER iface",
+			expResultIface: "iser",
+		},
+		{
+			name:         "Should fall back to TCP when the login over iSER fails",
+			iserLoginErr: newExitError(5),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+			fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "session"}).Return(nil, newExitError(21))
+			fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "iface", "-I", "iser"}).Return([]byte{}, nil)
+			fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+				[]string{"-m", "iface", "-I", "iser", "-o", "update", "-n", "iface.transport_name", "-v", "iser"}).Return([]byte{}, nil)
+			fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+				[]string{"-m", "discoverydb", "-t", "sendtargets", "-p", "1.1.1.1:3260", "-I", "iser", "--discover"}).Return([]byte{}, nil)
+			fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+				[]string{"-m", "node", "-p", "1.1.1.1:3260", "-T", target, "-I", "iser", "--login"}).Return([]byte{}, tc.iserLoginErr)
+			if tc.iserLoginErr != nil {
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+					[]string{"-m", "discoverydb", "-t", "sendtargets", "-p", "1.1.1.1:3260", "--discover"}).Return([]byte{}, nil)
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+					[]string{"-m", "node", "-p", "1.1.1.1:3260", "-T", target, "--login"}).Return([]byte{}, nil)
+			}
+
+			osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{
+				Executer: fakeExecuter,
+				Config:   device_connectivity.IscsiConfig{Transport: device_connectivity.IscsiTransportIser},
+			}
+			results, err := osDeviceConnectivity.EnsureLogin(context.TODO(), map[string][]string{target: {"1.1.1.1"}}, nil, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			expResults := []device_connectivity.PortalLoginResult{{ArrayIdentifier: target, Portal: "1.1.1.1:3260", Iface: tc.expResultIface}}
+			if !reflect.DeepEqual(results, expResults) {
+				t.Fatalf("wrong login results: expected %v, got %v", expResults, results)
+			}
+		})
+	}
+}
+
+func TestIscsiEnsureLoginSessionParameters(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	config := device_connectivity.IscsiConfig{SessionParameters: map[string]string{
+		device_connectivity.IscsiSessionReplacementTimeoutParameter: "120",
+		device_connectivity.IscsiStartupParameter:                   "automatic",
+	}}
+	testCases := []struct {
+		name             string
+		volumeContext    map[string]string
+		sessionTransport string
+		recordSettings   string   // The node record of the logged in portal
+		expRecordArgs    []string // The args of the node record of the logged in portal
+		expUpdatedRecord []string // The names and values of the settings which are updated on the node record of the logged in portal
+		expErr           error
+	}{
+		{
+			name: "Should set the session parameters of the volume context over the ones of the config",
+			volumeContext: map[string]string{
+				device_connectivity.IscsiSessionReplacementTimeoutParameter: "30",
+				"other_attribute": "value",
+			},
+			sessionTransport: "tcp",
+			recordSettings:   "node.session.timeo.replacement_timeout = 120\nnode.startup = manual\n",
+			expRecordArgs:    []string{"-m", "node", "-p", "1.1.1.1:3260", "-T", target},
+			expUpdatedRecord: []string{"node.session.timeo.replacement_timeout", "30", "node.startup", "automatic"},
+		},
+		{
+			name: "Should update only the session parameters which differ from the node record",
+			volumeContext: map[string]string{
+				device_connectivity.IscsiSessionReplacementTimeoutParameter: "30",
+			},
+			sessionTransport: "tcp",
+			recordSettings:   "node.session.timeo.replacement_timeout = 120\nnode.startup = automatic\n",
+			expRecordArgs:    []string{"-m", "node", "-p", "1.1.1.1:3260", "-T", target},
+			expUpdatedRecord: []string{"node.session.timeo.replacement_timeout", "30"},
+		},
+		{
+			name:             "Should not update the node record which has the session parameters",
+			sessionTransport: "tcp",
+			recordSettings:   "node.session.timeo.replacement_timeout = 120\nnode.startup = automatic\n",
+			expRecordArgs:    []string{"-m", "node", "-p", "1.1.1.1:3260", "-T", target},
+		},
+		{
+			name:             "Should update the node record of the iSER iface of a portal which is logged in over iSER",
+			sessionTransport: "iser",
+			recordSettings:   "node.session.timeo.replacement_timeout = 120\nnode.startup = manual\n",
+			expRecordArgs:    []string{"-m", "node", "-p", "1.1.1.1:3260", "-T", target, "-I", "iser"},
+			expUpdatedRecord: []string{"node.startup", "automatic"},
+		},
+		{
+			name:          "Should fail on an invalid session parameter in the volume context",
+			volumeContext: map[string]string{device_connectivity.IscsiQueueDepthParameter: "0"},
+			expErr:        &device_connectivity.IscsiSessionParameterError{Name: device_connectivity.IscsiQueueDepthParameter, Value: "0"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+
+			if tc.expErr == nil {
+				sessions := tc.sessionTransport + ": [1] 1.1.1.1:3260,1 " + target + " (non-flash)"
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "session"}).Return([]byte(sessions), nil)
+				// the node record of the logged in portal is updated for its next login
+				fakeExecuter.EXPECT().ExecuteWithTimeoutSilently(gomock.Any(), "iscsiadm",
+					append(append([]string{}, tc.expRecordArgs...), "-o", "show")).Return([]byte(tc.recordSettings), nil)
+				for i := 0; i < len(tc.expUpdatedRecord); i += 2 {
+					fakeExecuter.EXPECT().ExecuteWithTimeoutSilently(gomock.Any(), "iscsiadm", append(append([]string{}, tc.expRecordArgs...),
+						"-o", "update", "-n", tc.expUpdatedRecord[i], "-v", tc.expUpdatedRecord[i+1])).Return([]byte{}, nil)
+				}
+				// the node record of the new portal is updated before its login
+				recordArgs := []string{"-m", "node", "-p", "2.2.2.2:3260", "-T", target, "-o", "update", "-n"}
+				replacementTimeout := tc.volumeContext[device_connectivity.IscsiSessionReplacementTimeoutParameter]
+				if replacementTimeout == "" {
+					replacementTimeout = "120"
+				}
+				fakeExecuter.EXPECT().ExecuteWithTimeoutSilently(gomock.Any(), "iscsiadm",
+					append(recordArgs, "node.session.timeo.replacement_timeout", "-v", replacementTimeout)).Return([]byte{}, nil)
+				fakeExecuter.EXPECT().ExecuteWithTimeoutSilently(gomock.Any(), "iscsiadm",
+					append(recordArgs, "node.startup", "-v", "automatic")).Return([]byte{}, nil)
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+					[]string{"-m", "discoverydb", "-t", "sendtargets", "-p", "2.2.2.2:3260", "--discover"}).Return([]byte{}, nil)
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+					[]string{"-m", "node", "-p", "2.2.2.2:3260", "-T", target, "--login"}).Return([]byte{}, nil)
+			}
+
+			osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{Executer: fakeExecuter, Config: config}
+			_, err := osDeviceConnectivity.EnsureLogin(context.TODO(), map[string][]string{target: {"1.1.1.1", "2.2.2.2"}}, nil, tc.volumeContext)
+			if !reflect.DeepEqual(err, tc.expErr) {
+				t.Fatalf("wrong error: expected %v, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestIscsiEnsureLogout(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	otherTarget := "iqn.1986-03.com.ibm:2145.v7k2.node1"
+	sessionPaths := []string{"/sys/class/iscsi_session/session1", "/sys/class/iscsi_session/session2"}
+	targetNames := map[string]string{
+		"/sys/class/iscsi_session/session1/targetname": target,
+		"/sys/class/iscsi_session/session2/targetname": otherTarget,
+	}
+	testCases := []struct {
+		name              string
+		config            device_connectivity.IscsiConfig
+		disks             []string
+		expLogout         bool
+		expDeleteRecord   bool
+		expNoSessionCheck bool
+	}{
+		{
+			name:      "Should logout of the target when its sessions have no disks",
+			expLogout: true,
+		},
+		{
+			name:            "Should logout of the target and delete its node record",
+			config:          device_connectivity.IscsiConfig{DeleteNodeRecordsOnLogout: true},
+			expLogout:       true,
+			expDeleteRecord: true,
+		},
+		{
+			name:  "Should not logout of the target when its sessions still have disks",
+			disks: []string{"/sys/class/iscsi_session/session1/device/target1:0:0/1:0:0:2/block/sdd"},
+		},
+		{
+			name:              "Should keep the sessions when configured to",
+			config:            device_connectivity.IscsiConfig{KeepSessionsOnUnstage: true},
+			expNoSessionCheck: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+
+			if !tc.expNoSessionCheck {
+				fakeExecuter.EXPECT().FilepathGlob(device_connectivity.IscsiSessionsPath).Return(sessionPaths, nil)
+				fakeExecuter.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(filename string) ([]byte, error) {
+					return []byte(targetNames[filename] + "\n"), nil
+				}).Times(2)
+				fakeExecuter.EXPECT().FilepathGlob("/sys/class/iscsi_session/session1/device/target*/*/block/*").Return(tc.disks, nil)
+			}
+			if tc.expLogout {
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "node", "-T", target, "--logout"}).Return([]byte{}, nil)
+			}
+			if tc.expDeleteRecord {
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "node", "-T", target, "-o", "delete"}).Return([]byte{}, nil)
+			}
+
+			osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{Executer: fakeExecuter, Config: tc.config}
+			if err := osDeviceConnectivity.EnsureLogout("SVC:6005076810810261F800000000000A5B", []string{target}); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestIscsiGetTargetsOfDevices(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+
+	fakeExecuter.EXPECT().FilepathGlob("/sys/class/iscsi_session/session*/device/target*/*/block/*").Return([]string{
+		"/sys/class/iscsi_session/session1/device/target1:0:0/1:0:0:1/block/sdb",
+		"/sys/class/iscsi_session/session2/device/target2:0:0/2:0:0:1/block/sdc",
+		"/sys/class/iscsi_session/session3/device/target3:0:0/3:0:0:1/block/sdd",
+	}, nil)
+	fakeExecuter.EXPECT().IoutilReadFile("/sys/class/iscsi_session/session1/targetname").Return([]byte(target+"\n"), nil)
+	fakeExecuter.EXPECT().IoutilReadFile("/sys/class/iscsi_session/session2/targetname").Return([]byte(target+"\n"), nil)
+
+	osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{Executer: fakeExecuter}
+	targetNames, err := osDeviceConnectivity.GetTargetsOfDevices([]string{"sdb", "sdc"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(targetNames, []string{target}) {
+		t.Fatalf("Expected targets %v, got %v", []string{target}, targetNames)
+	}
+}
+
+func TestIscsiEnsureLoginRetries(t *testing.T) {
+	target := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	otherTarget := "iqn.1986-03.com.ibm:2145.v7k2.node1"
+	otherSession := "tcp: [1] 9.9.9.9:3260,1 iqn.1986-03.com.ibm:2145.v7k3.node1 (non-flash)"
+	config := device_connectivity.IscsiConfig{LoginWorkers: 4, LoginRetries: 2, LoginRetryInterval: time.Millisecond}
+	loginArgs := func(targetName, portal string) []string {
+		return []string{"-m", "node", "-p", portal, "-T", targetName, "--login"}
+	}
+	discoveryArgs := func(portal string) []string {
+		return []string{"-m", "discoverydb", "-t", "sendtargets", "-p", portal, "--discover"}
+	}
+
+	testCases := []struct {
+		name           string
+		loginErrs      []error
+		expLoginErr    bool
+		expCanceled    bool
+		expNoIscsiCmds bool
+	}{
+		{
+			name:      "Should retry a login which failed with a transient error",
+			loginErrs: []error{newExitError(8), newExitError(8), nil},
+		},
+		{
+			name:        "Should fail a login which failed with transient errors on all retries",
+			loginErrs:   []error{newExitError(8), newExitError(8), newExitError(8)},
+			expLoginErr: true,
+		},
+		{
+			name:        "Should not retry a login which failed with a permanent error",
+			loginErrs:   []error{newExitError(19)},
+			expLoginErr: true,
+		},
+		{
+			name:           "Should not login once the context is done",
+			expCanceled:    true,
+			expLoginErr:    true,
+			expNoIscsiCmds: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+
+			fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", []string{"-m", "session"}).Return([]byte(otherSession), nil)
+			if !tc.expNoIscsiCmds {
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", discoveryArgs("1.1.1.1:3260")).Return([]byte{}, nil)
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", discoveryArgs("3.3.3.3:3260")).Return([]byte{}, nil)
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", loginArgs(target, "2.2.2.2:3260")).Return([]byte{}, nil)
+				fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm", loginArgs(otherTarget, "3.3.3.3:3260")).Return([]byte{}, nil)
+				var calls []*gomock.Call
+				for _, loginErr := range tc.loginErrs {
+					calls = append(calls, fakeExecuter.EXPECT().ExecuteWithTimeout(gomock.Any(), "iscsiadm",
+						loginArgs(target, "1.1.1.1:3260")).Return([]byte{}, loginErr))
+				}
+				gomock.InOrder(calls...)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.expCanceled {
+				cancel()
+			}
+			osDeviceConnectivity := &device_connectivity.OsDeviceConnectivityIscsi{Executer: fakeExecuter, Config: config}
+			results, err := osDeviceConnectivity.EnsureLogin(ctx, map[string][]string{
+				target:      {"1.1.1.1", "2.2.2.2"},
+				otherTarget: {"3.3.3.3"},
+			}, nil, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(results) != 3 {
+				t.Fatalf("Expected results of 3 portals, got %v", results)
+			}
+			for _, result := range results {
+				isFailedPortal := result.Portal == "1.1.1.1:3260" || tc.expCanceled
+				if (result.Err != nil) != (isFailedPortal && tc.expLoginErr) {
+					t.Fatalf("wrong login error of portal %v: got %v", result.Portal, result.Err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/ibm/ibm-block-csi-driver/node/logger"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executer"
+)
+
+type OsDeviceConnectivityNvmeOFc struct {
+	Executer          executer.ExecuterInterface
+	HelperNvme        OsDeviceConnectivityHelperNvmeInterface
+	HelperScsiGeneric OsDeviceConnectivityHelperScsiGenericInterface
+}
+
+func NewOsDeviceConnectivityNvmeOFc(executer executer.ExecuterInterface) OsDeviceConnectivityInterface {
+	return &OsDeviceConnectivityNvmeOFc{
+		Executer:          executer,
+		HelperNvme:        NewOsDeviceConnectivityHelperNvme(executer),
+		HelperScsiGeneric: NewOsDeviceConnectivityHelperScsiGeneric(executer),
+	}
+}
+
+func (r OsDeviceConnectivityNvmeOFc) EnsureLogin(_ context.Context, _ map[string][]string, _ map[string]string, _ map[string]string) ([]PortalLoginResult, error) {
+	// NVMe/FC controllers are connected by the host (udev / nvme-cli autoconnect), no login is needed
+	return nil, nil
+}
+
+func (r OsDeviceConnectivityNvmeOFc) getArrayControllers(arrayIdentifiers []string) ([]NvmeController, error) {
+	controllers, err := r.HelperNvme.GetControllers(NvmeTransportFC)
+	if err != nil {
+		return nil, err
+	}
+
+	var arrayControllers []NvmeController
+	for _, controller := range controllers {
+		targetAddress := strings.ToLower(controller.Address[nvmeAddressTargetAddressKey])
+		for _, wwpn := range arrayIdentifiers {
+			wwpn = strings.TrimPrefix(strings.ToLower(wwpn), "0x")
+			if strings.Contains(targetAddress, nvmeFcPortNamePrefix+wwpn) {
+				arrayControllers = append(arrayControllers, controller)
+				break
+			}
+		}
+	}
+	return arrayControllers, nil
+}
+
+func (r OsDeviceConnectivityNvmeOFc) RescanDevices(lunId int, arrayIdentifiers []string) error {
+	/*
+		The lunId is the namespace ID of the volume on the NVMe subsystem of the storage.
+	*/
+	logger.Debugf("Rescan : Start rescan on NVMe/FC controllers of array identifiers : {%v}", arrayIdentifiers)
+	controllers, err := r.getArrayControllers(arrayIdentifiers)
+	if err != nil {
+		return err
+	}
+	if len(controllers) == 0 {
+		return &ConnectivityIdentifierStorageTargetNotFoundError{StorageTargetName: strings.Join(arrayIdentifiers, ","),
+			DirectoryPath: filepath.Dir(NvmeSubsystemControllersPath)}
+	}
+
+	if err := r.HelperNvme.RescanControllers(controllers); err != nil {
+		return err
+	}
+
+	if err := r.HelperNvme.WaitForNamespace(controllers, lunId); err != nil {
+		return err
+	}
+	logger.Debugf("Rescan : finish rescan NVMe/FC controllers for namespace ID : {%v}", lunId)
+	return nil
+}
+
+func (r OsDeviceConnectivityNvmeOFc) GetMpathDevice(volumeId string) (string, error) {
+	/*
+	   Return Value: "/dev/dm-X" or "/dev/nvmeXnY" (native NVMe multipath) of the volumeID.
+	*/
+	return r.HelperNvme.GetMpathDevice(volumeId)
+}
+
+func (r OsDeviceConnectivityNvmeOFc) FlushMultipathDevice(mpathDevice string) error {
+	if IsNvmeNativeDevice(mpathDevice) {
+		// native NVMe multipath head device is removed by the kernel once the namespace is unmapped
+		return nil
+	}
+	return r.HelperScsiGeneric.FlushMultipathDevice(mpathDevice)
+}
+
+func (r OsDeviceConnectivityNvmeOFc) RemovePhysicalDevice(_ []string) error {
+	// NVMe namespaces are removed by the kernel on the namespace change notification of the storage,
+	// the delete file of the NVMe device removes the whole controller so it must not be used here.
+	return nil
+}
+
+func (r OsDeviceConnectivityNvmeOFc) GetMpathDeviceCondition(mpathDevice string) (bool, string, error) {
+	if IsNvmeNativeDevice(mpathDevice) {
+		return r.HelperNvme.GetNativeMpathDeviceCondition(filepath.Base(mpathDevice))
+	}
+	return r.HelperScsiGeneric.GetMpathDeviceCondition(mpathDevice)
+}
+
+func (r OsDeviceConnectivityNvmeOFc) EnsureLogout(_ string, _ []string) error {
+	// NVMe/FC controllers are kept connected by the host
+	return nil
+}
@@ -0,0 +1,125 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity_test
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ibm/ibm-block-csi-driver/node/mocks"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
+)
+
+func TestNvmeOFcRescanDevices(t *testing.T) {
+	namespaceId := 1
+	arrayWwpn := "500507680B21C0AA"
+	controllerPaths := []string{
+		"/sys/class/nvme-subsystem/nvme-subsys0/nvme0/transport",
+		"/sys/class/nvme-subsystem/nvme-subsys1/nvme1/transport",
+		"/sys/class/nvme-subsystem/nvme-subsys2/nvme2/transport",
+	}
+	files := map[string]string{
+		"/sys/class/nvme-subsystem/nvme-subsys0/nvme0/transport": "fc",
+		"/sys/class/nvme-subsystem/nvme-subsys0/nvme0/address":   "traddr=nn-0x500507680b00c0aa:pn-0x500507680b21c0aa,host_traddr=nn-0x20000090fa9f5a8c:pn-0x10000090fa9f5a8c",
+		"/sys/class/nvme-subsystem/nvme-subsys1/nvme1/transport": "fc",
+		"/sys/class/nvme-subsystem/nvme-subsys1/nvme1/address":   "traddr=nn-0x500507680b00c0bb:pn-0x500507680b21c0bb,host_traddr=nn-0x20000090fa9f5a8c:pn-0x10000090fa9f5a8c",
+		"/sys/class/nvme-subsystem/nvme-subsys2/nvme2/transport": "tcp",
+		"/sys/class/nvme-subsystem/nvme-subsys2/nvme2/address":   "traddr=1.1.1.1,trsvcid=4420",
+		"/sys/class/nvme-subsystem/nvme-subsys0/nvme0n1/nsid":    "1",
+	}
+	writeError := errors.New("Dummy error")
+
+	testCases := []struct {
+		name                    string
+		arrayIdentifiers        []string
+		writeErr                error
+		expRescannedControllers []string
+		expErrType              reflect.Type
+		expErr                  error
+	}{
+		{
+			name:                    "Should rescan only the FC controller whose traddr has the array wwpn",
+			arrayIdentifiers:        []string{arrayWwpn},
+			expRescannedControllers: []string{"nvme0"},
+		},
+		{
+			name:                    "Should match the array wwpn with a 0x prefix",
+			arrayIdentifiers:        []string{"0x500507680b21c0aa"},
+			expRescannedControllers: []string{"nvme0"},
+		},
+		{
+			name:             "Should fail when no FC controller has the array wwpn",
+			arrayIdentifiers: []string{"500507680b21c0cc"},
+			expErrType:       reflect.TypeOf(&device_connectivity.ConnectivityIdentifierStorageTargetNotFoundError{}),
+		},
+		{
+			name:                    "Should fail when the rescan of the controller cannot be written",
+			arrayIdentifiers:        []string{arrayWwpn},
+			writeErr:                writeError,
+			expRescannedControllers: []string{"nvme0"},
+			expErr:                  writeError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+			fakeExecuter.EXPECT().FilepathGlob(gomock.Any()).DoAndReturn(func(pattern string) ([]string, error) {
+				switch pattern {
+				case device_connectivity.NvmeSubsystemControllersPath:
+					return controllerPaths, nil
+				case "/sys/class/nvme-subsystem/nvme-subsys0/nvme*n*/nsid":
+					return []string{"/sys/class/nvme-subsystem/nvme-subsys0/nvme0n1/nsid"}, nil
+				}
+				return nil, nil
+			}).AnyTimes()
+			fakeExecuter.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(path string) ([]byte, error) {
+				if value, ok := files[path]; ok {
+					return []byte(value + "\n"), nil
+				}
+				return nil, os.ErrNotExist
+			}).AnyTimes()
+			for _, controller := range tc.expRescannedControllers {
+				filename := "/sys/class/nvme/" + controller + "/rescan_controller"
+				fakeExecuter.EXPECT().OsOpenFile(filename, os.O_APPEND|os.O_WRONLY, os.FileMode(0200)).Return(nil, nil)
+				fakeExecuter.EXPECT().FileWriteString(nil, "1").Return(1, tc.writeErr)
+			}
+
+			nvmeOFc := device_connectivity.NewOsDeviceConnectivityNvmeOFc(fakeExecuter)
+			err := nvmeOFc.RescanDevices(namespaceId, tc.arrayIdentifiers)
+
+			switch {
+			case tc.expErrType != nil:
+				if reflect.TypeOf(err) != tc.expErrType {
+					t.Fatalf("Wrong error type: expected %v, got %v", tc.expErrType, reflect.TypeOf(err))
+				}
+			case tc.expErr != nil:
+				if err != tc.expErr {
+					t.Fatalf("Wrong error: expected %v, got %v", tc.expErr, err)
+				}
+			case err != nil:
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
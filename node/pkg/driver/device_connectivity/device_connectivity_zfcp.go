@@ -0,0 +1,116 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_connectivity
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ibm/ibm-block-csi-driver/node/logger"
+)
+
+const (
+	ZfcpDriverPath         = "/sys/bus/ccw/drivers/zfcp"
+	zfcpUnitAddFileName    = "unit_add"
+	zfcpUnitRemoveFileName = "unit_remove"
+	zfcpHbaIdFileName      = "hba_id"
+	zfcpWwpnFileName       = "wwpn"
+	zfcpFcpLunFileName     = "fcp_lun"
+)
+
+// zfcpUnit is a LUN of a remote port of an FCP device, e.g. 0x0001000000000000 of 0x500507680b25c0aa of 0.0.1900
+type zfcpUnit struct {
+	devno  string
+	wwpn   string
+	fcpLun string
+}
+
+// GetZfcpLun returns the 64 bit FCP LUN of a LUN id, in the SAM addressing the kernel uses for the scsi LUNs.
+func GetZfcpLun(lunId int) string {
+	var fcpLun uint64
+	lun := uint64(lunId)
+	for shift := 48; shift >= 0; shift -= 16 {
+		fcpLun |= (lun & 0xffff) << uint(shift)
+		lun >>= 16
+	}
+	return fmt.Sprintf("0x%016x", fcpLun)
+}
+
+// attachZfcpUnits adds the unit of the LUN on each pair of an FCP device and a remote port of the array, which the
+// LUN is not attached through yet.
+func (r OsDeviceConnectivityFc) attachZfcpUnits(lunId int, arrayIdentifiers []string) {
+	fcpLun := GetZfcpLun(lunId)
+	for _, arrayIdentifier := range arrayIdentifiers {
+		wwpn := "0x" + strings.ToLower(normalizeFcWwn(arrayIdentifier))
+		portPaths, err := r.Executer.FilepathGlob(filepath.Join(ZfcpDriverPath, "*", wwpn))
+		if err != nil {
+			logger.Errorf("Failed to list the zfcp ports of storage target {%v} : {%v}", arrayIdentifier, err)
+			continue
+		}
+		if len(portPaths) == 0 {
+			logger.Warningf("Storage target {%v} was not found on any FCP device under {%v}", arrayIdentifier, ZfcpDriverPath)
+		}
+		for _, portPath := range portPaths {
+			if unitPaths, _ := r.Executer.FilepathGlob(filepath.Join(portPath, fcpLun)); len(unitPaths) != 0 {
+				logger.Debugf("Idempotency: zfcp unit {%v} of {%v} already exists", fcpLun, portPath)
+				continue
+			}
+			unitAddFilename := filepath.Join(portPath, zfcpUnitAddFileName)
+			logger.Debugf("Attach zfcp unit : echo %s > %s", fcpLun, unitAddFilename)
+			if err := r.writeSysfsFile(unitAddFilename, fcpLun); err != nil {
+				logger.Errorf("Failed to attach zfcp unit {%v} of {%v} : {%v}", fcpLun, portPath, err)
+			}
+		}
+	}
+}
+
+// getZfcpUnits returns the zfcp units of the scsi devices, the devices which are not zfcp devices are skipped.
+func (r OsDeviceConnectivityFc) getZfcpUnits(sysDevices []string) []zfcpUnit {
+	var units []zfcpUnit
+	for _, deviceName := range sysDevices {
+		if deviceName == "" {
+			continue
+		}
+		devicePath := fmt.Sprintf("/sys/block/%s/device", deviceName)
+		unit := zfcpUnit{
+			devno:  r.readFcAttribute(devicePath, zfcpHbaIdFileName),
+			wwpn:   r.readFcAttribute(devicePath, zfcpWwpnFileName),
+			fcpLun: r.readFcAttribute(devicePath, zfcpFcpLunFileName),
+		}
+		if unit.devno == "" || unit.wwpn == "" || unit.fcpLun == "" {
+			continue
+		}
+		units = append(units, unit)
+	}
+	return units
+}
+
+func (r OsDeviceConnectivityFc) detachZfcpUnits(units []zfcpUnit) {
+	for _, unit := range units {
+		portPath := filepath.Join(ZfcpDriverPath, unit.devno, unit.wwpn)
+		if unitPaths, _ := r.Executer.FilepathGlob(filepath.Join(portPath, unit.fcpLun)); len(unitPaths) == 0 {
+			// the LUN was scanned without a unit, e.g. with NPIV
+			continue
+		}
+		unitRemoveFilename := filepath.Join(portPath, zfcpUnitRemoveFileName)
+		logger.Debugf("Detach zfcp unit : echo %s > %s", unit.fcpLun, unitRemoveFilename)
+		if err := r.writeSysfsFile(unitRemoveFilename, unit.fcpLun); err != nil {
+			logger.Warningf("Failed to detach zfcp unit {%v} of {%v} : {%v}", unit.fcpLun, portPath, err)
+		}
+	}
+}
@@ -1,3 +1,5 @@
 package device_connectivity
 
 const fcSubsystemPrefix = "pci-*-"
+
+const isZfcpArch = false
@@ -1,3 +1,6 @@
 package device_connectivity
 
 const fcSubsystemPrefix = "ccw-*-"
+
+// the FCP LUNs are attached through zfcp units, since they are not scanned without NPIV
+const isZfcpArch = true
@@ -30,6 +30,29 @@ func (e *ConnectivityIdentifierStorageTargetNotFoundError) Error() string {
 	return fmt.Sprintf("Connectivity Error: Storage target name [%s] was not found on the host, under directory %s. Please check the host connectivity to the storage.", e.StorageTargetName, e.DirectoryPath)
 }
 
+type ConnectivityStorageTargetOfflineError struct {
+	StorageTargetName string
+	OfflinePorts      []string
+}
+
+func (e *ConnectivityStorageTargetOfflineError) Error() string {
+	return fmt.Sprintf("Connectivity Error: Storage target name [%s] is visible on the host only through ports which are not Online %v.", e.StorageTargetName, e.OfflinePorts)
+}
+
+type StorageTargetsOfflineError struct {
+	OfflineTargets  []*ConnectivityStorageTargetOfflineError
+	NotFoundTargets []string
+}
+
+func (e *StorageTargetsOfflineError) Error() string {
+	offlineTargets := make([]string, 0, len(e.OfflineTargets))
+	for _, offlineTarget := range e.OfflineTargets {
+		offlineTargets = append(offlineTargets, fmt.Sprintf("%s %v", offlineTarget.StorageTargetName, offlineTarget.OfflinePorts))
+	}
+	return fmt.Sprintf("Connectivity Error: No Online path to the storage. Storage targets %v are visible but offline, storage targets %v are not found on the host. Please check the ports and the zoning of the host.",
+		offlineTargets, e.NotFoundTargets)
+}
+
 type MultipleDeviceNotFoundError struct {
 	DiskByPathDevice     string
 	LinkToPhysicalDevice string
@@ -76,3 +99,78 @@ func (e *ErrorWrongDeviceFound) Error() string {
 		"BUT sg_inq identify this device as a different WWN: [%s]. Check your multipathd.", e.devPath,
 		e.reqVolName, e.volName)
 }
+
+type NvmeNamespaceNotFoundError struct {
+	NamespaceId int
+}
+
+func (e *NvmeNamespaceNotFoundError) Error() string {
+	return fmt.Sprintf("Couldn't find NVMe namespace with ID [%d] in the connected NVMe subsystems. Please check the host connectivity to the storage.", e.NamespaceId)
+}
+
+type MultipleNvmeNamespacesError struct {
+	VolumeId   string
+	Namespaces []string
+}
+
+func (e *MultipleNvmeNamespacesError) Error() string {
+	return fmt.Sprintf("Detected more than one NVMe namespace (%v) for single volume (%s) while native NVMe multipath is enabled", e.Namespaces, e.VolumeId)
+}
+
+type IscsiChapCredentialsError struct {
+	Message string
+}
+
+func (e *IscsiChapCredentialsError) Error() string {
+	return fmt.Sprintf("Invalid iSCSI CHAP credentials in the node stage secrets: %s", e.Message)
+}
+
+type FcRescanStrategyError struct {
+	RescanStrategy string
+}
+
+func (e *FcRescanStrategyError) Error() string {
+	return fmt.Sprintf("Invalid FC rescan strategy [%s], it must be either [%s] or [%s]", e.RescanStrategy, FcRescanStrategyScan, FcRescanStrategyIssueLip)
+}
+
+type IscsiDiscoveryError struct {
+	Discovery string
+}
+
+func (e *IscsiDiscoveryError) Error() string {
+	return fmt.Sprintf("Invalid iSCSI discovery [%s], it must be either [%s] or [%s]", e.Discovery, IscsiDiscoverySendTargets, IscsiDiscoveryStatic)
+}
+
+type IscsiTransportError struct {
+	Transport string
+}
+
+func (e *IscsiTransportError) Error() string {
+	return fmt.Sprintf("Invalid iSCSI transport [%s], it must be either [%s] or [%s]", e.Transport, IscsiTransportTcp, IscsiTransportIser)
+}
+
+type IscsiSessionParameterError struct {
+	Name  string
+	Value string
+}
+
+func (e *IscsiSessionParameterError) Error() string {
+	return fmt.Sprintf("Unsupported iSCSI session parameter [%s] or invalid value [%s]", e.Name, e.Value)
+}
+
+type IscsiAuthenticationFailedError struct {
+	TargetName string
+	Portal     string
+}
+
+func (e *IscsiAuthenticationFailedError) Error() string {
+	return fmt.Sprintf("iSCSI CHAP authentication of target [%s] through portal [%s] failed. Please check the CHAP credentials in the node stage secrets and on the storage system.", e.TargetName, e.Portal)
+}
+
+type IscsiPortalError struct {
+	Portal string
+}
+
+func (e *IscsiPortalError) Error() string {
+	return fmt.Sprintf("Invalid iSCSI portal [%s], expected ip, ip:port, [ipv6] or [ipv6]:port", e.Portal)
+}
@@ -36,17 +36,43 @@ import (
 
 type Driver struct {
 	NodeService
-	srv      *grpc.Server
-	endpoint string
-	config   ConfigFile
+	srv                    *grpc.Server
+	endpoint               string
+	config                 ConfigFile
+	orphanDevicesCollector *OrphanDevicesCollector
+	iscsiSessionMonitor    *device_connectivity.IscsiSessionMonitor
+	stopCh                 chan struct{}
 }
 
-func NewDriver(endpoint string, configFilePath string, hostname string) (*Driver, error) {
+func NewDriver(endpoint string, configFilePath string, hostname string, collectorConfig OrphanDevicesCollectorConfig,
+	iscsiConfig device_connectivity.IscsiConfig, fcConfig device_connectivity.FcConfig, minLoggedInPortals int) (*Driver, error) {
 	configFile, err := ReadConfigFile(configFilePath)
 	if err != nil {
 		return nil, err
 	}
 	logger.Infof("Driver: %v Version: %v", configFile.Identity.Name, configFile.Identity.Version)
+	iscsiConfig.Ifaces = configFile.Node.Iscsi_ifaces
+	iscsiConfig.IfaceNics = configFile.Node.Iscsi_iface_nics
+	iscsiConfig.Discovery = configFile.Node.Iscsi_discovery
+	if err := device_connectivity.ValidateIscsiDiscovery(iscsiConfig.Discovery); err != nil {
+		logger.Errorf("%v", err)
+		return nil, err
+	}
+	iscsiConfig.Transport = configFile.Node.Iscsi_transport
+	if err := device_connectivity.ValidateIscsiTransport(iscsiConfig.Transport); err != nil {
+		logger.Errorf("%v", err)
+		return nil, err
+	}
+	iscsiConfig.SessionParameters = configFile.Node.Iscsi_session_parameters
+	if err := device_connectivity.ValidateIscsiSessionParameters(iscsiConfig.SessionParameters); err != nil {
+		logger.Errorf("%v", err)
+		return nil, err
+	}
+	fcConfig.RescanStrategy = configFile.Node.Fc_rescan_strategy
+	if err := device_connectivity.ValidateFcRescanStrategy(fcConfig.RescanStrategy); err != nil {
+		logger.Errorf("%v", err)
+		return nil, err
+	}
 
 	mounter := &mount.SafeFormatAndMount{
 		Interface: mountwrapper.New(""),
@@ -56,16 +82,23 @@ func NewDriver(endpoint string, configFilePath string, hostname string) (*Driver
 	syncLock := NewSyncLock()
 	executer := &executer.Executer{}
 	osDeviceConnectivityMapping := map[string]device_connectivity.OsDeviceConnectivityInterface{
-		device_connectivity.ConnectionTypeISCSI: device_connectivity.NewOsDeviceConnectivityIscsi(executer),
-		device_connectivity.ConnectionTypeFC:    device_connectivity.NewOsDeviceConnectivityFc(executer),
-		// TODO nvme
+		device_connectivity.ConnectionTypeISCSI:   device_connectivity.NewOsDeviceConnectivityIscsi(executer, iscsiConfig),
+		device_connectivity.ConnectionTypeFC:      device_connectivity.NewOsDeviceConnectivityFc(executer, fcConfig),
+		device_connectivity.ConnectionTypeNVMEoFC: device_connectivity.NewOsDeviceConnectivityNvmeOFc(executer),
 	}
 	osDeviceConnectivityHelper := device_connectivity.NewOsDeviceConnectivityHelperScsiGeneric(executer)
-	return &Driver{
+	driver := &Driver{
 		endpoint:    endpoint,
 		config:      configFile,
-		NodeService: NewNodeService(configFile, hostname, *NewNodeUtils(executer, mounter), osDeviceConnectivityMapping, osDeviceConnectivityHelper, executer, mounter, syncLock),
-	}, nil
+		NodeService: NewNodeService(configFile, hostname, *NewNodeUtils(executer, mounter), osDeviceConnectivityMapping, osDeviceConnectivityHelper, executer, mounter, syncLock, minLoggedInPortals),
+		stopCh:      make(chan struct{}),
+	}
+	driver.orphanDevicesCollector = NewOrphanDevicesCollector(collectorConfig, &driver.NodeService,
+		device_connectivity.NewOsDeviceConnectivityHelperGeneric(executer))
+	driver.iscsiSessionMonitor = device_connectivity.NewIscsiSessionMonitor(executer, iscsiConfig, func() ([]string, error) {
+		return driver.getStagedArrayInitiators(device_connectivity.ConnectionTypeISCSI)
+	})
+	return driver, nil
 }
 
 func (d *Driver) Run() error {
@@ -74,20 +107,23 @@ func (d *Driver) Run() error {
 		return err
 	}
 
+	// the volumes which were staged before a restart of the node are reconciled before any request is served
+	d.ReconcileStagedVolumes()
+
+	if d.orphanDevicesCollector.Config.Interval > 0 {
+		go d.orphanDevicesCollector.Run(d.stopCh)
+	}
+	if d.iscsiSessionMonitor.Interval > 0 {
+		go d.iscsiSessionMonitor.Run(d.stopCh)
+	}
+
 	listener, err := net.Listen(scheme, addr)
 	if err != nil {
 		return err
 	}
 
-	logErr := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
-		if err != nil {
-			logger.Errorf("GRPC error: %v", err)
-		}
-		return resp, err
-	}
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logErr),
+		grpc.UnaryInterceptor(logGRPC),
 	}
 	d.srv = grpc.NewServer(opts...)
 
@@ -98,8 +134,22 @@ func (d *Driver) Run() error {
 	return d.srv.Serve(listener)
 }
 
+// logGRPC logs the requests and responses with their secrets stripped, and the errors of the gRPC calls.
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	logger.Debugf("GRPC call: %s", info.FullMethod)
+	logger.Debugf("GRPC request: %s", util.StripSecrets(req))
+	resp, err := handler(ctx, req)
+	if err != nil {
+		logger.Errorf("GRPC error: %v", err)
+	} else {
+		logger.Debugf("GRPC response: %s", util.StripSecrets(resp))
+	}
+	return resp, err
+}
+
 func (d *Driver) Stop() {
 	logger.Infof("Stopping server")
+	close(d.stopCh)
 	d.srv.Stop()
 }
 
@@ -119,6 +169,15 @@ type ConfigFile struct {
 		//...
 		//<array_iqn_k> : comma-separated list of iqn_k iscsi target ips
 	}
+	Node struct {
+		Iscsi_ifaces     []string // iscsiadm ifaces to discover and login through, instead of the default iface
+		Iscsi_iface_nics []string // NICs to create iscsiadm ifaces for, and discover and login through
+		Iscsi_discovery  string   // sendtargets (default) or static, to create the node records from the publish context
+		Iscsi_transport  string   // tcp (default) or iser, which falls back to tcp for the portals which fail to login
+		// iscsiadm session parameters of the node records, e.g. node.session.timeo.replacement_timeout
+		Iscsi_session_parameters map[string]string
+		Fc_rescan_strategy       string // scan (default), or issue_lip to issue a LIP first if no array port is found
+	}
 }
 
 const (
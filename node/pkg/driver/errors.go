@@ -18,6 +18,9 @@ package driver
 
 import (
 	"fmt"
+	"strings"
+
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
 )
 
 type ConfigYmlEmptyAttribute struct {
@@ -43,3 +46,26 @@ type VolumeAlreadyProcessingError struct {
 func (e *VolumeAlreadyProcessingError) Error() string {
 	return fmt.Sprintf("Volume %s is already processing. request cannot be completed.", e.volId)
 }
+
+type PortalsLoginError struct {
+	FailedPortals      []device_connectivity.PortalLoginResult
+	LoggedInPortals    int
+	MinLoggedInPortals int
+}
+
+func (e *PortalsLoginError) Error() string {
+	return fmt.Sprintf("Failed to login to the storage portals {%s}, %d portals are logged in while at least %d are required. Please check the host connectivity to the storage.",
+		formatFailedPortals(e.FailedPortals), e.LoggedInPortals, e.MinLoggedInPortals)
+}
+
+func formatFailedPortals(failedPortals []device_connectivity.PortalLoginResult) string {
+	failures := make([]string, 0, len(failedPortals))
+	for _, result := range failedPortals {
+		portal := fmt.Sprintf("target [%s] portal [%s]", result.ArrayIdentifier, result.Portal)
+		if result.Iface != "" {
+			portal += fmt.Sprintf(" iface [%s]", result.Iface)
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", portal, result.Err))
+	}
+	return strings.Join(failures, "; ")
+}
@@ -30,6 +30,7 @@ import (
 //go:generate mockgen -destination=../../../mocks/mock_executer.go -package=mocks github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executer ExecuterInterface
 type ExecuterInterface interface { // basic host dependent functions
 	ExecuteWithTimeout(mSeconds int, command string, args []string) ([]byte, error)
+	ExecuteWithTimeoutSilently(mSeconds int, command string, args []string) ([]byte, error)
 	OsOpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
 	OsReadlink(name string) (string, error)
 	FilepathGlob(pattern string) (matches []string, err error)
@@ -43,7 +44,20 @@ type Executer struct {
 }
 
 func (e *Executer) ExecuteWithTimeout(mSeconds int, command string, args []string) ([]byte, error) {
-	logger.Debugf("Executing command : {%v} with args : {%v}. and timeout : {%v} mseconds", command, args, mSeconds)
+	return e.executeWithTimeout(mSeconds, command, args, false)
+}
+
+// ExecuteWithTimeoutSilently executes the command without logging its args and output, for commands with secrets.
+func (e *Executer) ExecuteWithTimeoutSilently(mSeconds int, command string, args []string) ([]byte, error) {
+	return e.executeWithTimeout(mSeconds, command, args, true)
+}
+
+func (e *Executer) executeWithTimeout(mSeconds int, command string, args []string, silent bool) ([]byte, error) {
+	if silent {
+		logger.Debugf("Executing command : {%v} with hidden args. and timeout : {%v} mseconds", command, mSeconds)
+	} else {
+		logger.Debugf("Executing command : {%v} with args : {%v}. and timeout : {%v} mseconds", command, args, mSeconds)
+	}
 
 	// Create a new context and add a timeout to it
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(mSeconds)*time.Millisecond)
@@ -64,7 +78,9 @@ func (e *Executer) ExecuteWithTimeout(mSeconds int, command string, args []strin
 	}
 
 	// If there's no context error, we know the command completed (or errored).
-	logger.Debugf("Output from command: %s", string(out))
+	if !silent {
+		logger.Debugf("Output from command: %s", string(out))
+	}
 	if err != nil {
 		logger.Debugf("Non-zero exit code: %s", err)
 	}
@@ -17,6 +17,8 @@ package driver
 
 var ErrorWhileTryingToReadIQN = "Error while trying to get iqn  from string: %v."
 
+var ErrorWhileTryingToReadNQN = "Error while trying to get nqn from string: %v."
+
 var ErrorUnsupportedConnectivityType = "Unsupported connectivity type : {%v}"
 
 var ErrorWhileTryingToReadFC = "Error while tring to get FC port from string: %v."
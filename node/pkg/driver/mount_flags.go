@@ -0,0 +1,162 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	mountFlagKeyValueSeparator = "="
+)
+
+var (
+	numberRegex = regexp.MustCompile(`^[0-9]+$`)
+	sizeRegex   = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+
+	// bindMountFlags are the flags of the mount point itself (and not of the filesystem),
+	// so they are the only flags which can be applied to the bind mount of the publish.
+	bindMountFlags = map[string]bool{
+		"atime": true, "noatime": true, "diratime": true, "nodiratime": true,
+		"relatime": true, "norelatime": true, "strictatime": true, "nostrictatime": true,
+		"dev": true, "nodev": true, "exec": true, "noexec": true, "suid": true, "nosuid": true,
+	}
+
+	genericMountFlags = map[string]bool{
+		"defaults": true, "async": true, "sync": true, "dirsync": true, "lazytime": true, "nolazytime": true,
+		"mand": true, "nomand": true, "iversion": true, "noiversion": true, "rw": true, readOnlyMountOption: true,
+	}
+
+	fsMountFlags = map[string]map[string]bool{
+		"ext4": {
+			"acl": true, "noacl": true, "user_xattr": true, "nouser_xattr": true,
+			"barrier": true, "nobarrier": true, "discard": true, "nodiscard": true,
+			"delalloc": true, "nodelalloc": true, "auto_da_alloc": true, "noauto_da_alloc": true,
+			"journal_checksum": true, "nojournal_checksum": true, "journal_async_commit": true,
+			"block_validity": true, "noblock_validity": true, "dioread_lock": true, "dioread_nolock": true,
+			"init_itable": true, "noinit_itable": true, "grpid": true, "nogrpid": true, "bsdgroups": true, "sysvgroups": true,
+			"quota": true, "noquota": true, "usrquota": true, "grpquota": true, "prjquota": true,
+		},
+		"ext3": {
+			"acl": true, "noacl": true, "user_xattr": true, "nouser_xattr": true,
+			"barrier": true, "nobarrier": true, "discard": true, "nodiscard": true,
+			"grpid": true, "nogrpid": true, "bsdgroups": true, "sysvgroups": true,
+			"quota": true, "noquota": true, "usrquota": true, "grpquota": true,
+		},
+		"xfs": {
+			"attr2": true, "noattr2": true, "discard": true, "nodiscard": true,
+			"grpid": true, "nogrpid": true, "bsdgroups": true, "sysvgroups": true,
+			"filestreams": true, "ikeep": true, "noikeep": true, "inode32": true, "inode64": true,
+			"largeio": true, "nolargeio": true, "noalign": true, "norecovery": true, "nouuid": true,
+			"swalloc": true, "wsync": true, "noquota": true,
+			"uquota": true, "usrquota": true, "uqnoenforce": true, "quota": true,
+			"gquota": true, "grpquota": true, "gqnoenforce": true,
+			"pquota": true, "prjquota": true, "pqnoenforce": true,
+		},
+	}
+
+	fsMountFlagsValueValidators = map[string]map[string]func(string) bool{
+		"ext4": {
+			"data":                 oneOf("journal", "ordered", "writeback"),
+			"errors":               oneOf("continue", "remount-ro", "panic"),
+			"commit":               numberRegex.MatchString,
+			"stripe":               numberRegex.MatchString,
+			"max_batch_time":       numberRegex.MatchString,
+			"min_batch_time":       numberRegex.MatchString,
+			"inode_readahead_blks": numberRegex.MatchString,
+			"init_itable":          numberRegex.MatchString,
+		},
+		"ext3": {
+			"data":   oneOf("journal", "ordered", "writeback"),
+			"errors": oneOf("continue", "remount-ro", "panic"),
+			"commit": numberRegex.MatchString,
+		},
+		"xfs": {
+			"allocsize": sizeRegex.MatchString,
+			"logbsize":  sizeRegex.MatchString,
+			"logbufs":   numberRegex.MatchString,
+			"sunit":     numberRegex.MatchString,
+			"swidth":    numberRegex.MatchString,
+		},
+	}
+)
+
+func oneOf(values ...string) func(string) bool {
+	return func(value string) bool {
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// getFsTypesForMountFlags returns the filesystems the mount flags may be applied to.
+// When no fs_type is requested, the filesystem is only known after the device is staged.
+func getFsTypesForMountFlags(fsType string) []string {
+	if fsType != "" {
+		return []string{fsType}
+	}
+	fsTypes := make([]string, 0, len(fsMountFlags))
+	for fs := range fsMountFlags {
+		fsTypes = append(fsTypes, fs)
+	}
+	return fsTypes
+}
+
+func isValidMountFlag(fsType string, mountFlag string) bool {
+	if bindMountFlags[mountFlag] || genericMountFlags[mountFlag] {
+		return true
+	}
+	for _, fs := range getFsTypesForMountFlags(fsType) {
+		if fsMountFlags[fs][mountFlag] {
+			return true
+		}
+		keyValue := strings.SplitN(mountFlag, mountFlagKeyValueSeparator, 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		if isValidValue, ok := fsMountFlagsValueValidators[fs][keyValue[0]]; ok && isValidValue(keyValue[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMountFlags validates the mount flags of the volume capability against the filesystem type.
+func validateMountFlags(fsType string, mountFlags []string) error {
+	for _, mountFlag := range mountFlags {
+		if !isValidMountFlag(fsType, mountFlag) {
+			return &RequestValidationError{fmt.Sprintf("Mount flag {%s} is not supported for fs_type {%s}", mountFlag, fsType)}
+		}
+	}
+	return nil
+}
+
+// getBindMountFlags returns the mount flags that can be applied to a bind mount.
+func getBindMountFlags(mountFlags []string) []string {
+	var flags []string
+	for _, mountFlag := range mountFlags {
+		if bindMountFlags[mountFlag] {
+			flags = append(flags, mountFlag)
+		}
+	}
+	return flags
+}
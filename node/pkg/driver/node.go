@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"syscall"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/ibm/ibm-block-csi-driver/node/goid_info"
@@ -36,6 +37,8 @@ var (
 	nodeCaps = []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 	}
 
 	// volumeCaps represents how the volume could be accessed.
@@ -48,14 +51,24 @@ var (
 	}
 
 	defaultFSType              = "ext4"
+	readOnlyMountOption        = "ro"
 	StageInfoFilename          = ".stageInfo.json"
+	stageInfoAccessTypeMount   = "mount"
+	stageInfoAccessTypeBlock   = "block"
 	supportedConnectivityTypes = map[string]bool{
-		device_connectivity.ConnectionTypeISCSI: true,
-		device_connectivity.ConnectionTypeFC:    true,
-		// TODO add nvme later on
+		device_connectivity.ConnectionTypeISCSI:   true,
+		device_connectivity.ConnectionTypeFC:      true,
+		device_connectivity.ConnectionTypeNVMEoFC: true,
 	}
 
-	IscsiFullPath = "/host/etc/iscsi/initiatorname.iscsi"
+	IscsiFullPath       = "/host/etc/iscsi/initiatorname.iscsi"
+	NvmeHostNqnFullPath = "/host/etc/nvme/hostnqn"
+
+	// nvmeConnectivityTypes are searched for the device of a volume before the scsi generic helper,
+	// since their devices are not discovered by the multipathd and sg_inq based search.
+	nvmeConnectivityTypes = []string{
+		device_connectivity.ConnectionTypeNVMEoFC,
+	}
 )
 
 const (
@@ -80,8 +93,17 @@ type NodeService struct {
 	NodeUtils                   NodeUtilsInterface
 	executer                    executer.ExecuterInterface
 	VolumeIdLocksMap            SyncLockInterface
+	TargetLocks                 *TargetLocks // Held while logging in and rescanning on stage, and while logging out on unstage
 	OsDeviceConnectivityMapping map[string]device_connectivity.OsDeviceConnectivityInterface
 	OsDeviceConnectivityHelper  device_connectivity.OsDeviceConnectivityHelperScsiGenericInterface
+	MinLoggedInPortals          int // NodeStageVolume fails if fewer portals of the storage are logged in
+}
+
+// mpathDeviceHandler is the part of the device connectivity which handles an already discovered device
+type mpathDeviceHandler interface {
+	FlushMultipathDevice(mpathDevice string) error
+	RemovePhysicalDevice(sysDevices []string) error
+	GetMpathDeviceCondition(mpathDevice string) (bool, string, error)
 }
 
 // newNodeService creates a new node service
@@ -89,7 +111,7 @@ type NodeService struct {
 func NewNodeService(configYaml ConfigFile, hostname string, nodeUtils NodeUtilsInterface,
 	OsDeviceConnectivityMapping map[string]device_connectivity.OsDeviceConnectivityInterface,
 	osDeviceConnectivityHelper device_connectivity.OsDeviceConnectivityHelperScsiGenericInterface,
-	executer executer.ExecuterInterface, mounter NodeMounter, syncLock SyncLockInterface) NodeService {
+	executer executer.ExecuterInterface, mounter NodeMounter, syncLock SyncLockInterface, minLoggedInPortals int) NodeService {
 	return NodeService{
 		ConfigYaml:                  configYaml,
 		Hostname:                    hostname,
@@ -99,13 +121,15 @@ func NewNodeService(configYaml ConfigFile, hostname string, nodeUtils NodeUtilsI
 		OsDeviceConnectivityHelper:  osDeviceConnectivityHelper,
 		Mounter:                     mounter,
 		VolumeIdLocksMap:            syncLock,
+		TargetLocks:                 NewTargetLocks(),
+		MinLoggedInPortals:          minLoggedInPortals,
 	}
 }
 
 func (d *NodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	goid_info.SetAdditionalIDInfo(req.VolumeId)
 	defer goid_info.DeleteAdditionalIDInfo()
-	logger.Debugf(">>>> NodeStageVolume: called with args %+v", *req)
+	logger.Debugf(">>>> NodeStageVolume")
 	defer logger.Debugf("<<<< NodeStageVolume")
 
 	err := d.nodeStageVolumeRequestValidation(req)
@@ -138,11 +162,25 @@ func (d *NodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Wrong connectivity type %s", connectivityType))
 	}
 
-	osDeviceConnectivity.EnsureLogin(ipsByArrayInitiator)
+	// the targets stay locked until the devices of the volume are scanned, so they are not logged out meanwhile
+	unlockTargets := d.TargetLocks.Lock(arrayInitiators, "NodeStageVolume")
+	err = d.ensureLogin(ctx, osDeviceConnectivity, ipsByArrayInitiator, req.GetSecrets(), req.GetVolumeContext())
+	if err != nil {
+		unlockTargets()
+		logger.Errorf("Error while logging in to the storage : {%v}", err.Error())
+		switch err.(type) {
+		case *device_connectivity.IscsiChapCredentialsError, *device_connectivity.IscsiDiscoveryError,
+			*device_connectivity.IscsiTransportError, *device_connectivity.IscsiSessionParameterError:
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
 
 	err = osDeviceConnectivity.RescanDevices(lun, arrayInitiators)
+	unlockTargets()
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.Internal, d.getErrorWithDiagnostics(osDeviceConnectivity, arrayInitiators, err))
 	}
 
 	mpathDevice, err := osDeviceConnectivity.GetMpathDevice(volId)
@@ -152,9 +190,29 @@ func (d *NodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	baseDevice := path.Base(mpathDevice)
+	rawSysDevices, err := d.NodeUtils.GetSysDevicesFromMpath(baseDevice)
+	if err != nil {
+		logger.Errorf("Error while trying to get sys devices : {%v}", err.Error())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	stageInfo := &StageInfo{
+		VolumeId:        volId,
+		Connectivity:    connectivityType,
+		Lun:             lun,
+		ArrayInitiators: arrayInitiators,
+		MpathDevice:     baseDevice,
+		SysDevices:      splitSysDevices(rawSysDevices),
+	}
+
+	stagingPath := req.GetStagingTargetPath() // e.g in k8s /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-21967c74-b456-11e9-b93e-005056a45d5f/globalmount
 	volumeCap := req.GetVolumeCapability()
 	switch volumeCap.GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
+		stageInfo.AccessType = stageInfoAccessTypeBlock
+		if err := d.writeStageInfo(getStageInfoPath(stagingPath, false), stageInfo); err != nil {
+			return nil, err
+		}
 		logger.Debugf("NodeStageVolume Finished: multipath device [%s] is ready to be mounted by NodePublishVolume API.", mpathDevice)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
@@ -171,8 +229,10 @@ func (d *NodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		logger.Errorf("Error while resolving type of filesystem to mount : {%v}", err.Error())
 		return nil, err
 	}
+	stageInfo.AccessType = stageInfoAccessTypeMount
+	stageInfo.FsType = fsTypeForMount
+	stageInfoPath := getStageInfoPath(stagingPath, true)
 
-	stagingPath := req.GetStagingTargetPath() // e.g in k8s /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-21967c74-b456-11e9-b93e-005056a45d5f/globalmount
 	stagingPathWithHostPrefix := d.NodeUtils.GetPodPath(stagingPath)
 
 	// check if already mounted
@@ -182,18 +242,56 @@ func (d *NodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, err
 	}
 	if isMounted { // idempotent case
+		if err := d.writeStageInfo(stageInfoPath, stageInfo); err != nil {
+			return nil, err
+		}
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	err = d.formatAndMount(mpathDevice, stagingPath, fsTypeForMount, existingFormat)
+	mountFlags := volumeCap.GetMount().GetMountFlags()
+	if requestedFsType == "" {
+		// the mount flags were validated before the filesystem of the device was known
+		if err := validateMountFlags(fsTypeForMount, mountFlags); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	err = d.formatAndMount(mpathDevice, stagingPath, fsTypeForMount, existingFormat, mountFlags)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if err := d.writeStageInfo(stageInfoPath, stageInfo); err != nil {
+		return nil, err
+	}
+
 	logger.Debugf("NodeStageVolume Finished: staging path [%s] is ready to be mounted by NodePublishVolume API.", stagingPath)
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// diagnoser is implemented by the connectivity types which can diagnose their connectivity to the storage.
+type diagnoser interface {
+	GetDiagnostics(arrayIdentifiers []string) (string, error) // Returns a short summary, the full report is logged
+}
+
+// getErrorWithDiagnostics returns the error message with the diagnostics summary of the connectivity to the storage, if any.
+func (d *NodeService) getErrorWithDiagnostics(osDeviceConnectivity device_connectivity.OsDeviceConnectivityInterface,
+	arrayInitiators []string, err error) string {
+	connectivityDiagnoser, ok := osDeviceConnectivity.(diagnoser)
+	if !ok {
+		return err.Error()
+	}
+	summary, diagnosticsErr := connectivityDiagnoser.GetDiagnostics(arrayInitiators)
+	if diagnosticsErr != nil {
+		logger.Warningf("Failed to get the connectivity diagnostics : {%v}", diagnosticsErr)
+		return err.Error()
+	}
+	if summary == "" {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s. %s", err.Error(), summary)
+}
+
 func (d *NodeService) nodeStageVolumeRequestValidation(req *csi.NodeStageVolumeRequest) error {
 
 	volumeID := req.GetVolumeId()
@@ -224,6 +322,9 @@ func (d *NodeService) nodeStageVolumeRequestValidation(req *csi.NodeStageVolumeR
 	// If the access type is not mount and not block, should never happen
 	switch volCap.GetAccessType().(type) {
 	case *csi.VolumeCapability_Mount:
+		if err := validateMountFlags(volCap.GetMount().GetFsType(), volCap.GetMount().GetMountFlags()); err != nil {
+			return err
+		}
 	case *csi.VolumeCapability_Block:
 	default:
 		return &RequestValidationError{"Volume Access Type is not supported"}
@@ -261,6 +362,16 @@ func (d *NodeService) nodeStageVolumeRequestValidation(req *csi.NodeStageVolumeR
 		}
 	}
 
+	if connectivityType == device_connectivity.ConnectionTypeISCSI {
+		for _, portals := range ipsByArrayInitiator {
+			for _, portal := range portals {
+				if _, err := device_connectivity.GetIscsiPortalWithPort(portal); err != nil {
+					return &RequestValidationError{fmt.Sprintf("PublishContext with wrong iSCSI portal : %v", err)}
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -280,7 +391,7 @@ func (d *NodeService) resolveFsTypeForMount(requestedFsType string, existingForm
 	return fsTypeForMount, nil
 }
 
-func (d *NodeService) formatAndMount(mpathDevice string, stagingPath string, fsTypeForMount string, existingFormat string) error {
+func (d *NodeService) formatAndMount(mpathDevice string, stagingPath string, fsTypeForMount string, existingFormat string, mountFlags []string) error {
 	if existingFormat == "" {
 		d.NodeUtils.FormatDevice(mpathDevice, fsTypeForMount)
 	}
@@ -289,8 +400,13 @@ func (d *NodeService) formatAndMount(mpathDevice string, stagingPath string, fsT
 	if fsTypeForMount == "xfs" {
 		mountOptions = append(mountOptions, "nouuid")
 	}
+	for _, mountFlag := range mountFlags {
+		if mountFlag != "nouuid" || fsTypeForMount != "xfs" {
+			mountOptions = append(mountOptions, mountFlag)
+		}
+	}
 
-	logger.Debugf("Mount the device with fs_type = {%v} (Create filesystem if needed)", fsTypeForMount)
+	logger.Debugf("Mount the device with fs_type = {%v}, options = {%v} (Create filesystem if needed)", fsTypeForMount, mountOptions)
 	return d.Mounter.FormatAndMount(mpathDevice, stagingPath, fsTypeForMount, mountOptions) // Passing without /host because k8s mounter uses mount\mkfs\fsck
 }
 
@@ -298,7 +414,7 @@ func (d *NodeService) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	volumeID := req.GetVolumeId()
 	goid_info.SetAdditionalIDInfo(volumeID)
 	defer goid_info.DeleteAdditionalIDInfo()
-	logger.Debugf(">>>> NodeUnstageVolume: called with args %+v", *req)
+	logger.Debugf(">>>> NodeUnstageVolume")
 	defer logger.Debugf("<<<< NodeUnstageVolume")
 
 	if len(volumeID) == 0 {
@@ -334,39 +450,30 @@ func (d *NodeService) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		}
 	}
 
-	mpathDevice, err := d.OsDeviceConnectivityHelper.GetMpathDevice(volumeID)
-	if err != nil {
-		switch err.(type) {
-		case *device_connectivity.MultipathDeviceNotFoundForVolumeError:
-			return &csi.NodeUnstageVolumeResponse{}, nil
-		default:
-			logger.Errorf("Error while discovering the device : {%v}", err.Error())
-			return nil, status.Error(codes.Internal, err.Error())
+	stageInfo, stageInfoPath := d.getStageInfo(stagingTargetPath)
+	if stageInfo != nil {
+		// the devices are removed even if the multipath device is already gone, as long as they still belong to the volume
+		d.dropDevicesNotOfVolume(volumeID, stageInfo)
+	} else {
+		stageInfo, err = d.discoverStageInfo(volumeID)
+		if err != nil {
+			switch err.(type) {
+			case *device_connectivity.MultipathDeviceNotFoundForVolumeError:
+				stageInfo = nil
+			default:
+				return nil, status.Error(codes.Internal, err.Error())
+			}
 		}
 	}
-	logger.Debugf("Discovered device : {%v}", mpathDevice)
-
-	baseDevice := path.Base(mpathDevice)
 
-	rawSysDevices, err := d.NodeUtils.GetSysDevicesFromMpath(baseDevice)
-	if err != nil {
-		logger.Errorf("Error while trying to get sys devices : {%v}", err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	sysDevices := strings.Split(rawSysDevices, ",")
-
-	err = d.OsDeviceConnectivityHelper.FlushMultipathDevice(baseDevice)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Multipath -f command failed with error: %v", err)
-	}
-	err = d.OsDeviceConnectivityHelper.RemovePhysicalDevice(sysDevices)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Remove scsi device failed with error: %v", err)
+	if stageInfo != nil {
+		err = d.removeStagedDevices(volumeID, stageInfo)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	stageInfoPath := path.Join(stagingTargetPath, StageInfoFilename)
-	if d.NodeUtils.StageInfoFileIsExist(stageInfoPath) {
+	if stageInfoPath != "" {
 		if err := d.NodeUtils.ClearStageInfoFile(stageInfoPath); err != nil {
 			return nil, status.Errorf(codes.Internal, "Fail to clear the stage info file: error %v", err)
 		}
@@ -380,7 +487,7 @@ func (d *NodeService) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 func (d *NodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	goid_info.SetAdditionalIDInfo(req.VolumeId)
 	defer goid_info.DeleteAdditionalIDInfo()
-	logger.Debugf(">>>> NodePublishVolume: called with args %+v", *req)
+	logger.Debugf(">>>> NodePublishVolume")
 	defer logger.Debugf("<<<< NodePublishVolume")
 
 	err := d.nodePublishVolumeRequestValidation(req)
@@ -424,6 +531,10 @@ func (d *NodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return nil, err
 		}
 		if isMounted { // idempotent case
+			err = d.checkTargetMountReadOnly(targetPathWithHostPrefix, req.GetReadonly())
+			if err != nil {
+				return nil, err
+			}
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
 	} else {
@@ -440,16 +551,16 @@ func (d *NodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 
 	if isFSVolume {
 		fsType := volumeCap.GetMount().FsType
-		err = d.publishFileSystemVolume(stagingPath, targetPath, fsType)
+		err = d.publishFileSystemVolume(stagingPath, targetPath, fsType, req.GetReadonly(), volumeCap.GetMount().GetMountFlags())
 	} else {
-		mpathDevice, err := d.OsDeviceConnectivityHelper.GetMpathDevice(volumeID)
+		mpathDevice, err := d.getStagedMpathDevice(volumeID, stagingPath)
 		if err != nil {
 			logger.Errorf("Error while discovering the device : {%v}", err.Error())
 			return nil, status.Error(codes.Internal, err.Error())
 		}
-		logger.Debugf("Discovered device : {%v}", mpathDevice)
+		logger.Debugf("Staged device : {%v}", mpathDevice)
 
-		err = d.publishRawBlockVolume(mpathDevice, targetPath)
+		err = d.publishRawBlockVolume(mpathDevice, targetPath, req.GetReadonly())
 	}
 
 	if err != nil {
@@ -460,18 +571,42 @@ func (d *NodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func (d *NodeService) publishFileSystemVolume(stagingPath string, targetPath string, fsType string) error {
-	mountOptions := []string{"bind"}
-	logger.Debugf("Bind mount staging: {%v} with target: {%v}, fs_type: {%v}", stagingPath, targetPath, fsType)
+// getBindMountOptions returns the options of the bind mount of a published volume.
+// With the ro option or the mount point flags, the mounter remounts the target right after the bind mount.
+func getBindMountOptions(isReadOnly bool, mountFlags []string) []string {
+	mountOptions := append([]string{"bind"}, getBindMountFlags(mountFlags)...)
+	if isReadOnly {
+		mountOptions = append(mountOptions, readOnlyMountOption)
+	}
+	return mountOptions
+}
+
+func (d *NodeService) publishFileSystemVolume(stagingPath string, targetPath string, fsType string, isReadOnly bool, mountFlags []string) error {
+	mountOptions := getBindMountOptions(isReadOnly, mountFlags)
+	logger.Debugf("Bind mount staging: {%v} with target: {%v}, fs_type: {%v}, options: {%v}", stagingPath, targetPath, fsType, mountOptions)
 	return d.Mounter.Mount(stagingPath, targetPath, fsType, mountOptions) // Passing without /host because k8s mounter uses mount\mkfs\fsck
 }
 
-func (d *NodeService) publishRawBlockVolume(mpathDevice string, targetPath string) error {
-	options := []string{"bind"}
-	logger.Debugf("Mount the device to raw block volume. Target : {%s}, device : {%s}", targetPath, mpathDevice)
+func (d *NodeService) publishRawBlockVolume(mpathDevice string, targetPath string, isReadOnly bool) error {
+	options := getBindMountOptions(isReadOnly, nil)
+	logger.Debugf("Mount the device to raw block volume. Target : {%s}, device : {%s}, options: {%v}", targetPath, mpathDevice, options)
 	return d.Mounter.Mount(mpathDevice, targetPath, "", options)
 }
 
+// checkTargetMountReadOnly verifies that an existing mount of the target matches the requested read only flag.
+func (d *NodeService) checkTargetMountReadOnly(targetPathWithHostPrefix string, isReadOnlyRequested bool) error {
+	isReadOnlyMounted, err := d.NodeUtils.IsMountReadOnly(targetPathWithHostPrefix)
+	if err != nil {
+		logger.Warningf("Failed to check if (%s) is mounted read only.", targetPathWithHostPrefix)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if isReadOnlyMounted != isReadOnlyRequested {
+		return status.Errorf(codes.AlreadyExists, "Required volume with readonly=%t but target {%s} is mounted with readonly=%t.",
+			isReadOnlyRequested, targetPathWithHostPrefix, isReadOnlyMounted)
+	}
+	return nil
+}
+
 // targetPathWithHostPrefix: path of target
 // isFSVolume: if we check volume with file system - true, otherwise for raw block false
 // Returns: is <target mounted, error if occured>
@@ -524,6 +659,9 @@ func (d *NodeService) nodePublishVolumeRequestValidation(req *csi.NodePublishVol
 	// If the access type is not mount and not block, should never happen
 	switch volCap.GetAccessType().(type) {
 	case *csi.VolumeCapability_Mount:
+		if err := validateMountFlags(volCap.GetMount().GetFsType(), volCap.GetMount().GetMountFlags()); err != nil {
+			return err
+		}
 	case *csi.VolumeCapability_Block:
 	default:
 		return &RequestValidationError{"Volume Access Type is not supported"}
@@ -536,7 +674,7 @@ func (d *NodeService) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	volumeID := req.GetVolumeId()
 	goid_info.SetAdditionalIDInfo(volumeID)
 	defer goid_info.DeleteAdditionalIDInfo()
-	logger.Debugf(">>>> NodeUnpublishVolume: called with args %+v", *req)
+	logger.Debugf(">>>> NodeUnpublishVolume")
 	defer logger.Debugf("<<<< NodeUnpublishVolume")
 
 	if len(volumeID) == 0 {
@@ -590,7 +728,113 @@ func (d *NodeService) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 func (d *NodeService) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 	goid_info.SetAdditionalIDInfo(req.VolumeId)
 	defer goid_info.DeleteAdditionalIDInfo()
-	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not implemented yet")
+	logger.Debugf(">>>> NodeGetVolumeStats")
+	defer logger.Debugf("<<<< NodeGetVolumeStats")
+
+	err := d.nodeGetVolumeStatsRequestValidation(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	volumePathWithHostPrefix := d.NodeUtils.GetPodPath(volumePath)
+
+	if !d.NodeUtils.IsPathExists(volumePathWithHostPrefix) {
+		return nil, status.Errorf(codes.NotFound, "Volume path {%s} does not exist", volumePath)
+	}
+
+	response := &csi.NodeGetVolumeStatsResponse{}
+	isFSVolume := d.NodeUtils.IsDirectory(volumePathWithHostPrefix)
+	if isFSVolume {
+		volumeStats, err := d.NodeUtils.GetVolumeStats(volumePathWithHostPrefix)
+		if err != nil {
+			logger.Errorf("Could not get stats of volume path {%v}, error: %v", volumePath, err)
+			if err == syscall.EIO {
+				response.VolumeCondition = &csi.VolumeCondition{
+					Abnormal: true,
+					Message:  fmt.Sprintf("I/O error on volume path %s: %v", volumePath, err),
+				}
+				return response, nil
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		response.Usage = []*csi.VolumeUsage{
+			{
+				Available: volumeStats.AvailableBytes,
+				Total:     volumeStats.TotalBytes,
+				Used:      volumeStats.UsedBytes,
+				Unit:      csi.VolumeUsage_BYTES,
+			},
+			{
+				Available: volumeStats.AvailableInodes,
+				Total:     volumeStats.TotalInodes,
+				Used:      volumeStats.UsedInodes,
+				Unit:      csi.VolumeUsage_INODES,
+			},
+		}
+	}
+
+	mpathDevice, connectivityType, err := d.getMpathDevice(volumeID)
+	if err != nil {
+		logger.Errorf("Error while discovering the device : {%v}", err.Error())
+		switch err.(type) {
+		case *device_connectivity.MultipathDeviceNotFoundForVolumeError:
+			response.VolumeCondition = &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  err.Error(),
+			}
+			return response, nil
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	logger.Debugf("Discovered device : {%v}", mpathDevice)
+
+	if !isFSVolume {
+		deviceSize, err := d.NodeUtils.GetBlockVolumeSize(mpathDevice)
+		if err != nil {
+			logger.Errorf("Could not get size of device {%v}, error: %v", mpathDevice, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		response.Usage = []*csi.VolumeUsage{
+			{
+				Total: deviceSize,
+				Unit:  csi.VolumeUsage_BYTES,
+			},
+		}
+	}
+
+	abnormal, message, err := d.getMpathDeviceHandler(connectivityType).GetMpathDeviceCondition(mpathDevice)
+	if err != nil {
+		logger.Errorf("Could not get condition of device {%v}, error: %v", mpathDevice, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if abnormal {
+		logger.Warningf("Volume %s is abnormal: %s", volumeID, message)
+	}
+	response.VolumeCondition = &csi.VolumeCondition{
+		Abnormal: abnormal,
+		Message:  message,
+	}
+
+	return response, nil
+}
+
+func (d *NodeService) nodeGetVolumeStatsRequestValidation(req *csi.NodeGetVolumeStatsRequest) error {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return &RequestValidationError{"Volume ID not provided"}
+	}
+
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return &RequestValidationError{"Volume path not provided"}
+	}
+
+	return nil
 }
 
 func (d *NodeService) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -611,31 +855,31 @@ func (d *NodeService) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 	}
 	defer d.VolumeIdLocksMap.RemoveVolumeLock(volumeID, "NodeExpandVolume")
 
-	device, err := d.OsDeviceConnectivityHelper.GetMpathDevice(volumeID)
+	stageInfo, err := d.getStagedDevices(volumeID, req.GetStagingTargetPath())
 	if err != nil {
-		logger.Errorf("Error while discovering the device : {%v}", err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	logger.Debugf("Discovered device : {%v}", device)
+	baseDevice := stageInfo.MpathDevice
+	device := path.Join(device_connectivity.DevPath, baseDevice)
+	logger.Debugf("Staged device : {%v}", device)
 
-	baseDevice := path.Base(device)
-
-	rawSysDevices, err := d.NodeUtils.GetSysDevicesFromMpath(baseDevice)
-	if err != nil {
-		logger.Errorf("Error while trying to get sys devices : {%v}", err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	sysDevices := stageInfo.SysDevices
+	isNvmeNativeDevice := device_connectivity.IsNvmeNativeDevice(baseDevice)
+	if isNvmeNativeDevice {
+		// native NVMe multipath device has no slaves, its namespace is rescanned through its controllers
+		sysDevices = []string{baseDevice}
 	}
 
-	sysDevices := strings.Split(rawSysDevices, ",")
-
 	err = d.NodeUtils.RescanPhysicalDevices(sysDevices)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	err = d.NodeUtils.ExpandMpathDevice(baseDevice)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if !isNvmeNativeDevice {
+		err = d.NodeUtils.ExpandMpathDevice(baseDevice)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
 	existingFormat, err := d.Mounter.GetDiskFormat(device)
@@ -658,6 +902,271 @@ func (d *NodeService) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
 
+// getMpathDevice returns the multipath device of the volume and the NVMe connectivity type it was found by,
+// or an empty connectivity type if it was found by the scsi generic helper.
+func (d *NodeService) getMpathDevice(volumeID string) (string, string, error) {
+	for _, connectivityType := range nvmeConnectivityTypes {
+		osDeviceConnectivity, ok := d.OsDeviceConnectivityMapping[connectivityType]
+		if !ok {
+			continue
+		}
+		mpathDevice, err := osDeviceConnectivity.GetMpathDevice(volumeID)
+		if err == nil {
+			return mpathDevice, connectivityType, nil
+		}
+		if _, ok := err.(*device_connectivity.MultipathDeviceNotFoundForVolumeError); !ok {
+			return "", "", err
+		}
+	}
+
+	mpathDevice, err := d.OsDeviceConnectivityHelper.GetMpathDevice(volumeID)
+	return mpathDevice, "", err
+}
+
+// getStageInfoPath returns the path of the stage info file of the staging path.
+// The filesystem of a mount volume is mounted on the staging path itself, so its file is kept next to the staging path,
+// while the staging path of a block volume is a directory of its own, which is shared by nothing but the volume.
+func getStageInfoPath(stagingPath string, isFSVolume bool) string {
+	stagingPath = path.Clean(stagingPath)
+	if isFSVolume {
+		return path.Join(path.Dir(stagingPath), StageInfoFilename)
+	}
+	return path.Join(stagingPath, StageInfoFilename)
+}
+
+func splitSysDevices(rawSysDevices string) []string {
+	if rawSysDevices == "" {
+		return nil
+	}
+	return strings.Split(rawSysDevices, ",")
+}
+
+func (d *NodeService) writeStageInfo(stageInfoPath string, stageInfo *StageInfo) error {
+	if err := d.NodeUtils.WriteStageInfoFile(stageInfoPath, stageInfo); err != nil {
+		logger.Errorf("Failed to write the stage info file {%v} : {%v}", stageInfoPath, err)
+		return status.Errorf(codes.Internal, "Fail to write the stage info file: error %v", err)
+	}
+	return nil
+}
+
+// getStageInfo returns the stage info of the staging path and the path of its file,
+// or nil if the volume was staged without a readable stage info file.
+func (d *NodeService) getStageInfo(stagingPath string) (*StageInfo, string) {
+	if stagingPath == "" {
+		return nil, ""
+	}
+	for _, isFSVolume := range []bool{false, true} {
+		stageInfoPath := getStageInfoPath(stagingPath, isFSVolume)
+		if !d.NodeUtils.StageInfoFileIsExist(stageInfoPath) {
+			continue
+		}
+		stageInfo, err := d.NodeUtils.ReadStageInfoFile(stageInfoPath)
+		if err != nil {
+			logger.Warningf("Failed to read the stage info file {%v}, the devices will be discovered : {%v}", stageInfoPath, err)
+			return nil, stageInfoPath
+		}
+		return stageInfo, stageInfoPath
+	}
+	return nil, ""
+}
+
+// getStagedArrayInitiators returns the array initiators of the staged volumes of the connectivity type.
+func (d *NodeService) getStagedArrayInitiators(connectivityType string) ([]string, error) {
+	stagingPaths, err := d.NodeUtils.GetStagingPaths()
+	if err != nil {
+		return nil, err
+	}
+	arrayInitiatorsSet := make(map[string]bool)
+	var arrayInitiators []string
+	for _, stagingPath := range stagingPaths {
+		stageInfo, _ := d.getStageInfo(stagingPath)
+		if stageInfo == nil || stageInfo.Connectivity != connectivityType {
+			continue
+		}
+		for _, arrayInitiator := range stageInfo.ArrayInitiators {
+			if !arrayInitiatorsSet[arrayInitiator] {
+				arrayInitiatorsSet[arrayInitiator] = true
+				arrayInitiators = append(arrayInitiators, arrayInitiator)
+			}
+		}
+	}
+	return arrayInitiators, nil
+}
+
+// discoverStageInfo builds the stage info of a volume from its discovered multipath device.
+func (d *NodeService) discoverStageInfo(volumeID string) (*StageInfo, error) {
+	mpathDevice, connectivityType, err := d.getMpathDevice(volumeID)
+	if err != nil {
+		logger.Errorf("Error while discovering the device : {%v}", err.Error())
+		return nil, err
+	}
+	logger.Debugf("Discovered device : {%v}", mpathDevice)
+
+	baseDevice := path.Base(mpathDevice)
+	rawSysDevices, err := d.NodeUtils.GetSysDevicesFromMpath(baseDevice)
+	if err != nil {
+		logger.Errorf("Error while trying to get sys devices : {%v}", err.Error())
+		return nil, err
+	}
+	return &StageInfo{
+		Connectivity: connectivityType,
+		MpathDevice:  baseDevice,
+		SysDevices:   splitSysDevices(rawSysDevices),
+	}, nil
+}
+
+// getVerifiedStageInfo returns the stage info of the staging path if its multipath device still belongs to the volume.
+func (d *NodeService) getVerifiedStageInfo(volumeID string, stagingPath string) *StageInfo {
+	stageInfo, _ := d.getStageInfo(stagingPath)
+	if stageInfo == nil {
+		return nil
+	}
+	if !d.NodeUtils.IsDeviceOfVolume(stageInfo.MpathDevice, volumeID) {
+		logger.Warningf("Staged device {%v} does not belong to the volume anymore, the device will be discovered", stageInfo.MpathDevice)
+		return nil
+	}
+	return stageInfo
+}
+
+// getStagedMpathDevice returns the multipath device of a staged volume, "/dev/dm-X" or "/dev/nvmeXnY".
+func (d *NodeService) getStagedMpathDevice(volumeID string, stagingPath string) (string, error) {
+	if stageInfo := d.getVerifiedStageInfo(volumeID, stagingPath); stageInfo != nil {
+		return path.Join(device_connectivity.DevPath, stageInfo.MpathDevice), nil
+	}
+	mpathDevice, _, err := d.getMpathDevice(volumeID)
+	return mpathDevice, err
+}
+
+// getStagedDevices returns the multipath device and the sys devices of a staged volume.
+func (d *NodeService) getStagedDevices(volumeID string, stagingPath string) (*StageInfo, error) {
+	if stageInfo := d.getVerifiedStageInfo(volumeID, stagingPath); stageInfo != nil {
+		return stageInfo, nil
+	}
+	return d.discoverStageInfo(volumeID)
+}
+
+// dropDevicesNotOfVolume drops the recorded devices which were already removed, and may have been reused by another volume.
+func (d *NodeService) dropDevicesNotOfVolume(volumeID string, stageInfo *StageInfo) {
+	if stageInfo.MpathDevice != "" && !d.NodeUtils.IsDeviceOfVolume(stageInfo.MpathDevice, volumeID) {
+		logger.Debugf("Multipath device {%v} was already removed", stageInfo.MpathDevice)
+		stageInfo.MpathDevice = ""
+	}
+	var sysDevices []string
+	for _, sysDevice := range stageInfo.SysDevices {
+		if d.NodeUtils.IsDeviceOfVolume(sysDevice, volumeID) {
+			sysDevices = append(sysDevices, sysDevice)
+		} else {
+			logger.Debugf("Device {%v} was already removed", sysDevice)
+		}
+	}
+	stageInfo.SysDevices = sysDevices
+}
+
+// deviceTargetsGetter is implemented by the connectivity types whose devices are disks of sessions to storage targets.
+type deviceTargetsGetter interface {
+	GetTargetsOfDevices(sysDevices []string) ([]string, error)
+}
+
+// resolveStagedTargets finds the connectivity and the targets of the devices of a volume which were not recorded,
+// e.g. for a volume staged by a driver version which did not write them, so the targets can be logged out.
+func (d *NodeService) resolveStagedTargets(volumeID string, stageInfo *StageInfo) {
+	if len(stageInfo.ArrayInitiators) > 0 || len(stageInfo.SysDevices) == 0 {
+		return
+	}
+	for connectivityType, osDeviceConnectivity := range d.OsDeviceConnectivityMapping {
+		if stageInfo.Connectivity != "" && stageInfo.Connectivity != connectivityType {
+			continue
+		}
+		targetsGetter, ok := osDeviceConnectivity.(deviceTargetsGetter)
+		if !ok {
+			continue
+		}
+		targets, err := targetsGetter.GetTargetsOfDevices(stageInfo.SysDevices)
+		if err != nil {
+			logger.Warningf("Failed to get the {%v} targets of devices {%v} : {%v}", connectivityType, stageInfo.SysDevices, err)
+			continue
+		}
+		if len(targets) > 0 {
+			logger.Debugf("Devices {%v} of volume {%v} are of {%v} targets {%v}", stageInfo.SysDevices, volumeID, connectivityType, targets)
+			stageInfo.Connectivity = connectivityType
+			stageInfo.ArrayInitiators = targets
+			return
+		}
+	}
+}
+
+func (d *NodeService) removeStagedDevices(volumeID string, stageInfo *StageInfo) error {
+	d.resolveStagedTargets(volumeID, stageInfo)
+	deviceHandler := d.getMpathDeviceHandler(stageInfo.Connectivity)
+	if stageInfo.MpathDevice != "" {
+		err := deviceHandler.FlushMultipathDevice(stageInfo.MpathDevice)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Multipath -f command failed with error: %v", err)
+		}
+	}
+	if len(stageInfo.SysDevices) > 0 {
+		err := deviceHandler.RemovePhysicalDevice(stageInfo.SysDevices)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Remove scsi device failed with error: %v", err)
+		}
+	}
+	osDeviceConnectivity, ok := d.OsDeviceConnectivityMapping[stageInfo.Connectivity]
+	if !ok || len(stageInfo.ArrayInitiators) == 0 {
+		logger.Infof("The storage targets of volume {%v} are not known, skipping their logout", volumeID)
+		return nil
+	}
+	unlockTargets := d.TargetLocks.Lock(stageInfo.ArrayInitiators, "NodeUnstageVolume")
+	defer unlockTargets()
+	if err := osDeviceConnectivity.EnsureLogout(volumeID, stageInfo.ArrayInitiators); err != nil {
+		logger.Warningf("Failed to disconnect from the storage after the device was removed : {%v}", err)
+	}
+	return nil
+}
+
+// ensureLogin logs in to the portals of the storage, and fails unless the minimum number of portals is logged in.
+func (d *NodeService) ensureLogin(ctx context.Context, osDeviceConnectivity device_connectivity.OsDeviceConnectivityInterface,
+	ipsByArrayInitiator map[string][]string, secrets map[string]string, volumeContext map[string]string) error {
+	results, err := osDeviceConnectivity.EnsureLogin(ctx, ipsByArrayInitiator, secrets, volumeContext)
+	if err != nil {
+		return err
+	}
+	var failedPortals []device_connectivity.PortalLoginResult
+	for _, result := range results {
+		if result.Err != nil {
+			failedPortals = append(failedPortals, result)
+		}
+	}
+	if len(failedPortals) == 0 {
+		return nil
+	}
+
+	loggedInPortals := len(results) - len(failedPortals)
+	minLoggedInPortals := d.MinLoggedInPortals
+	if minLoggedInPortals < 1 {
+		minLoggedInPortals = 1
+	}
+	if minLoggedInPortals > len(results) {
+		minLoggedInPortals = len(results)
+	}
+	if loggedInPortals < minLoggedInPortals {
+		return &PortalsLoginError{
+			FailedPortals:      failedPortals,
+			LoggedInPortals:    loggedInPortals,
+			MinLoggedInPortals: minLoggedInPortals,
+		}
+	}
+	logger.Warningf("Continuing in degraded mode, %d of %d portals are logged in. Failed portals : {%s}",
+		loggedInPortals, len(results), formatFailedPortals(failedPortals))
+	return nil
+}
+
+func (d *NodeService) getMpathDeviceHandler(connectivityType string) mpathDeviceHandler {
+	if osDeviceConnectivity, ok := d.OsDeviceConnectivityMapping[connectivityType]; ok {
+		return osDeviceConnectivity
+	}
+	return d.OsDeviceConnectivityHelper
+}
+
 func (d *NodeService) nodeExpandVolumeRequestValidation(req *csi.NodeExpandVolumeRequest) error {
 	volumeID := req.GetVolumeId()
 	if volumeID == "" {
@@ -681,7 +1190,7 @@ func (d *NodeService) nodeExpandVolumeRequestValidation(req *csi.NodeExpandVolum
 }
 
 func (d *NodeService) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	logger.Debugf(">>>> NodeGetCapabilities: called with args %+v", *req)
+	logger.Debugf(">>>> NodeGetCapabilities")
 	defer logger.Debugf("<<<< NodeGetCapabilities")
 
 	var caps []*csi.NodeServiceCapability
@@ -699,10 +1208,11 @@ func (d *NodeService) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 }
 
 func (d *NodeService) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	logger.Debugf(">>>> NodeGetInfo: called with args %+v", *req)
+	logger.Debugf(">>>> NodeGetInfo")
 	defer logger.Debugf("<<<< NodeGetInfo")
 
 	var iscsiIQN string
+	var nvmeNQN string
 	var fcWWNs []string
 	var err error
 
@@ -725,12 +1235,17 @@ func (d *NodeService) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 		iscsiIQN, _ = d.NodeUtils.ParseIscsiInitiators()
 	}
 
-	if fcWWNs == nil && iscsiIQN == "" {
-		err := fmt.Errorf("Cannot find valid fc wwns or iscsi iqn")
+	nvmeExists := d.NodeUtils.IsPathExists(NvmeHostNqnFullPath)
+	if nvmeExists {
+		nvmeNQN, _ = d.NodeUtils.ParseNvmeHostNqn()
+	}
+
+	if fcWWNs == nil && iscsiIQN == "" && nvmeNQN == "" {
+		err := fmt.Errorf("Cannot find valid fc wwns, iscsi iqn or nvme nqn")
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	nodeId, err := d.NodeUtils.GenerateNodeID(d.Hostname, fcWWNs, iscsiIQN)
+	nodeId, err := d.NodeUtils.GenerateNodeID(d.Hostname, fcWWNs, iscsiIQN, nvmeNQN)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
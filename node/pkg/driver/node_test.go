@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -47,6 +48,7 @@ func newTestNodeService(nodeUtils driver.NodeUtilsInterface, osDevCon device_con
 		Hostname:                   "test-host",
 		ConfigYaml:                 driver.ConfigFile{},
 		VolumeIdLocksMap:           driver.NewSyncLock(),
+		TargetLocks:                driver.NewTargetLocks(),
 		NodeUtils:                  nodeUtils,
 		Mounter:                    nodeMounter,
 		OsDeviceConnectivityHelper: osDevCon,
@@ -64,12 +66,33 @@ func newTestNodeServiceStaging(nodeUtils driver.NodeUtilsInterface, osDevCon dev
 		Hostname:                    "test-host",
 		ConfigYaml:                  driver.ConfigFile{},
 		VolumeIdLocksMap:            driver.NewSyncLock(),
+		TargetLocks:                 driver.NewTargetLocks(),
 		NodeUtils:                   nodeUtils,
 		OsDeviceConnectivityMapping: osDeviceConnectivityMapping,
 		OsDeviceConnectivityHelper:  osDevCon,
 	}
 }
 
+// targetsOsDeviceConnectivity adds the optional GetTargetsOfDevices of the connectivity types to the connectivity mock
+type targetsOsDeviceConnectivity struct {
+	*mocks.MockOsDeviceConnectivityInterface
+	targets []string
+}
+
+func (d targetsOsDeviceConnectivity) GetTargetsOfDevices(_ []string) ([]string, error) {
+	return d.targets, nil
+}
+
+// diagnoserOsDeviceConnectivity adds the optional GetDiagnostics of the connectivity types to the connectivity mock
+type diagnoserOsDeviceConnectivity struct {
+	*mocks.MockOsDeviceConnectivityInterface
+	summary string
+}
+
+func (d diagnoserOsDeviceConnectivity) GetDiagnostics(_ []string) (string, error) {
+	return d.summary, nil
+}
+
 func TestNodeStageVolume(t *testing.T) {
 	dummyError := errors.New("Dummy error")
 	conType := device_connectivity.ConnectionTypeISCSI
@@ -82,6 +105,20 @@ func TestNodeStageVolume(t *testing.T) {
 	arrayInitiators := []string{"iqn.1994-05.com.redhat:686358c930fe"}
 	stagingPath := "/test/path"
 	stagingPathWithHostPrefix := GetPodPath(stagingPath)
+	stageInfoPath := path.Join("/test", driver.StageInfoFilename)
+	newStageInfo := func(fsType string) *driver.StageInfo {
+		return &driver.StageInfo{
+			VolumeId:        volId,
+			Connectivity:    conType,
+			Lun:             lun,
+			ArrayInitiators: arrayInitiators,
+			MpathDevice:     mpathDeviceName,
+			SysDevices:      []string{"sdb", "sdc"},
+			FsType:          fsType,
+			AccessType:      "mount",
+		}
+	}
+	rawSysDevices := "sdb,sdc"
 	var mountOptions []string
 
 	stdVolCap := &csi.VolumeCapability{
@@ -180,6 +217,218 @@ func TestNodeStageVolume(t *testing.T) {
 				assertError(t, err, codes.InvalidArgument)
 			},
 		},
+		{
+			name: "fail invalid mount flag",
+			testFunc: func(t *testing.T) {
+				req := &csi.NodeStageVolumeRequest{
+					PublishContext:    publishContext,
+					StagingTargetPath: stagingPath,
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{FsType: fsType, MountFlags: []string{"noatime", "logbsize=256k"}},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+					VolumeId: volId,
+				}
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, nil, nil)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+
+				_, err := node.NodeStageVolume(context.TODO(), req)
+				assertError(t, err, codes.InvalidArgument)
+			},
+		},
+		{
+			name: "fail mount flag does not fit the existing filesystem",
+			testFunc: func(t *testing.T) {
+				req := &csi.NodeStageVolumeRequest{
+					PublishContext:    publishContext,
+					StagingTargetPath: stagingPath,
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"data=ordered"}},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+					VolumeId: volId,
+				}
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetInfoFromPublishContext(req.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
+				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
+				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
+				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return("xfs", nil)
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
+
+				_, err := node.NodeStageVolume(context.TODO(), req)
+				assertError(t, err, codes.InvalidArgument)
+			},
+		},
+		{
+			name: "fail invalid iSCSI portal in publish context",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, nil, nil)
+				wrongIpsByArrayInitiator := map[string][]string{"iqn.1994-05.com.redhat:686358c930fe": {"1.2.3.4:port"}}
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetInfoFromPublishContext(publishContext, node.ConfigYaml).Return(conType, lun, wrongIpsByArrayInitiator, nil)
+
+				_, err := node.NodeStageVolume(context.TODO(), stagingRequest)
+				assertError(t, err, codes.InvalidArgument)
+			},
+		},
+		{
+			name: "fail invalid iSCSI CHAP credentials in secrets",
+			testFunc: func(t *testing.T) {
+				secrets := map[string]string{device_connectivity.IscsiChapUsernameSecretKey: "initiator-user"}
+				req := &csi.NodeStageVolumeRequest{
+					PublishContext:    publishContext,
+					StagingTargetPath: stagingPath,
+					VolumeCapability:  stdVolCap,
+					VolumeId:          volId,
+					Secrets:           secrets,
+				}
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, nil)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetInfoFromPublishContext(req.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
+				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, secrets, nil).Return(nil,
+					&device_connectivity.IscsiChapCredentialsError{Message: "both CHAP username and password are required"})
+
+				_, err := node.NodeStageVolume(context.TODO(), req)
+				assertError(t, err, codes.InvalidArgument)
+			},
+		},
+		{
+			name: "fail invalid iSCSI discovery in volume context",
+			testFunc: func(t *testing.T) {
+				volumeContext := map[string]string{device_connectivity.IscsiDiscoveryVolumeContextKey: "isns"}
+				req := &csi.NodeStageVolumeRequest{
+					PublishContext:    publishContext,
+					StagingTargetPath: stagingPath,
+					VolumeCapability:  stdVolCap,
+					VolumeId:          volId,
+					VolumeContext:     volumeContext,
+				}
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, nil)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetInfoFromPublishContext(req.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
+				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, volumeContext).Return(nil,
+					&device_connectivity.IscsiDiscoveryError{Discovery: "isns"})
+
+				_, err := node.NodeStageVolume(context.TODO(), req)
+				assertError(t, err, codes.InvalidArgument)
+			},
+		},
+		{
+			name: "fail invalid iSCSI transport in volume context",
+			testFunc: func(t *testing.T) {
+				volumeContext := map[string]string{device_connectivity.IscsiTransportVolumeContextKey: "fcoe"}
+				req := &csi.NodeStageVolumeRequest{
+					PublishContext:    publishContext,
+					StagingTargetPath: stagingPath,
+					VolumeCapability:  stdVolCap,
+					VolumeId:          volId,
+					VolumeContext:     volumeContext,
+				}
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, nil)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetInfoFromPublishContext(req.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
+				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, volumeContext).Return(nil,
+					&device_connectivity.IscsiTransportError{Transport: "fcoe"})
+
+				_, err := node.NodeStageVolume(context.TODO(), req)
+				assertError(t, err, codes.InvalidArgument)
+			},
+		},
+		{
+			name: "success new filesystem with mount flags",
+			testFunc: func(t *testing.T) {
+				req := &csi.NodeStageVolumeRequest{
+					PublishContext:    publishContext,
+					StagingTargetPath: stagingPath,
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs", MountFlags: []string{"noatime", "discard", "logbsize=256k"}},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+					VolumeId: volId,
+				}
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetInfoFromPublishContext(req.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
+				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
+				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
+				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return("", nil)
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
+				mockNodeUtils.EXPECT().FormatDevice(mpathDevice, "xfs")
+				mockMounter.EXPECT().FormatAndMount(mpathDevice, stagingPath, "xfs", []string{"nouuid", "noatime", "discard", "logbsize=256k"})
+				mockNodeUtils.EXPECT().WriteStageInfoFile(stageInfoPath, newStageInfo("xfs")).Return(nil)
+
+				_, err := node.NodeStageVolume(context.TODO(), req)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
 		{
 			name: "fail invalid arrayInitiators",
 			testFunc: func(t *testing.T) {
@@ -234,17 +483,20 @@ func TestNodeStageVolume(t *testing.T) {
 				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
 				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
 				mockMounter := mocks.NewMockNodeMounter(mockCtl)
-				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, mockMounter)
+				node := newTestNodeServiceStaging(mockNodeUtils, diagnoserOsDeviceConnectivity{mockOsDeviceCon, "FC array ports: 500507680b26c0aa NotVisible"}, mockMounter)
 
 				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
 				mockNodeUtils.EXPECT().GetInfoFromPublishContext(stagingRequest.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
 				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
-				mockOsDeviceCon.EXPECT().EnsureLogin(ipsByArrayInitiator)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
 				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(dummyError)
 
 				_, err := node.NodeStageVolume(context.TODO(), stagingRequest)
 				assertError(t, err, codes.Internal)
+				if !strings.Contains(err.Error(), "FC array ports: 500507680b26c0aa NotVisible") {
+					t.Fatalf("Expected the diagnostics summary in the error, got %v", err)
+				}
 			},
 		},
 		{
@@ -261,7 +513,7 @@ func TestNodeStageVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
 				mockNodeUtils.EXPECT().GetInfoFromPublishContext(stagingRequest.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
 				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
-				mockOsDeviceCon.EXPECT().EnsureLogin(ipsByArrayInitiator)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
 				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return("", dummyError)
 
@@ -283,9 +535,10 @@ func TestNodeStageVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
 				mockNodeUtils.EXPECT().GetInfoFromPublishContext(stagingRequest.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
 				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
-				mockOsDeviceCon.EXPECT().EnsureLogin(ipsByArrayInitiator)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
 				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return("", dummyError)
 
 				_, err := node.NodeStageVolume(context.TODO(), stagingRequest)
@@ -306,14 +559,16 @@ func TestNodeStageVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
 				mockNodeUtils.EXPECT().GetInfoFromPublishContext(stagingRequest.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
 				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
-				mockOsDeviceCon.EXPECT().EnsureLogin(ipsByArrayInitiator)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
 				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return("", nil)
 				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
 				mockNodeUtils.EXPECT().FormatDevice(mpathDevice, fsType)
 				mockMounter.EXPECT().FormatAndMount(mpathDevice, stagingPath, fsType, mountOptions)
+				mockNodeUtils.EXPECT().WriteStageInfoFile(stageInfoPath, newStageInfo(fsType)).Return(nil)
 
 				_, err := node.NodeStageVolume(context.TODO(), stagingRequest)
 				if err != nil {
@@ -335,13 +590,15 @@ func TestNodeStageVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
 				mockNodeUtils.EXPECT().GetInfoFromPublishContext(stagingRequest.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
 				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
-				mockOsDeviceCon.EXPECT().EnsureLogin(ipsByArrayInitiator)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
 				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return(fsType, nil)
 				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
 				mockMounter.EXPECT().FormatAndMount(mpathDevice, stagingPath, fsType, mountOptions)
+				mockNodeUtils.EXPECT().WriteStageInfoFile(stageInfoPath, newStageInfo(fsType)).Return(nil)
 
 				_, err := node.NodeStageVolume(context.TODO(), stagingRequest)
 				if err != nil {
@@ -363,13 +620,15 @@ func TestNodeStageVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
 				mockNodeUtils.EXPECT().GetInfoFromPublishContext(stagingRequest.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
 				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
-				mockOsDeviceCon.EXPECT().EnsureLogin(ipsByArrayInitiator)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
 				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return(fsType, nil)
 				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(false, nil)
 				mockNodeUtils.EXPECT().IsDirectory(stagingPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().WriteStageInfoFile(stageInfoPath, newStageInfo(fsType)).Return(nil)
 
 				_, err := node.NodeStageVolume(context.TODO(), stagingRequest)
 				if err != nil {
@@ -377,6 +636,76 @@ func TestNodeStageVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "success block volume",
+			testFunc: func(t *testing.T) {
+				req := &csi.NodeStageVolumeRequest{
+					PublishContext:    publishContext,
+					StagingTargetPath: stagingPath,
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Block{
+							Block: &csi.VolumeCapability_BlockVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+					VolumeId: volId,
+				}
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, mockMounter)
+
+				stageInfo := newStageInfo("")
+				stageInfo.AccessType = "block"
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetInfoFromPublishContext(req.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
+				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
+				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
+				mockNodeUtils.EXPECT().WriteStageInfoFile(path.Join(stagingPath, driver.StageInfoFilename), stageInfo).Return(nil)
+
+				_, err := node.NodeStageVolume(context.TODO(), req)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "fail write stage info file",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetInfoFromPublishContext(stagingRequest.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
+				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
+				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
+				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return(fsType, nil)
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
+				mockMounter.EXPECT().FormatAndMount(mpathDevice, stagingPath, fsType, mountOptions)
+				mockNodeUtils.EXPECT().WriteStageInfoFile(stageInfoPath, newStageInfo(fsType)).Return(dummyError)
+
+				_, err := node.NodeStageVolume(context.TODO(), stagingRequest)
+				assertError(t, err, codes.Internal)
+			},
+		},
 		{
 			name: "fail existing fsType different from requested",
 			testFunc: func(t *testing.T) {
@@ -391,9 +720,10 @@ func TestNodeStageVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
 				mockNodeUtils.EXPECT().GetInfoFromPublishContext(stagingRequest.PublishContext, node.ConfigYaml).Return(conType, lun, ipsByArrayInitiator, nil).AnyTimes()
 				mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
-				mockOsDeviceCon.EXPECT().EnsureLogin(ipsByArrayInitiator)
+				mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(nil, nil)
 				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(nil)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return("different-fsType", nil)
 
 				_, err := node.NodeStageVolume(context.TODO(), stagingRequest)
@@ -406,6 +736,84 @@ func TestNodeStageVolume(t *testing.T) {
 	}
 }
 
+func TestNodeStageVolumeLoginResults(t *testing.T) {
+	volId := "vol-test"
+	lun := 10
+	targetIqn := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	ipsByArrayInitiator := map[string][]string{targetIqn: {"1.1.1.1", "2.2.2.2"}}
+	arrayInitiators := []string{targetIqn}
+	stagingPath := "/test/path"
+	stagingPathWithHostPrefix := GetPodPath(stagingPath)
+	publishContext := map[string]string{
+		PublishContextParamLun:          "10",
+		PublishContextParamConnectivity: device_connectivity.ConnectionTypeISCSI,
+		PublishContextParamArrayIqn:     targetIqn,
+		targetIqn:                       "1.1.1.1,2.2.2.2",
+	}
+	stagingRequest := &csi.NodeStageVolumeRequest{
+		PublishContext:    publishContext,
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeId: volId,
+	}
+	loggedIn := device_connectivity.PortalLoginResult{ArrayIdentifier: targetIqn, Portal: "1.1.1.1:3260"}
+	failed := device_connectivity.PortalLoginResult{ArrayIdentifier: targetIqn, Portal: "2.2.2.2:3260", Err: errors.New("Dummy error")}
+
+	testCases := []struct {
+		name               string
+		minLoggedInPortals int
+		results            []device_connectivity.PortalLoginResult
+		expRescan          bool
+	}{
+		{
+			name:      "success all portals are logged in",
+			results:   []device_connectivity.PortalLoginResult{loggedIn, loggedIn},
+			expRescan: true,
+		},
+		{
+			name:      "success degraded when the minimum number of portals is logged in",
+			results:   []device_connectivity.PortalLoginResult{loggedIn, failed},
+			expRescan: true,
+		},
+		{
+			name:               "fail when fewer portals than the minimum are logged in",
+			minLoggedInPortals: 2,
+			results:            []device_connectivity.PortalLoginResult{loggedIn, failed},
+		},
+		{
+			name:    "fail when no portal is logged in",
+			results: []device_connectivity.PortalLoginResult{failed, failed},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+			mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+			node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, nil)
+			node.MinLoggedInPortals = tc.minLoggedInPortals
+
+			mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+			mockNodeUtils.EXPECT().IsPathExists(stagingPathWithHostPrefix).Return(true)
+			mockNodeUtils.EXPECT().GetInfoFromPublishContext(publishContext, node.ConfigYaml).Return(device_connectivity.ConnectionTypeISCSI, lun, ipsByArrayInitiator, nil).AnyTimes()
+			mockNodeUtils.EXPECT().GetArrayInitiators(ipsByArrayInitiator).Return(arrayInitiators)
+			mockOsDeviceCon.EXPECT().EnsureLogin(gomock.Any(), ipsByArrayInitiator, nil, nil).Return(tc.results, nil)
+			if tc.expRescan {
+				// the stage is stopped right after the login phase
+				mockOsDeviceCon.EXPECT().RescanDevices(lun, arrayInitiators).Return(errors.New("Dummy error"))
+			}
+
+			_, err := node.NodeStageVolume(context.TODO(), stagingRequest)
+			assertError(t, err, codes.Internal)
+		})
+	}
+}
+
 func TestNodeUnstageVolume(t *testing.T) {
 	volId := "vol-test"
 	dummyError := errors.New("Dummy error")
@@ -414,7 +822,19 @@ func TestNodeUnstageVolume(t *testing.T) {
 	rawSysDevices := "/dev/d1,/dev/d2"
 	sysDevices := strings.Split(rawSysDevices, ",")
 	stagingPath := "/test/path"
-	stageInfoPath := path.Join(stagingPath, driver.StageInfoFilename)
+	blockStageInfoPath := path.Join(stagingPath, driver.StageInfoFilename)
+	stageInfoPath := path.Join("/test", driver.StageInfoFilename)
+	arrayInitiators := []string{"iqn.1986-03.com.ibm:2145.v7k1.node1"}
+	newStageInfo := func() *driver.StageInfo {
+		return &driver.StageInfo{
+			Connectivity:    device_connectivity.ConnectionTypeISCSI,
+			ArrayInitiators: arrayInitiators,
+			MpathDevice:     mpathDeviceName,
+			SysDevices:      []string{"sdb", "sdc"},
+			FsType:          "ext4",
+			AccessType:      "mount",
+		}
+	}
 	stagingPathWithHostPrefix := GetPodPath(stagingPath)
 
 	unstageRequest := &csi.NodeUnstageVolumeRequest{
@@ -459,6 +879,8 @@ func TestNodeUnstageVolume(t *testing.T) {
 
 				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(stageInfoPath).Return(false)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return("", dummyError)
 
 				_, err := node.NodeUnstageVolume(context.TODO(), unstageRequest)
@@ -477,6 +899,8 @@ func TestNodeUnstageVolume(t *testing.T) {
 
 				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(stageInfoPath).Return(false)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDeviceName, nil)
 				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockOsDeviceCon.EXPECT().FlushMultipathDevice(mpathDeviceName).Return(dummyError)
@@ -497,6 +921,8 @@ func TestNodeUnstageVolume(t *testing.T) {
 
 				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(stageInfoPath).Return(false)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return("", dmNotFoundError)
 
 				_, err := node.NodeUnstageVolume(context.TODO(), unstageRequest)
@@ -518,11 +944,95 @@ func TestNodeUnstageVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(false, nil)
 				mockMounter.EXPECT().Unmount(stagingPath).Return(nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(stageInfoPath).Return(false)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDeviceName, nil)
 				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockOsDeviceCon.EXPECT().FlushMultipathDevice(mpathDeviceName).Return(nil)
 				mockOsDeviceCon.EXPECT().RemovePhysicalDevice(sysDevices).Return(nil)
+
+				_, err := node.NodeUnstageVolume(context.TODO(), unstageRequest)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "success normal logs out of the targets of the discovered devices",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, targetsOsDeviceConnectivity{mockOsDeviceCon, arrayInitiators}, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(stageInfoPath).Return(false)
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDeviceName, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
+				mockOsDeviceCon.EXPECT().FlushMultipathDevice(mpathDeviceName).Return(nil)
+				mockOsDeviceCon.EXPECT().RemovePhysicalDevice(sysDevices).Return(nil)
+				mockOsDeviceCon.EXPECT().EnsureLogout(volId, arrayInitiators).Return(nil)
+
+				_, err := node.NodeUnstageVolume(context.TODO(), unstageRequest)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "success with stage info file",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(false, nil)
+				mockMounter.EXPECT().Unmount(stagingPath).Return(nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
 				mockNodeUtils.EXPECT().StageInfoFileIsExist(stageInfoPath).Return(true)
+				mockNodeUtils.EXPECT().ReadStageInfoFile(stageInfoPath).Return(newStageInfo(), nil)
+				mockNodeUtils.EXPECT().IsDeviceOfVolume(mpathDeviceName, volId).Return(true)
+				mockNodeUtils.EXPECT().IsDeviceOfVolume("sdb", volId).Return(true)
+				mockNodeUtils.EXPECT().IsDeviceOfVolume("sdc", volId).Return(true)
+				mockOsDeviceCon.EXPECT().FlushMultipathDevice(mpathDeviceName).Return(nil)
+				mockOsDeviceCon.EXPECT().RemovePhysicalDevice([]string{"sdb", "sdc"}).Return(nil)
+				mockOsDeviceCon.EXPECT().EnsureLogout(volId, arrayInitiators).Return(nil)
+				mockNodeUtils.EXPECT().ClearStageInfoFile(stageInfoPath).Return(nil)
+
+				_, err := node.NodeUnstageVolume(context.TODO(), unstageRequest)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "success with stage info file after the multipath device was removed",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(true, nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(stageInfoPath).Return(true)
+				mockNodeUtils.EXPECT().ReadStageInfoFile(stageInfoPath).Return(newStageInfo(), nil)
+				mockNodeUtils.EXPECT().IsDeviceOfVolume(mpathDeviceName, volId).Return(false)
+				mockNodeUtils.EXPECT().IsDeviceOfVolume("sdb", volId).Return(true)
+				mockNodeUtils.EXPECT().IsDeviceOfVolume("sdc", volId).Return(false)
+				mockOsDeviceCon.EXPECT().RemovePhysicalDevice([]string{"sdb"}).Return(nil)
+				mockOsDeviceCon.EXPECT().EnsureLogout(volId, arrayInitiators).Return(nil)
 				mockNodeUtils.EXPECT().ClearStageInfoFile(stageInfoPath).Return(nil)
 
 				_, err := node.NodeUnstageVolume(context.TODO(), unstageRequest)
@@ -542,7 +1052,9 @@ func TestNodePublishVolume(t *testing.T) {
 	fsTypeXfs := "ext4"
 	targetPath := "/test/path"
 	targetPathWithHostPrefix := GetPodPath(targetPath)
-	stagingTargetPath := path.Join("/test/staging", driver.StageInfoFilename)
+	stagingTargetPath := "/test/staging"
+	blockStageInfoPath := path.Join(stagingTargetPath, driver.StageInfoFilename)
+	fsStageInfoPath := path.Join("/test", driver.StageInfoFilename)
 	deviceName := "fakedev"
 	mpathDevice := filepath.Join(device_connectivity.DevPath, deviceName)
 	accessMode := &csi.VolumeCapability_AccessMode{
@@ -657,7 +1169,92 @@ func TestNodePublishVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix).AnyTimes()
 				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(true)
 				mockNodeUtils.EXPECT().IsNotMountPoint(targetPathWithHostPrefix).Return(false, nil)
-				mockNodeUtils.EXPECT().IsDirectory(targetPathWithHostPrefix).Return(false)
+				mockNodeUtils.EXPECT().IsDirectory(targetPathWithHostPrefix).Return(false)
+
+				req := &csi.NodePublishVolumeRequest{
+					PublishContext:    map[string]string{},
+					StagingTargetPath: stagingTargetPath,
+					TargetPath:        targetPath,
+					VolumeCapability:  fsVolCap,
+					VolumeId:          volumeId,
+				}
+
+				_, err := node.NodePublishVolume(context.TODO(), req)
+				assertError(t, err, codes.AlreadyExists)
+			},
+		},
+		{
+			name: "success with filesystem volume",
+			testFunc: func(t *testing.T) {
+				mountOptions := []string{"bind"}
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, nil, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix).AnyTimes()
+				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(false)
+				mockNodeUtils.EXPECT().MakeDir(targetPathWithHostPrefix).Return(nil)
+				mockMounter.EXPECT().Mount(stagingTargetPath, targetPath, fsTypeXfs, mountOptions)
+
+				req := &csi.NodePublishVolumeRequest{
+					PublishContext:    map[string]string{},
+					StagingTargetPath: stagingTargetPath,
+					TargetPath:        targetPath,
+					VolumeCapability:  fsVolCap,
+					VolumeId:          volumeId,
+				}
+
+				_, err := node.NodePublishVolume(context.TODO(), req)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "success idempotent with filesystem volume",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, nil, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix).AnyTimes()
+				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsNotMountPoint(targetPathWithHostPrefix).Return(false, nil)
+				mockNodeUtils.EXPECT().IsDirectory(targetPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsMountReadOnly(targetPathWithHostPrefix).Return(false, nil)
+
+				req := &csi.NodePublishVolumeRequest{
+					PublishContext:    map[string]string{},
+					StagingTargetPath: stagingTargetPath,
+					TargetPath:        targetPath,
+					VolumeCapability:  fsVolCap,
+					VolumeId:          volumeId,
+				}
+
+				_, err := node.NodePublishVolume(context.TODO(), req)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "fail idempotent with filesystem volume mounted read write while read only is requested",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, nil, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix).AnyTimes()
+				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsNotMountPoint(targetPathWithHostPrefix).Return(false, nil)
+				mockNodeUtils.EXPECT().IsDirectory(targetPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsMountReadOnly(targetPathWithHostPrefix).Return(false, nil)
 
 				req := &csi.NodePublishVolumeRequest{
 					PublishContext:    map[string]string{},
@@ -665,6 +1262,7 @@ func TestNodePublishVolume(t *testing.T) {
 					TargetPath:        targetPath,
 					VolumeCapability:  fsVolCap,
 					VolumeId:          volumeId,
+					Readonly:          true,
 				}
 
 				_, err := node.NodePublishVolume(context.TODO(), req)
@@ -672,9 +1270,8 @@ func TestNodePublishVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "success with filesystem volume",
+			name: "success with read only filesystem volume",
 			testFunc: func(t *testing.T) {
-				mountOptions := []string{"bind"}
 				mockCtl := gomock.NewController(t)
 				defer mockCtl.Finish()
 				mockMounter := mocks.NewMockNodeMounter(mockCtl)
@@ -684,7 +1281,7 @@ func TestNodePublishVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix).AnyTimes()
 				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(false)
 				mockNodeUtils.EXPECT().MakeDir(targetPathWithHostPrefix).Return(nil)
-				mockMounter.EXPECT().Mount(stagingTargetPath, targetPath, fsTypeXfs, mountOptions)
+				mockMounter.EXPECT().Mount(stagingTargetPath, targetPath, fsTypeXfs, []string{"bind", "ro"})
 
 				req := &csi.NodePublishVolumeRequest{
 					PublishContext:    map[string]string{},
@@ -692,6 +1289,7 @@ func TestNodePublishVolume(t *testing.T) {
 					TargetPath:        targetPath,
 					VolumeCapability:  fsVolCap,
 					VolumeId:          volumeId,
+					Readonly:          true,
 				}
 
 				_, err := node.NodePublishVolume(context.TODO(), req)
@@ -701,7 +1299,39 @@ func TestNodePublishVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "success idempotent with filesystem volume",
+			name: "success with raw block volume",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, mockOsDeviceCon, mockMounter)
+
+				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(false)
+				mockNodeUtils.EXPECT().MakeFile(gomock.Eq(targetPathWithHostPrefix)).Return(nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volumeId).Return(mpathDevice, nil)
+				mockMounter.EXPECT().Mount(mpathDevice, targetPath, "", []string{"bind"})
+
+				req := &csi.NodePublishVolumeRequest{
+					PublishContext:    map[string]string{},
+					StagingTargetPath: stagingTargetPath,
+					TargetPath:        targetPath,
+					VolumeCapability:  rawBlockVolumeCap,
+					VolumeId:          "vol-test",
+				}
+
+				_, err := node.NodePublishVolume(context.TODO(), req)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "success with filesystem volume mount flags",
 			testFunc: func(t *testing.T) {
 				mockCtl := gomock.NewController(t)
 				defer mockCtl.Finish()
@@ -710,16 +1340,21 @@ func TestNodePublishVolume(t *testing.T) {
 				node := newTestNodeService(mockNodeUtils, nil, mockMounter)
 
 				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix).AnyTimes()
-				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(true)
-				mockNodeUtils.EXPECT().IsNotMountPoint(targetPathWithHostPrefix).Return(false, nil)
-				mockNodeUtils.EXPECT().IsDirectory(targetPathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(false)
+				mockNodeUtils.EXPECT().MakeDir(targetPathWithHostPrefix).Return(nil)
+				mockMounter.EXPECT().Mount(stagingTargetPath, targetPath, fsTypeXfs, []string{"bind", "noatime", "nosuid"})
 
 				req := &csi.NodePublishVolumeRequest{
 					PublishContext:    map[string]string{},
 					StagingTargetPath: stagingTargetPath,
 					TargetPath:        targetPath,
-					VolumeCapability:  fsVolCap,
-					VolumeId:          volumeId,
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{FsType: fsTypeXfs, MountFlags: []string{"noatime", "data=ordered", "nosuid"}},
+						},
+						AccessMode: accessMode,
+					},
+					VolumeId: volumeId,
 				}
 
 				_, err := node.NodePublishVolume(context.TODO(), req)
@@ -729,7 +1364,7 @@ func TestNodePublishVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "success with raw block volume",
+			name: "success with read only raw block volume",
 			testFunc: func(t *testing.T) {
 				mockCtl := gomock.NewController(t)
 				defer mockCtl.Finish()
@@ -741,8 +1376,10 @@ func TestNodePublishVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(false)
 				mockNodeUtils.EXPECT().MakeFile(gomock.Eq(targetPathWithHostPrefix)).Return(nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volumeId).Return(mpathDevice, nil)
-				mockMounter.EXPECT().Mount(mpathDevice, targetPath, "", []string{"bind"})
+				mockMounter.EXPECT().Mount(mpathDevice, targetPath, "", []string{"bind", "ro"})
 
 				req := &csi.NodePublishVolumeRequest{
 					PublishContext:    map[string]string{},
@@ -750,6 +1387,7 @@ func TestNodePublishVolume(t *testing.T) {
 					TargetPath:        targetPath,
 					VolumeCapability:  rawBlockVolumeCap,
 					VolumeId:          "vol-test",
+					Readonly:          true,
 				}
 
 				_, err := node.NodePublishVolume(context.TODO(), req)
@@ -771,6 +1409,8 @@ func TestNodePublishVolume(t *testing.T) {
 				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix)
 				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(true)
 				mockNodeUtils.EXPECT().IsNotMountPoint(targetPathWithHostPrefix).Return(true, nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
 				mockOsDeviceCon.EXPECT().GetMpathDevice(volumeId).Return(mpathDevice, nil)
 				mockMounter.EXPECT().Mount(mpathDevice, targetPath, "", []string{"bind"})
 
@@ -782,6 +1422,39 @@ func TestNodePublishVolume(t *testing.T) {
 					VolumeId:          "vol-test",
 				}
 
+				_, err := node.NodePublishVolume(context.TODO(), req)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "success with raw block volume with stage info file",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, mockOsDeviceCon, mockMounter)
+
+				stageInfo := &driver.StageInfo{MpathDevice: deviceName, AccessType: "block"}
+				mockNodeUtils.EXPECT().GetPodPath(targetPath).Return(targetPathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(targetPathWithHostPrefix).Return(false)
+				mockNodeUtils.EXPECT().MakeFile(gomock.Eq(targetPathWithHostPrefix)).Return(nil)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(true)
+				mockNodeUtils.EXPECT().ReadStageInfoFile(blockStageInfoPath).Return(stageInfo, nil)
+				mockNodeUtils.EXPECT().IsDeviceOfVolume(deviceName, volumeId).Return(true)
+				mockMounter.EXPECT().Mount(mpathDevice, targetPath, "", []string{"bind"})
+
+				req := &csi.NodePublishVolumeRequest{
+					PublishContext:    map[string]string{},
+					StagingTargetPath: stagingTargetPath,
+					TargetPath:        targetPath,
+					VolumeCapability:  rawBlockVolumeCap,
+					VolumeId:          volumeId,
+				}
+
 				_, err := node.NodePublishVolume(context.TODO(), req)
 				if err != nil {
 					t.Fatalf("Expect no error but got: %v", err)
@@ -878,23 +1551,196 @@ func TestNodeUnpublishVolume(t *testing.T) {
 }
 
 func TestNodeGetVolumeStats(t *testing.T) {
+	volId := "vol-test"
+	volumePath := "/test/path"
+	volumePathWithHostPrefix := GetPodPath(volumePath)
+	mpathDevice := "/dev/dm-2"
+	dummyError := errors.New("Dummy error")
+	conditionMessage := "condition message"
+	volumeStats := driver.VolumeStatistics{
+		AvailableBytes:  100,
+		TotalBytes:      300,
+		UsedBytes:       200,
+		AvailableInodes: 10,
+		TotalInodes:     30,
+		UsedInodes:      20,
+	}
+	statsRequest := &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   volId,
+		VolumePath: volumePath,
+	}
+
+	testCases := []struct {
+		name     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			name: "fail no VolumeId",
+			testFunc: func(t *testing.T) {
+				node := newTestNodeService(nil, nil, nil)
+				req := &csi.NodeGetVolumeStatsRequest{
+					VolumePath: volumePath,
+				}
+				_, err := node.NodeGetVolumeStats(context.TODO(), req)
+				assertError(t, err, codes.InvalidArgument)
+			},
+		},
+		{
+			name: "fail no VolumePath",
+			testFunc: func(t *testing.T) {
+				node := newTestNodeService(nil, nil, nil)
+				req := &csi.NodeGetVolumeStatsRequest{
+					VolumeId: volId,
+				}
+				_, err := node.NodeGetVolumeStats(context.TODO(), req)
+				assertError(t, err, codes.InvalidArgument)
+			},
+		},
+		{
+			name: "fail volume path does not exist",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, nil, nil)
 
-	req := &csi.NodeGetVolumeStatsRequest{}
+				mockNodeUtils.EXPECT().GetPodPath(volumePath).Return(volumePathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(volumePathWithHostPrefix).Return(false)
 
-	d := newTestNodeService(nil, nil, nil)
+				_, err := node.NodeGetVolumeStats(context.TODO(), statsRequest)
+				assertError(t, err, codes.NotFound)
+			},
+		},
+		{
+			name: "fail get filesystem stats",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, nil, nil)
 
-	expErrCode := codes.Unimplemented
+				mockNodeUtils.EXPECT().GetPodPath(volumePath).Return(volumePathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(volumePathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsDirectory(volumePathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetVolumeStats(volumePathWithHostPrefix).Return(driver.VolumeStatistics{}, dummyError)
 
-	_, err := d.NodeGetVolumeStats(context.TODO(), req)
-	if err == nil {
-		t.Fatalf("Expected error code %d, got nil", expErrCode)
-	}
-	srvErr, ok := status.FromError(err)
-	if !ok {
-		t.Fatalf("Could not get error status code from error: %v", srvErr)
+				_, err := node.NodeGetVolumeStats(context.TODO(), statsRequest)
+				assertError(t, err, codes.Internal)
+			},
+		},
+		{
+			name: "success filesystem volume with I/O error",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, nil, nil)
+
+				mockNodeUtils.EXPECT().GetPodPath(volumePath).Return(volumePathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(volumePathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsDirectory(volumePathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetVolumeStats(volumePathWithHostPrefix).Return(driver.VolumeStatistics{}, syscall.EIO)
+
+				resp, err := node.NodeGetVolumeStats(context.TODO(), statsRequest)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+				if !resp.VolumeCondition.Abnormal {
+					t.Fatalf("Expected abnormal volume condition, got {%+v}", resp.VolumeCondition)
+				}
+			},
+		},
+		{
+			name: "success filesystem volume",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, mockOsDeviceCon, nil)
+
+				mockNodeUtils.EXPECT().GetPodPath(volumePath).Return(volumePathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(volumePathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsDirectory(volumePathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().GetVolumeStats(volumePathWithHostPrefix).Return(volumeStats, nil)
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockOsDeviceCon.EXPECT().GetMpathDeviceCondition(mpathDevice).Return(false, conditionMessage, nil)
+
+				expResp := &csi.NodeGetVolumeStatsResponse{
+					Usage: []*csi.VolumeUsage{
+						{Available: 100, Total: 300, Used: 200, Unit: csi.VolumeUsage_BYTES},
+						{Available: 10, Total: 30, Used: 20, Unit: csi.VolumeUsage_INODES},
+					},
+					VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: conditionMessage},
+				}
+
+				resp, err := node.NodeGetVolumeStats(context.TODO(), statsRequest)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+				if !reflect.DeepEqual(expResp, resp) {
+					t.Fatalf("Expected response {%+v}, got {%+v}", expResp, resp)
+				}
+			},
+		},
+		{
+			name: "success raw block device not found",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, mockOsDeviceCon, nil)
+
+				mockNodeUtils.EXPECT().GetPodPath(volumePath).Return(volumePathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(volumePathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsDirectory(volumePathWithHostPrefix).Return(false)
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return("", &device_connectivity.MultipathDeviceNotFoundForVolumeError{VolumeId: volId})
+
+				resp, err := node.NodeGetVolumeStats(context.TODO(), statsRequest)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+				if !resp.VolumeCondition.Abnormal {
+					t.Fatalf("Expected abnormal volume condition, got {%+v}", resp.VolumeCondition)
+				}
+			},
+		},
+		{
+			name: "success raw block volume",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+				node := newTestNodeService(mockNodeUtils, mockOsDeviceCon, nil)
+
+				mockNodeUtils.EXPECT().GetPodPath(volumePath).Return(volumePathWithHostPrefix)
+				mockNodeUtils.EXPECT().IsPathExists(volumePathWithHostPrefix).Return(true)
+				mockNodeUtils.EXPECT().IsDirectory(volumePathWithHostPrefix).Return(false)
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetBlockVolumeSize(mpathDevice).Return(int64(1024), nil)
+				mockOsDeviceCon.EXPECT().GetMpathDeviceCondition(mpathDevice).Return(true, conditionMessage, nil)
+
+				expResp := &csi.NodeGetVolumeStatsResponse{
+					Usage: []*csi.VolumeUsage{
+						{Total: 1024, Unit: csi.VolumeUsage_BYTES},
+					},
+					VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: conditionMessage},
+				}
+
+				resp, err := node.NodeGetVolumeStats(context.TODO(), statsRequest)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+				if !reflect.DeepEqual(expResp, resp) {
+					t.Fatalf("Expected response {%+v}, got {%+v}", expResp, resp)
+				}
+			},
+		},
 	}
-	if srvErr.Code() != expErrCode {
-		t.Fatalf("Expected error code %d, got %d message %s", expErrCode, srvErr.Code(), srvErr.Message())
+	for _, tc := range testCases {
+		t.Run(tc.name, tc.testFunc)
 	}
 }
 
@@ -903,6 +1749,7 @@ func newTestNodeServiceExpand(nodeUtils driver.NodeUtilsInterface, osDevConHelpe
 		Hostname:                    "test-host",
 		ConfigYaml:                  driver.ConfigFile{},
 		VolumeIdLocksMap:            driver.NewSyncLock(),
+		TargetLocks:                 driver.NewTargetLocks(),
 		NodeUtils:                   nodeUtils,
 		OsDeviceConnectivityMapping: map[string]device_connectivity.OsDeviceConnectivityInterface{},
 		OsDeviceConnectivityHelper:  osDevConHelper,
@@ -915,6 +1762,8 @@ func TestNodeExpandVolume(t *testing.T) {
 	volId := "someStorageType:vol-test"
 	volumePath := "/test/path"
 	stagingTargetPath := "/staging/test/path"
+	blockStageInfoPath := path.Join(stagingTargetPath, driver.StageInfoFilename)
+	fsStageInfoPath := path.Join("/staging/test", driver.StageInfoFilename)
 	expandRequest := &csi.NodeExpandVolumeRequest{
 		VolumeId:          volId,
 		VolumePath:        volumePath,
@@ -967,6 +1816,8 @@ func TestNodeExpandVolume(t *testing.T) {
 				mockMounter := mocks.NewMockNodeMounter(mockCtl)
 				node := newTestNodeServiceExpand(mockNodeUtils, mockOsDeviceConHelper, mockMounter)
 
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
 				mockOsDeviceConHelper.EXPECT().GetMpathDevice(volId).Return("", dummyError)
 
 				_, err := node.NodeExpandVolume(context.TODO(), expandRequest)
@@ -983,6 +1834,8 @@ func TestNodeExpandVolume(t *testing.T) {
 				mockMounter := mocks.NewMockNodeMounter(mockCtl)
 				node := newTestNodeServiceExpand(mockNodeUtils, mockOsDeviceConHelper, mockMounter)
 
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
 				mockOsDeviceConHelper.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
 				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return("", dummyError)
 
@@ -1000,6 +1853,8 @@ func TestNodeExpandVolume(t *testing.T) {
 				mockMounter := mocks.NewMockNodeMounter(mockCtl)
 				node := newTestNodeServiceExpand(mockNodeUtils, mockOsDeviceConHelper, mockMounter)
 
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
 				mockOsDeviceConHelper.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
 				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockNodeUtils.EXPECT().RescanPhysicalDevices(sysDevices).Return(dummyError)
@@ -1018,6 +1873,8 @@ func TestNodeExpandVolume(t *testing.T) {
 				mockMounter := mocks.NewMockNodeMounter(mockCtl)
 				node := newTestNodeServiceExpand(mockNodeUtils, mockOsDeviceConHelper, mockMounter)
 
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
 				mockOsDeviceConHelper.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
 				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockNodeUtils.EXPECT().RescanPhysicalDevices(sysDevices)
@@ -1037,6 +1894,8 @@ func TestNodeExpandVolume(t *testing.T) {
 				mockMounter := mocks.NewMockNodeMounter(mockCtl)
 				node := newTestNodeServiceExpand(mockNodeUtils, mockOsDeviceConHelper, mockMounter)
 
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
 				mockOsDeviceConHelper.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
 				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockNodeUtils.EXPECT().RescanPhysicalDevices(sysDevices)
@@ -1057,6 +1916,8 @@ func TestNodeExpandVolume(t *testing.T) {
 				mockMounter := mocks.NewMockNodeMounter(mockCtl)
 				node := newTestNodeServiceExpand(mockNodeUtils, mockOsDeviceConHelper, mockMounter)
 
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
 				mockOsDeviceConHelper.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
 				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockNodeUtils.EXPECT().RescanPhysicalDevices(sysDevices)
@@ -1078,6 +1939,62 @@ func TestNodeExpandVolume(t *testing.T) {
 				mockMounter := mocks.NewMockNodeMounter(mockCtl)
 				node := newTestNodeServiceExpand(mockNodeUtils, mockOsDeviceConHelper, mockMounter)
 
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(false)
+				mockOsDeviceConHelper.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
+				mockNodeUtils.EXPECT().RescanPhysicalDevices(sysDevices)
+				mockNodeUtils.EXPECT().ExpandMpathDevice(mpathDeviceName)
+				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return(fsType, nil)
+				mockNodeUtils.EXPECT().ExpandFilesystem(mpathDevice, stagingTargetPath, fsType)
+
+				_, err := node.NodeExpandVolume(context.TODO(), expandRequest)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "success expand volume with stage info file",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceConHelper := mocks.NewMockOsDeviceConnectivityHelperScsiGenericInterface(mockCtl)
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				node := newTestNodeServiceExpand(mockNodeUtils, mockOsDeviceConHelper, mockMounter)
+
+				stageInfo := &driver.StageInfo{MpathDevice: mpathDeviceName, SysDevices: sysDevices, FsType: fsType, AccessType: "mount"}
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(true)
+				mockNodeUtils.EXPECT().ReadStageInfoFile(fsStageInfoPath).Return(stageInfo, nil)
+				mockNodeUtils.EXPECT().IsDeviceOfVolume(mpathDeviceName, volId).Return(true)
+				mockNodeUtils.EXPECT().RescanPhysicalDevices(sysDevices)
+				mockNodeUtils.EXPECT().ExpandMpathDevice(mpathDeviceName)
+				mockMounter.EXPECT().GetDiskFormat(mpathDevice).Return(fsType, nil)
+				mockNodeUtils.EXPECT().ExpandFilesystem(mpathDevice, stagingTargetPath, fsType)
+
+				_, err := node.NodeExpandVolume(context.TODO(), expandRequest)
+				if err != nil {
+					t.Fatalf("Expect no error but got: %v", err)
+				}
+			},
+		},
+		{
+			name: "success expand volume with stage info file of a reused device",
+			testFunc: func(t *testing.T) {
+				mockCtl := gomock.NewController(t)
+				defer mockCtl.Finish()
+				mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+				mockOsDeviceConHelper := mocks.NewMockOsDeviceConnectivityHelperScsiGenericInterface(mockCtl)
+				mockMounter := mocks.NewMockNodeMounter(mockCtl)
+				node := newTestNodeServiceExpand(mockNodeUtils, mockOsDeviceConHelper, mockMounter)
+
+				stageInfo := &driver.StageInfo{MpathDevice: "dm-7", SysDevices: []string{"sdx"}, FsType: fsType, AccessType: "mount"}
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+				mockNodeUtils.EXPECT().StageInfoFileIsExist(fsStageInfoPath).Return(true)
+				mockNodeUtils.EXPECT().ReadStageInfoFile(fsStageInfoPath).Return(stageInfo, nil)
+				mockNodeUtils.EXPECT().IsDeviceOfVolume("dm-7", volId).Return(false)
 				mockOsDeviceConHelper.EXPECT().GetMpathDevice(volId).Return(mpathDevice, nil)
 				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(mpathDeviceName).Return(rawSysDevices, nil)
 				mockNodeUtils.EXPECT().RescanPhysicalDevices(sysDevices)
@@ -1118,6 +2035,20 @@ func TestNodeGetCapabilities(t *testing.T) {
 				},
 			},
 		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
 	}
 	expResp := &csi.NodeGetCapabilitiesResponse{Capabilities: caps}
 
@@ -1143,11 +2074,13 @@ func TestNodeGetInfo(t *testing.T) {
 		return_iqn_err    error
 		return_fcs        []string
 		return_fc_err     error
+		return_nqn        string
 		return_nodeId_err error
 		expErr            error
 		expNodeId         string
 		iscsiExists       bool
 		fcExists          bool
+		nvmeExists        bool
 	}{
 		{
 			name:          "good iqn, empty fc with error from node_utils",
@@ -1183,7 +2116,25 @@ func TestNodeGetInfo(t *testing.T) {
 			name:        "iqn and fc path are inexistent",
 			iscsiExists: false,
 			fcExists:    false,
-			expErr:      status.Error(codes.Internal, fmt.Errorf("Cannot find valid fc wwns or iscsi iqn").Error()),
+			expErr:      status.Error(codes.Internal, fmt.Errorf("Cannot find valid fc wwns, iscsi iqn or nvme nqn").Error()),
+		},
+		{
+			name:        "only nvme nqn",
+			iscsiExists: false,
+			fcExists:    false,
+			nvmeExists:  true,
+			return_nqn:  "nqn.2014-08.org.nvmexpress:uuid:e123456789",
+			expNodeId:   "test-host;;;nqn.2014-08.org.nvmexpress:uuid:e123456789",
+		},
+		{
+			name:        "good iqn, good fcs and good nqn",
+			iscsiExists: true,
+			fcExists:    true,
+			nvmeExists:  true,
+			return_iqn:  "iqn.1994-07.com.redhat:e123456789",
+			return_fcs:  []string{"10000000c9934d9f"},
+			return_nqn:  "nqn.2014-08.org.nvmexpress:uuid:e123456789",
+			expNodeId:   "test-host;10000000c9934d9f;iqn.1994-07.com.redhat:e123456789;nqn.2014-08.org.nvmexpress:uuid:e123456789",
 		},
 		{
 			name:        "iqn path is inexistsent",
@@ -1227,10 +2178,14 @@ func TestNodeGetInfo(t *testing.T) {
 				if tc.iscsiExists {
 					fake_nodeutils.EXPECT().ParseIscsiInitiators().Return(tc.return_iqn, tc.return_iqn_err)
 				}
+				fake_nodeutils.EXPECT().IsPathExists(driver.NvmeHostNqnFullPath).Return(tc.nvmeExists)
+				if tc.nvmeExists {
+					fake_nodeutils.EXPECT().ParseNvmeHostNqn().Return(tc.return_nqn, nil)
+				}
 			}
 
-			if (tc.iscsiExists || tc.fcExists) && tc.return_fc_err == nil {
-				fake_nodeutils.EXPECT().GenerateNodeID("test-host", tc.return_fcs, tc.return_iqn).Return(tc.expNodeId, tc.return_nodeId_err)
+			if (tc.iscsiExists || tc.fcExists || tc.nvmeExists) && tc.return_fc_err == nil {
+				fake_nodeutils.EXPECT().GenerateNodeID("test-host", tc.return_fcs, tc.return_iqn, tc.return_nqn).Return(tc.expNodeId, tc.return_nodeId_err)
 			}
 
 			expTopology := &csi.Topology{Segments: topologySegments}
@@ -18,13 +18,16 @@ package driver
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
 	"k8s.io/apimachinery/pkg/util/errors"
@@ -41,6 +44,15 @@ import (
 var (
 	getOpts          = metav1.GetOptions{}
 	topologyPrefixes = [...]string{"topology.kubernetes.io", "topology.block.csi.ibm.com"}
+
+	// deviceIdentifierFiles hold the identifier of a multipath device, a native NVMe device and a scsi device
+	deviceIdentifierFiles = []string{"/sys/block/%s/dm/uuid", "/sys/block/%s/wwid", "/sys/block/%s/device/wwid"}
+
+	// stagingPathsPatterns match the staging paths of the mount volumes and of the block volumes the kubelet creates
+	stagingPathsPatterns = []string{
+		path.Join(KubeletCsiPluginsPath, "pv", "*", "globalmount"),
+		path.Join(KubeletCsiPluginsPath, "volumeDevices", "staging", "*"),
+	}
 )
 
 const (
@@ -52,15 +64,21 @@ const (
 	NodeIdFcDelimiter           = ":"
 	mkfsTimeoutMilliseconds     = 15 * 60 * 1000
 	resizeFsTimeoutMilliseconds = 30 * 1000
+	blockdevTimeoutMilliseconds = 10 * 1000
 	TimeOutMultipathdCmd        = 10 * 1000
 	multipathdCmd               = "multipathd"
+	dmsetupCmd                  = "dmsetup"
+	TimeOutDmsetupCmd           = 10 * 1000
 	minFilesInNonEmptyDir       = 1
+	KubeletCsiPluginsPath       = "/var/lib/kubelet/plugins/kubernetes.io/csi"
+	KubeletVolumeDataFilename   = "vol_data.json"
 )
 
 //go:generate mockgen -destination=../../mocks/mock_node_utils.go -package=mocks github.com/ibm/ibm-block-csi-driver/node/pkg/driver NodeUtilsInterface
 
 type NodeUtilsInterface interface {
 	ParseIscsiInitiators() (string, error)
+	ParseNvmeHostNqn() (string, error)
 	ParseFCPorts() ([]string, error)
 	GetInfoFromPublishContext(publishContext map[string]string, configYaml ConfigFile) (string, int, map[string][]string, error)
 	GetArrayInitiators(ipsByArrayInitiator map[string][]string) []string
@@ -69,6 +87,12 @@ type NodeUtilsInterface interface {
 	// TODO refactor and move all staging methods to dedicate interface.
 	ClearStageInfoFile(filePath string) error
 	StageInfoFileIsExist(filePath string) bool
+	WriteStageInfoFile(filePath string, stageInfo *StageInfo) error
+	ReadStageInfoFile(filePath string) (*StageInfo, error)
+	IsDeviceOfVolume(baseDevice string, volumeId string) bool
+	GetStagingPaths() ([]string, error)
+	ReadKubeletVolumeData(stagingPath string) (*KubeletVolumeData, error)
+	IsDeviceInUse(baseDevice string) (bool, error)
 	IsPathExists(filePath string) bool
 	IsFCExists() bool
 	IsDirectory(filePath string) bool
@@ -80,11 +104,37 @@ type NodeUtilsInterface interface {
 	RescanPhysicalDevices(sysDevices []string) error
 	FormatDevice(devicePath string, fsType string)
 	IsNotMountPoint(file string) (bool, error)
+	IsMountReadOnly(mountPoint string) (bool, error)
+	GetVolumeStats(volumePath string) (VolumeStatistics, error)
+	GetBlockVolumeSize(devicePath string) (int64, error)
 	GetPodPath(filepath string) string
-	GenerateNodeID(hostName string, fcWWNs []string, iscsiIQN string) (string, error)
+	GenerateNodeID(hostName string, fcWWNs []string, iscsiIQN string, nvmeNQN string) (string, error)
 	GetTopologyLabels(ctx context.Context, nodeName string) (map[string]string, error)
 }
 
+type VolumeStatistics struct {
+	AvailableBytes, TotalBytes, UsedBytes    int64
+	AvailableInodes, TotalInodes, UsedInodes int64
+}
+
+// StageInfo is the record of a staged volume, so the devices of the volume can be handled without discovering them again
+type StageInfo struct {
+	VolumeId        string   `json:"volumeId"`
+	Connectivity    string   `json:"connectivity"`
+	Lun             int      `json:"lun"`
+	ArrayInitiators []string `json:"arrayInitiators"`
+	MpathDevice     string   `json:"mpathDevice"`
+	SysDevices      []string `json:"sysDevices"`
+	FsType          string   `json:"fsType,omitempty"`
+	AccessType      string   `json:"accessType"`
+}
+
+// KubeletVolumeData is the part of the volume data the kubelet saves next to the staging path of a csi volume
+type KubeletVolumeData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
 type NodeUtils struct {
 	Executer executer.ExecuterInterface
 	mounter  mount.Interface
@@ -120,6 +170,20 @@ func (n NodeUtils) ParseIscsiInitiators() (string, error) {
 	return iscsiIqn, nil
 }
 
+func (n NodeUtils) ParseNvmeHostNqn() (string, error) {
+	fileOut, err := ioutil.ReadFile(NvmeHostNqnFullPath)
+	if err != nil {
+		return "", err
+	}
+
+	nvmeNqn := strings.TrimSpace(string(fileOut))
+	if !strings.HasPrefix(nvmeNqn, "nqn.") {
+		return "", fmt.Errorf(ErrorWhileTryingToReadNQN, string(fileOut))
+	}
+
+	return nvmeNqn, nil
+}
+
 func (n NodeUtils) GetInfoFromPublishContext(publishContext map[string]string, configYaml ConfigFile) (string, int, map[string][]string, error) {
 	// this will return :  connectivityType, lun, ipsByArrayInitiator, error
 	ipsByArrayInitiator := make(map[string][]string)
@@ -141,7 +205,7 @@ func (n NodeUtils) GetInfoFromPublishContext(publishContext map[string]string, c
 			}
 		}
 	}
-	if connectivityType == device_connectivity.ConnectionTypeFC {
+	if connectivityType == device_connectivity.ConnectionTypeFC || connectivityType == device_connectivity.ConnectionTypeNVMEoFC {
 		wwns := strings.Split(publishContext[configYaml.Controller.Publish_context_fc_initiators], PublishContextSeparator)
 		for _, wwn := range wwns {
 			ipsByArrayInitiator[wwn] = nil
@@ -191,12 +255,134 @@ func (n NodeUtils) GetSysDevicesFromMpath(device string) (string, error) {
 }
 
 func (n NodeUtils) StageInfoFileIsExist(filePath string) bool {
-	if _, err := os.Stat(filePath); err != nil {
+	if _, err := os.Stat(n.GetPodPath(filePath)); err != nil {
 		return false
 	}
 	return true
 }
 
+func (n NodeUtils) WriteStageInfoFile(filePath string, stageInfo *StageInfo) error {
+	filePath = n.GetPodPath(filePath)
+	logger.Debugf("Write StagingInfoFile : path {%v}, info {%+v}", filePath, *stageInfo)
+
+	stageInfoJson, err := json.Marshal(stageInfo)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, stageInfoJson, 0600)
+}
+
+func (n NodeUtils) ReadStageInfoFile(filePath string) (*StageInfo, error) {
+	filePath = n.GetPodPath(filePath)
+	logger.Debugf("Read StagingInfoFile : path {%v}", filePath)
+
+	stageInfoJson, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	stageInfo := &StageInfo{}
+	if err := json.Unmarshal(stageInfoJson, stageInfo); err != nil {
+		return nil, err
+	}
+	return stageInfo, nil
+}
+
+func (n NodeUtils) IsDeviceOfVolume(baseDevice string, volumeId string) bool {
+	/*
+		The device names in the stage info may be reused by the kernel once the devices are removed,
+		so a device belongs to the volume only if its identifier still contains the volume uuid.
+	*/
+	volumeIdParts := strings.Split(volumeId, device_connectivity.VolumeIdDelimiter)
+	volumeUuidLower := strings.ToLower(volumeIdParts[len(volumeIdParts)-1])
+	for _, identifierFile := range deviceIdentifierFiles {
+		identifier, err := n.Executer.IoutilReadFile(fmt.Sprintf(identifierFile, baseDevice))
+		if err != nil {
+			continue
+		}
+		return strings.Contains(strings.ToLower(string(identifier)), volumeUuidLower)
+	}
+	logger.Debugf("Device {%v} does not exist", baseDevice)
+	return false
+}
+
+func (n NodeUtils) GetStagingPaths() ([]string, error) {
+	var stagingPaths []string
+	for _, pattern := range stagingPathsPatterns {
+		matches, err := n.Executer.FilepathGlob(n.GetPodPath(pattern))
+		if err != nil {
+			logger.Errorf("Error while Glob staging paths : {%v}. err : {%v}", pattern, err)
+			return nil, err
+		}
+		for _, match := range matches {
+			stagingPaths = append(stagingPaths, strings.TrimPrefix(match, PrefixChrootOfHostRoot))
+		}
+	}
+	return stagingPaths, nil
+}
+
+// getKubeletVolumeDataPath returns the volume data file of the staging path, e.g. csi/pv/pvc-1/vol_data.json of
+// csi/pv/pvc-1/globalmount, or csi/volumeDevices/pvc-1/data/vol_data.json of csi/volumeDevices/staging/pvc-1.
+func getKubeletVolumeDataPath(stagingPath string) string {
+	stagingPath = path.Clean(stagingPath)
+	if path.Base(path.Dir(stagingPath)) == "staging" {
+		volumeDevicesPath := path.Dir(path.Dir(stagingPath))
+		return path.Join(volumeDevicesPath, path.Base(stagingPath), "data", KubeletVolumeDataFilename)
+	}
+	return path.Join(path.Dir(stagingPath), KubeletVolumeDataFilename)
+}
+
+func (n NodeUtils) ReadKubeletVolumeData(stagingPath string) (*KubeletVolumeData, error) {
+	filePath := n.GetPodPath(getKubeletVolumeDataPath(stagingPath))
+	logger.Debugf("Read kubelet volume data : path {%v}", filePath)
+
+	volumeDataJson, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	volumeData := &KubeletVolumeData{}
+	if err := json.Unmarshal(volumeDataJson, volumeData); err != nil {
+		return nil, err
+	}
+	return volumeData, nil
+}
+
+func (n NodeUtils) IsDeviceInUse(baseDevice string) (bool, error) {
+	/*
+		A device is in use if it is mounted or held open, e.g. by a mounted filesystem, by a raw block
+		volume of a running pod or by a device which is stacked on top of it.
+	*/
+	devicePath := path.Join(device_connectivity.DevPath, baseDevice)
+	mountPoints, err := n.mounter.List()
+	if err != nil {
+		return false, err
+	}
+	for _, mountPoint := range mountPoints {
+		if mountPoint.Device == devicePath {
+			logger.Debugf("Device {%v} is mounted on {%v}", devicePath, mountPoint.Path)
+			return true, nil
+		}
+		if !strings.HasPrefix(mountPoint.Device, device_connectivity.DevPath) {
+			continue
+		}
+		if resolvedDevice, err := filepath.EvalSymlinks(mountPoint.Device); err == nil && resolvedDevice == devicePath {
+			logger.Debugf("Device {%v} is mounted as {%v} on {%v}", devicePath, mountPoint.Device, mountPoint.Path)
+			return true, nil
+		}
+	}
+
+	args := []string{"info", "-c", "--noheadings", "-o", "open", devicePath}
+	out, err := n.Executer.ExecuteWithTimeout(TimeOutDmsetupCmd, dmsetupCmd, args)
+	if err != nil {
+		return false, err
+	}
+	openCount, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return false, err
+	}
+	logger.Debugf("Device {%v} open count : {%v}", devicePath, openCount)
+	return openCount > 0, nil
+}
+
 func (n NodeUtils) ParseFCPorts() ([]string, error) {
 	var errs []error
 	var fcPorts []string
@@ -351,8 +537,36 @@ func (n NodeUtils) ExpandMpathDevice(mpathDevice string) error {
 	return nil
 }
 
+func (n NodeUtils) rescanNvmeDevice(deviceName string) error {
+	// the device of a namespace is its controller, or its subsystem in case of native NVMe multipath
+	var controllersRescanFiles []string
+	for _, pattern := range []string{"/sys/block/%s/device/rescan_controller", "/sys/block/%s/device/nvme*/rescan_controller"} {
+		matches, err := n.Executer.FilepathGlob(fmt.Sprintf(pattern, deviceName))
+		if err != nil {
+			return err
+		}
+		controllersRescanFiles = append(controllersRescanFiles, matches...)
+	}
+	if len(controllersRescanFiles) == 0 {
+		return fmt.Errorf("rescan error: no NVMe controller was found for device : {%s}", deviceName)
+	}
+
+	for _, filename := range controllersRescanFiles {
+		if err := n.writeRescanFile(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (n NodeUtils) rescanPhysicalDevice(deviceName string) error {
-	filename := fmt.Sprintf("/sys/block/%s/device/rescan", deviceName)
+	if device_connectivity.IsNvmeNativeDevice(deviceName) {
+		return n.rescanNvmeDevice(deviceName)
+	}
+	return n.writeRescanFile(fmt.Sprintf("/sys/block/%s/device/rescan", deviceName))
+}
+
+func (n NodeUtils) writeRescanFile(filename string) error {
 	f, err := n.Executer.OsOpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200)
 	if err != nil {
 		logger.Errorf("Rescan Error: could not open filename : {%v}. err : {%v}", filename, err)
@@ -408,13 +622,75 @@ func (n NodeUtils) IsNotMountPoint(file string) (bool, error) {
 	return mount.IsNotMountPoint(n.mounter, file)
 }
 
+func (n NodeUtils) IsMountReadOnly(mountPoint string) (bool, error) {
+	mountPoints, err := n.mounter.List()
+	if err != nil {
+		return false, err
+	}
+
+	// the last mount of the path is the one that is visible
+	isFound := false
+	isReadOnly := false
+	for _, mp := range mountPoints {
+		if mp.Path != mountPoint {
+			continue
+		}
+		isFound = true
+		isReadOnly = false
+		for _, opt := range mp.Opts {
+			if opt == readOnlyMountOption {
+				isReadOnly = true
+				break
+			}
+		}
+	}
+	if !isFound {
+		return false, fmt.Errorf("mount point {%s} was not found in the mount table", mountPoint)
+	}
+	return isReadOnly, nil
+}
+
+func (n NodeUtils) GetVolumeStats(volumePath string) (VolumeStatistics, error) {
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(volumePath, &statfs); err != nil {
+		logger.Errorf("Failed to run statfs on {%v}, error: %v", volumePath, err)
+		return VolumeStatistics{}, err
+	}
+
+	blockSize := int64(statfs.Bsize)
+	volumeStats := VolumeStatistics{
+		AvailableBytes:  int64(statfs.Bavail) * blockSize,
+		TotalBytes:      int64(statfs.Blocks) * blockSize,
+		UsedBytes:       (int64(statfs.Blocks) - int64(statfs.Bfree)) * blockSize,
+		AvailableInodes: int64(statfs.Ffree),
+		TotalInodes:     int64(statfs.Files),
+		UsedInodes:      int64(statfs.Files) - int64(statfs.Ffree),
+	}
+	return volumeStats, nil
+}
+
+func (n NodeUtils) GetBlockVolumeSize(devicePath string) (int64, error) {
+	args := []string{"--getsize64", devicePath}
+	output, err := n.Executer.ExecuteWithTimeout(blockdevTimeoutMilliseconds, "blockdev", args)
+	if err != nil {
+		return 0, fmt.Errorf("blockdev failed: %v\narguments: %v\nOutput: %s\n", err, args, string(output))
+	}
+
+	strOut := strings.TrimSpace(string(output))
+	size, err := strconv.ParseInt(strOut, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size of device %s from blockdev output {%s}: %v", devicePath, strOut, err)
+	}
+	return size, nil
+}
+
 // To some files/dirs pod cannot access using its real path. It has to use a different path which is <prefix>/<path>.
 // E.g. in order to access /etc/test.txt pod has to use /host/etc/test.txt
 func (n NodeUtils) GetPodPath(origPath string) string {
 	return path.Join(PrefixChrootOfHostRoot, origPath)
 }
 
-func (n NodeUtils) GenerateNodeID(hostName string, fcWWNs []string, iscsiIQN string) (string, error) {
+func (n NodeUtils) GenerateNodeID(hostName string, fcWWNs []string, iscsiIQN string, nvmeNQN string) (string, error) {
 	var nodeId strings.Builder
 	nodeId.Grow(MaxNodeIdLength)
 	nodeId.WriteString(hostName)
@@ -434,14 +710,29 @@ func (n NodeUtils) GenerateNodeID(hostName string, fcWWNs []string, iscsiIQN str
 			}
 		}
 	}
+	isIqnWritten := false
 	if len(iscsiIQN) > 0 {
 		if nodeId.Len()+len(NodeIdDelimiter)+len(iscsiIQN) <= MaxNodeIdLength {
 			nodeId.WriteString(NodeIdDelimiter)
 			nodeId.WriteString(iscsiIQN)
+			isIqnWritten = true
 		} else if len(fcWWNs) == 0 {
 			return "", fmt.Errorf(ErrorNoPortsCouldFitInNodeId, nodeId.String(), MaxNodeIdLength)
 		}
 	}
+	if len(nvmeNQN) > 0 {
+		// the nqn is always the fourth field, so an empty iqn field is written before it if needed
+		nqnPrefix := NodeIdDelimiter
+		if !isIqnWritten {
+			nqnPrefix = NodeIdDelimiter + NodeIdDelimiter
+		}
+		if nodeId.Len()+len(nqnPrefix)+len(nvmeNQN) <= MaxNodeIdLength {
+			nodeId.WriteString(nqnPrefix)
+			nodeId.WriteString(nvmeNQN)
+		} else if len(fcWWNs) == 0 && !isIqnWritten {
+			return "", fmt.Errorf(ErrorNoPortsCouldFitInNodeId, nodeId.String(), MaxNodeIdLength)
+		}
+	}
 
 	return nodeId.String(), nil
 }
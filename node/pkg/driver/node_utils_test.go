@@ -30,6 +30,7 @@ import (
 	driver "github.com/ibm/ibm-block-csi-driver/node/pkg/driver"
 	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
 	executer "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executer"
+	"k8s.io/utils/mount"
 )
 
 var (
@@ -218,6 +219,7 @@ func TestGenerateNodeID(t *testing.T) {
 		hostName  string
 		fcWWNs    []string
 		iscsiIQN  string
+		nvmeNQN   string
 		expErr    error
 		expNodeId string
 	}{
@@ -245,6 +247,27 @@ func TestGenerateNodeID(t *testing.T) {
 			iscsiIQN:  "iqn.1994-07.com.redhat:e123456789",
 			expNodeId: "test-hostname.ibm.com;10000000c9934d9f:10000000c9934d9h:10000000c9934d9a:10000000c9934d9b:10000000c9934d9z",
 		},
+		{name: "success all in with nvme nqn",
+			hostName:  "test-host",
+			fcWWNs:    []string{"10000000c9934d9f"},
+			iscsiIQN:  "iqn.1994-07.com.redhat:e123456789",
+			nvmeNQN:   "nqn.2014-08.org.nvmexpress:uuid:e123456789",
+			expNodeId: "test-host;10000000c9934d9f;iqn.1994-07.com.redhat:e123456789;nqn.2014-08.org.nvmexpress:uuid:e123456789",
+		},
+		{name: "success only nvme nqn",
+			hostName:  "test-host",
+			fcWWNs:    []string{},
+			iscsiIQN:  "",
+			nvmeNQN:   "nqn.2014-08.org.nvmexpress:uuid:e123456789",
+			expNodeId: "test-host;;;nqn.2014-08.org.nvmexpress:uuid:e123456789",
+		},
+		{name: "success nvme nqn does not fit after fc ports",
+			hostName:  "test-hostname.ibm.com",
+			fcWWNs:    []string{"10000000c9934d9f", "10000000c9934d9h", "10000000c9934d9a", "10000000c9934d9b", "10000000c9934d9z"},
+			iscsiIQN:  "",
+			nvmeNQN:   "nqn.2014-08.org.nvmexpress:uuid:e123456789",
+			expNodeId: "test-hostname.ibm.com;10000000c9934d9f:10000000c9934d9h:10000000c9934d9a:10000000c9934d9b:10000000c9934d9z",
+		},
 		{name: "fail long hostName on fc ports",
 			hostName: "test-hostname-that-is-too-long-and-take-almost-128-characters-so-no-port-get-place-additional-characters.nodeutilstest.ibm.com",
 			fcWWNs:   []string{"10000000c9934d9f", "10000000c9934d9h"},
@@ -257,6 +280,13 @@ func TestGenerateNodeID(t *testing.T) {
 			iscsiIQN: "iqn.1994-07.com.redhat:e123456789",
 			expErr:   errors.New("could not fit any ports in node id: test-hostname-that-is-too-long-and-take-almost-128-characters-so-no-port-get-place-additional-characters.nodeutilstest.ibm.com;, length limit: 128"),
 		},
+		{name: "fail long hostName on nvme nqn",
+			hostName: "test-hostname-that-is-too-long-and-take-almost-128-characters-so-no-port-get-place-additional-characters.nodeutilstest.ibm.com",
+			fcWWNs:   []string{},
+			iscsiIQN: "",
+			nvmeNQN:  "nqn.2014-08.org.nvmexpress:uuid:e123456789",
+			expErr:   errors.New("could not fit any ports in node id: test-hostname-that-is-too-long-and-take-almost-128-characters-so-no-port-get-place-additional-characters.nodeutilstest.ibm.com;, length limit: 128"),
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -267,7 +297,7 @@ func TestGenerateNodeID(t *testing.T) {
 			fake_executer := mocks.NewMockExecuterInterface(mockCtrl)
 			nodeUtils := driver.NewNodeUtils(fake_executer, nil)
 
-			nodeId, err := nodeUtils.GenerateNodeID(tc.hostName, tc.fcWWNs, tc.iscsiIQN)
+			nodeId, err := nodeUtils.GenerateNodeID(tc.hostName, tc.fcWWNs, tc.iscsiIQN, tc.nvmeNQN)
 
 			if tc.expErr != nil {
 				if err.Error() != tc.expErr.Error() {
@@ -286,3 +316,104 @@ func TestGenerateNodeID(t *testing.T) {
 		})
 	}
 }
+
+func TestIsMountReadOnly(t *testing.T) {
+	mountPoint := "/host/var/lib/kubelet/pods/pod-uid/volumes/kubernetes.io~csi/pv/mount"
+	testCases := []struct {
+		name          string
+		mountPoints   []mount.MountPoint
+		expReadOnly   bool
+		expErrMessage string
+	}{
+		{name: "success read write mount",
+			mountPoints: []mount.MountPoint{{Path: mountPoint, Opts: []string{"rw", "relatime"}}},
+			expReadOnly: false,
+		},
+		{name: "success read only mount",
+			mountPoints: []mount.MountPoint{{Path: mountPoint, Opts: []string{"ro", "relatime"}}},
+			expReadOnly: true,
+		},
+		{name: "success last mount of the path is read only",
+			mountPoints: []mount.MountPoint{
+				{Path: mountPoint, Opts: []string{"rw"}},
+				{Path: mountPoint, Opts: []string{"ro"}},
+			},
+			expReadOnly: true,
+		},
+		{name: "fail mount point not found",
+			mountPoints:   []mount.MountPoint{{Path: "/other/path", Opts: []string{"ro"}}},
+			expErrMessage: fmt.Sprintf("mount point {%s} was not found in the mount table", mountPoint),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodeUtils := driver.NewNodeUtils(&executer.Executer{}, mount.NewFakeMounter(tc.mountPoints))
+
+			isReadOnly, err := nodeUtils.IsMountReadOnly(mountPoint)
+
+			if tc.expErrMessage != "" {
+				if err == nil || err.Error() != tc.expErrMessage {
+					t.Fatalf("Expecting err: expected %v, got %v", tc.expErrMessage, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			if isReadOnly != tc.expReadOnly {
+				t.Fatalf("wrong read only: expected %v, got %v", tc.expReadOnly, isReadOnly)
+			}
+		})
+	}
+}
+
+func TestIsDeviceOfVolume(t *testing.T) {
+	volumeId := "SVC:6005076810810261F800000000000A5B"
+	testCases := []struct {
+		name        string
+		device      string
+		identifiers map[string]string
+		expResult   bool
+	}{
+		{name: "success multipath device of the volume",
+			device:      "dm-2",
+			identifiers: map[string]string{"/sys/block/dm-2/dm/uuid": "mpath-36005076810810261f800000000000a5b\n"},
+			expResult:   true,
+		},
+		{name: "success scsi device of the volume",
+			device:      "sdb",
+			identifiers: map[string]string{"/sys/block/sdb/device/wwid": "naa.6005076810810261F800000000000A5B\n"},
+			expResult:   true,
+		},
+		{name: "success multipath device reused by another volume",
+			device:      "dm-2",
+			identifiers: map[string]string{"/sys/block/dm-2/dm/uuid": "mpath-36005076810810261f800000000000a5c\n"},
+			expResult:   false,
+		},
+		{name: "success device does not exist",
+			device:      "sdb",
+			identifiers: map[string]string{},
+			expResult:   false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			fakeExecuter := mocks.NewMockExecuterInterface(mockCtrl)
+			fakeExecuter.EXPECT().IoutilReadFile(gomock.Any()).DoAndReturn(func(filename string) ([]byte, error) {
+				if identifier, ok := tc.identifiers[filename]; ok {
+					return []byte(identifier), nil
+				}
+				return nil, os.ErrNotExist
+			}).AnyTimes()
+			nodeUtils := driver.NewNodeUtils(fakeExecuter, nil)
+
+			isDeviceOfVolume := nodeUtils.IsDeviceOfVolume(tc.device, volumeId)
+
+			if isDeviceOfVolume != tc.expResult {
+				t.Fatalf("wrong result: expected %v, got %v", tc.expResult, isDeviceOfVolume)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ibm/ibm-block-csi-driver/node/logger"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
+)
+
+const multipathNaaWwidPrefix = "3"
+
+type OrphanDevicesCollectorConfig struct {
+	Interval    time.Duration // The collector is disabled if the interval is 0
+	GracePeriod time.Duration // How long a device must stay orphaned before it is removed
+	DryRun      bool          // Only log the devices which would be removed
+}
+
+// OrphanDevicesCollector removes the multipath devices of IBM storage, and their scsi devices, which are left behind
+// by failed or interrupted unstage requests. A device is orphaned if no staged volume uses it, no request is
+// being performed on its volume, and it is neither mounted nor held open.
+type OrphanDevicesCollector struct {
+	Config      OrphanDevicesCollectorConfig
+	NodeService *NodeService
+	Helper      device_connectivity.OsDeviceConnectivityHelperInterface
+	orphanSince map[string]time.Time
+}
+
+func NewOrphanDevicesCollector(config OrphanDevicesCollectorConfig, nodeService *NodeService,
+	helper device_connectivity.OsDeviceConnectivityHelperInterface) *OrphanDevicesCollector {
+	return &OrphanDevicesCollector{
+		Config:      config,
+		NodeService: nodeService,
+		Helper:      helper,
+		orphanSince: make(map[string]time.Time),
+	}
+}
+
+func (c *OrphanDevicesCollector) Run(stopCh <-chan struct{}) {
+	logger.Infof("Orphan devices collector started, interval : {%v}, grace period : {%v}, dry run : {%v}",
+		c.Config.Interval, c.Config.GracePeriod, c.Config.DryRun)
+	ticker := time.NewTicker(c.Config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			logger.Infof("Orphan devices collector stopped")
+			return
+		case now := <-ticker.C:
+			c.Collect(now)
+		}
+	}
+}
+
+// Collect removes the devices which are orphaned for the grace period, and starts the grace period of new orphans.
+func (c *OrphanDevicesCollector) Collect(now time.Time) {
+	logger.Debugf(">>>> OrphanDevicesCollector.Collect")
+	defer logger.Debugf("<<<< OrphanDevicesCollector.Collect")
+
+	wwidsByDm, err := c.Helper.GetIbmDms()
+	if err != nil {
+		logger.Errorf("Failed to list the multipath devices : {%v}", err)
+		return
+	}
+	stagedDevices, unrecordedVolumeUuids, err := c.getStagedDevices()
+	if err != nil {
+		logger.Errorf("Failed to get the staged devices : {%v}", err)
+		return
+	}
+
+	orphanSince := make(map[string]time.Time)
+	for dm, wwid := range wwidsByDm {
+		if stagedDevices[dm] || isWwidOfVolumes(wwid, unrecordedVolumeUuids) {
+			continue
+		}
+		orphanKey := dm + "," + wwid
+		since, ok := c.orphanSince[orphanKey]
+		if !ok {
+			since = now
+		}
+		isOrphaned, isRemoved := c.collectDevice(dm, wwid, now.Sub(since) >= c.Config.GracePeriod)
+		if !isOrphaned || isRemoved {
+			continue
+		}
+		if !ok {
+			logger.Infof("Multipath device {%v} of wwid {%v} is orphaned", dm, wwid)
+		}
+		orphanSince[orphanKey] = since
+	}
+	c.orphanSince = orphanSince
+}
+
+// collectDevice checks if the device is orphaned, and removes it once the grace period is over, while holding the lock
+// of its volume so no request can stage the volume meanwhile. It returns if the device is orphaned and if it was removed.
+func (c *OrphanDevicesCollector) collectDevice(dm string, wwid string, isGracePeriodOver bool) (bool, bool) {
+	d := c.NodeService
+	volumeUuid := getVolumeUuidOfWwid(wwid)
+	if err := d.VolumeIdLocksMap.AddVolumeLock(volumeUuid, "OrphanDevicesCollector"); err != nil {
+		logger.Debugf("A request is being performed on the volume of multipath device {%v}, skipping it", dm)
+		return false, false
+	}
+	defer d.VolumeIdLocksMap.RemoveVolumeLock(volumeUuid, "OrphanDevicesCollector")
+
+	isInUse, err := d.NodeUtils.IsDeviceInUse(dm)
+	if err != nil {
+		logger.Warningf("Failed to check if device {%v} is in use, skipping it : {%v}", dm, err)
+		return false, false
+	}
+	if isInUse {
+		return false, false
+	}
+	if !isGracePeriodOver {
+		return true, false
+	}
+
+	// the volume may have been staged since the staged devices were listed
+	stagedDevices, unrecordedVolumeUuids, err := c.getStagedDevices()
+	if err != nil {
+		logger.Errorf("Failed to get the staged devices, skipping device {%v} : {%v}", dm, err)
+		return true, false
+	}
+	if stagedDevices[dm] || isWwidOfVolumes(wwid, unrecordedVolumeUuids) {
+		return false, false
+	}
+	if err := c.removeDevice(dm, wwid); err != nil {
+		logger.Errorf("Failed to remove orphaned multipath device {%v} : {%v}", dm, err)
+		return true, false
+	}
+	return true, !c.Config.DryRun
+}
+
+// getStagedDevices returns the multipath devices in the stage info of the staged volumes, and the uuids of the volumes
+// of the driver which are staged without stage info, e.g. by a driver version which did not write it, so their devices
+// are not known.
+func (c *OrphanDevicesCollector) getStagedDevices() (map[string]bool, []string, error) {
+	d := c.NodeService
+	stagingPaths, err := d.NodeUtils.GetStagingPaths()
+	if err != nil {
+		return nil, nil, err
+	}
+	stagedDevices := make(map[string]bool)
+	var unrecordedVolumeUuids []string
+	for _, stagingPath := range stagingPaths {
+		if stageInfo, _ := d.getStageInfo(stagingPath); stageInfo != nil {
+			stagedDevices[stageInfo.MpathDevice] = true
+			continue
+		}
+		volumeData, err := d.NodeUtils.ReadKubeletVolumeData(stagingPath)
+		if err != nil {
+			// e.g. a leftover staging path, or a staging path of another driver
+			logger.Warningf("Staging path {%v} has neither stage info nor volume data, skipping it : {%v}", stagingPath, err)
+			continue
+		}
+		if volumeData.DriverName == d.ConfigYaml.Identity.Name {
+			logger.Debugf("Staging path {%v} of volume {%v} has no stage info", stagingPath, volumeData.VolumeHandle)
+			unrecordedVolumeUuids = append(unrecordedVolumeUuids, getVolumeLockKey(volumeData.VolumeHandle))
+		}
+	}
+	return stagedDevices, unrecordedVolumeUuids, nil
+}
+
+// getVolumeUuidOfWwid returns the volume uuid of the wwid of a multipath device, which is the NAA identifier of the
+// volume with the NAA prefix of multipath, e.g. 6005076810810261f800000000000a5b of 36005076810810261f800000000000a5b.
+func getVolumeUuidOfWwid(wwid string) string {
+	return strings.TrimPrefix(wwid, multipathNaaWwidPrefix)
+}
+
+func isWwidOfVolumes(wwid string, volumeUuids []string) bool {
+	for _, volumeUuid := range volumeUuids {
+		if strings.Contains(wwid, volumeUuid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *OrphanDevicesCollector) removeDevice(dm string, wwid string) error {
+	d := c.NodeService
+	rawSysDevices, err := d.NodeUtils.GetSysDevicesFromMpath(dm)
+	if err != nil {
+		return err
+	}
+	sysDevices := splitSysDevices(rawSysDevices)
+
+	if c.Config.DryRun {
+		logger.Infof("Dry run: orphaned multipath device {%v} of wwid {%v} and its devices {%v} would be removed", dm, wwid, sysDevices)
+		return nil
+	}
+	logger.Infof("Removing orphaned multipath device {%v} of wwid {%v} and its devices {%v}", dm, wwid, sysDevices)
+	if err := d.OsDeviceConnectivityHelper.FlushMultipathDevice(dm); err != nil {
+		return err
+	}
+	return d.OsDeviceConnectivityHelper.RemovePhysicalDevice(sysDevices)
+}
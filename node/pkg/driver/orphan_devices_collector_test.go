@@ -0,0 +1,167 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver_test
+
+import (
+	"errors"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ibm/ibm-block-csi-driver/node/mocks"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver"
+)
+
+func TestOrphanDevicesCollectorCollect(t *testing.T) {
+	orphanDm := "dm-3"
+	orphanWwid := "36005076810810261f800000000000a5b"
+	volumeId := "SVC:6005076810810261F800000000000A5B"
+	driverName := "block.csi.ibm.com"
+	stagingPath := path.Join(driver.KubeletCsiPluginsPath, "volumeDevices", "staging", "pvc-1")
+	stageInfoPath := path.Join(stagingPath, driver.StageInfoFilename)
+	gracePeriod := time.Hour
+	firstCollect := time.Now()
+
+	testCases := []struct {
+		name                 string
+		dryRun               bool
+		stagedDevice         string
+		isStagedMeanwhile    bool // The volume is staged while the second collect checks if the device is in use
+		unrecordedDriverName string
+		volumeDataErr        error
+		lockedVolume         string
+		isInUse              bool
+		secondCollect        time.Time
+		expInUseChecks       int
+		expRemoved           bool
+	}{
+		{
+			name:           "Should remove the device once it is orphaned for the grace period",
+			secondCollect:  firstCollect.Add(gracePeriod),
+			expInUseChecks: 2,
+			expRemoved:     true,
+		},
+		{
+			name:           "Should not remove the device before the grace period ends",
+			secondCollect:  firstCollect.Add(gracePeriod / 2),
+			expInUseChecks: 2,
+		},
+		{
+			name:           "Should not remove the device in dry run",
+			dryRun:         true,
+			secondCollect:  firstCollect.Add(gracePeriod),
+			expInUseChecks: 2,
+		},
+		{
+			name:          "Should not remove the device of a staged volume",
+			stagedDevice:  orphanDm,
+			secondCollect: firstCollect.Add(gracePeriod),
+		},
+		{
+			name:              "Should not remove the device of a volume which is staged while it is checked",
+			stagedDevice:      orphanDm,
+			isStagedMeanwhile: true,
+			secondCollect:     firstCollect.Add(gracePeriod),
+			expInUseChecks:    2,
+		},
+		{
+			name:                 "Should not remove the device of a volume which is staged without stage info",
+			unrecordedDriverName: driverName,
+			secondCollect:        firstCollect.Add(gracePeriod),
+		},
+		{
+			name:                 "Should remove the device when only a volume of another driver has no stage info",
+			unrecordedDriverName: "other.csi.com",
+			secondCollect:        firstCollect.Add(gracePeriod),
+			expInUseChecks:       2,
+			expRemoved:           true,
+		},
+		{
+			name:           "Should remove the device when a staging path has neither stage info nor volume data",
+			volumeDataErr:  errors.New("Dummy error"),
+			secondCollect:  firstCollect.Add(gracePeriod),
+			expInUseChecks: 2,
+			expRemoved:     true,
+		},
+		{
+			name:          "Should not remove the device of a volume which a request is performed on",
+			lockedVolume:  volumeId,
+			secondCollect: firstCollect.Add(gracePeriod),
+		},
+		{
+			name:           "Should not remove a device which is in use",
+			isInUse:        true,
+			secondCollect:  firstCollect.Add(gracePeriod),
+			expInUseChecks: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+			mockScsiGenericHelper := mocks.NewMockOsDeviceConnectivityHelperScsiGenericInterface(mockCtl)
+			mockHelper := mocks.NewMockOsDeviceConnectivityHelperInterface(mockCtl)
+			node := &driver.NodeService{
+				ConfigYaml:                 driver.ConfigFile{},
+				NodeUtils:                  mockNodeUtils,
+				VolumeIdLocksMap:           driver.NewSyncLock(),
+				OsDeviceConnectivityHelper: mockScsiGenericHelper,
+			}
+			node.ConfigYaml.Identity.Name = driverName
+			if tc.lockedVolume != "" {
+				_ = node.VolumeIdLocksMap.AddVolumeLock(tc.lockedVolume, "NodeStageVolume")
+			}
+
+			isStaged := tc.stagedDevice != "" && !tc.isStagedMeanwhile
+			inUseChecks := 0
+			mockHelper.EXPECT().GetIbmDms().Return(map[string]string{orphanDm: orphanWwid}, nil).Times(2)
+			mockNodeUtils.EXPECT().GetStagingPaths().Return([]string{stagingPath}, nil).MinTimes(2)
+			mockNodeUtils.EXPECT().StageInfoFileIsExist(gomock.Any()).DoAndReturn(func(filePath string) bool {
+				return isStaged && filePath == stageInfoPath
+			}).AnyTimes()
+			mockNodeUtils.EXPECT().ReadStageInfoFile(stageInfoPath).Return(&driver.StageInfo{MpathDevice: tc.stagedDevice}, nil).AnyTimes()
+			volumeData := &driver.KubeletVolumeData{DriverName: tc.unrecordedDriverName, VolumeHandle: volumeId}
+			mockNodeUtils.EXPECT().ReadKubeletVolumeData(stagingPath).Return(volumeData, tc.volumeDataErr).AnyTimes()
+			mockNodeUtils.EXPECT().IsDeviceInUse(orphanDm).DoAndReturn(func(_ string) (bool, error) {
+				inUseChecks++
+				isStaged = isStaged || (tc.isStagedMeanwhile && inUseChecks == 2)
+				return tc.isInUse, nil
+			}).Times(tc.expInUseChecks)
+			if tc.expRemoved || tc.dryRun {
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath(orphanDm).Return("sdb,sdc", nil)
+			}
+			if tc.expRemoved {
+				mockScsiGenericHelper.EXPECT().FlushMultipathDevice(orphanDm).Return(nil)
+				mockScsiGenericHelper.EXPECT().RemovePhysicalDevice([]string{"sdb", "sdc"}).Return(nil)
+			}
+
+			config := driver.OrphanDevicesCollectorConfig{Interval: time.Minute, GracePeriod: gracePeriod, DryRun: tc.dryRun}
+			collector := driver.NewOrphanDevicesCollector(config, node, mockHelper)
+			collector.Collect(firstCollect)
+			collector.Collect(tc.secondCollect)
+
+			if tc.lockedVolume == "" {
+				if err := node.VolumeIdLocksMap.AddVolumeLock(volumeId, "NodeStageVolume"); err != nil {
+					t.Fatalf("Expected the collector to release the volume lock, got %v", err)
+				}
+			}
+		})
+	}
+}
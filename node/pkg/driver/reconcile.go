@@ -0,0 +1,147 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"path"
+
+	"github.com/ibm/ibm-block-csi-driver/node/goid_info"
+	"github.com/ibm/ibm-block-csi-driver/node/logger"
+)
+
+// ReconcileStagedVolumes matches the volumes which were staged before the node service started to their devices
+// and sessions. A device which is gone is rescanned and recorded again, the other mismatches are only logged,
+// since the kubelet stages or unstages the volume again on its own.
+func (d *NodeService) ReconcileStagedVolumes() {
+	logger.Infof(">>>> ReconcileStagedVolumes")
+	defer logger.Infof("<<<< ReconcileStagedVolumes")
+
+	stagingPaths, err := d.NodeUtils.GetStagingPaths()
+	if err != nil {
+		logger.Errorf("Failed to get the staging paths : {%v}", err)
+		return
+	}
+
+	arrayIdentifiersByConnectivity := make(map[string]map[string]bool)
+	for _, stagingPath := range stagingPaths {
+		stageInfo := d.reconcileStagedVolume(stagingPath)
+		if stageInfo == nil {
+			continue
+		}
+		if arrayIdentifiersByConnectivity[stageInfo.Connectivity] == nil {
+			arrayIdentifiersByConnectivity[stageInfo.Connectivity] = make(map[string]bool)
+		}
+		for _, arrayIdentifier := range stageInfo.ArrayInitiators {
+			arrayIdentifiersByConnectivity[stageInfo.Connectivity][arrayIdentifier] = true
+		}
+	}
+
+	d.reconcileSessions(arrayIdentifiersByConnectivity)
+}
+
+func (d *NodeService) reconcileStagedVolume(stagingPath string) *StageInfo {
+	stageInfo, stageInfoPath := d.getStageInfo(stagingPath)
+	if stageInfo == nil || stageInfo.VolumeId == "" {
+		logger.Debugf("Staging path {%v} has no stage info of the driver, skipping it", stagingPath)
+		return nil
+	}
+	goid_info.SetAdditionalIDInfo(stageInfo.VolumeId)
+	defer goid_info.DeleteAdditionalIDInfo()
+
+	isMounted := true
+	if stageInfo.AccessType == stageInfoAccessTypeMount {
+		isNotMounted, err := d.NodeUtils.IsNotMountPoint(d.NodeUtils.GetPodPath(stagingPath))
+		if err != nil {
+			logger.Warningf("Failed to check if staging path {%v} is mounted : {%v}", stagingPath, err)
+			return stageInfo
+		}
+		isMounted = !isNotMounted
+	}
+
+	isDeviceFound := d.reconcileStagedDevice(stageInfo, stageInfoPath)
+	if isMounted && !isDeviceFound {
+		logger.Errorf("Staging path {%v} is stale, the device of the volume is gone", stagingPath)
+	}
+	if !isMounted && isDeviceFound {
+		logger.Warningf("Device {%v} of the volume is not mounted on staging path {%v}", stageInfo.MpathDevice, stagingPath)
+	}
+	return stageInfo
+}
+
+// reconcileStagedDevice returns whether the device of the volume exists, after it rescans the device if it is gone.
+func (d *NodeService) reconcileStagedDevice(stageInfo *StageInfo, stageInfoPath string) bool {
+	if d.NodeUtils.IsDeviceOfVolume(stageInfo.MpathDevice, stageInfo.VolumeId) {
+		return true
+	}
+	logger.Warningf("Staged device {%v} of the volume is gone, rescanning the devices", stageInfo.MpathDevice)
+
+	osDeviceConnectivity, ok := d.OsDeviceConnectivityMapping[stageInfo.Connectivity]
+	if !ok {
+		logger.Errorf("Wrong connectivity type {%v} in stage info", stageInfo.Connectivity)
+		return false
+	}
+	if err := osDeviceConnectivity.RescanDevices(stageInfo.Lun, stageInfo.ArrayInitiators); err != nil {
+		logger.Errorf("Failed to rescan the devices of the volume : {%v}", err)
+		return false
+	}
+	mpathDevice, err := osDeviceConnectivity.GetMpathDevice(stageInfo.VolumeId)
+	if err != nil {
+		logger.Errorf("Failed to discover the device of the volume : {%v}", err)
+		return false
+	}
+	baseDevice := path.Base(mpathDevice)
+	rawSysDevices, err := d.NodeUtils.GetSysDevicesFromMpath(baseDevice)
+	if err != nil {
+		logger.Errorf("Error while trying to get sys devices : {%v}", err)
+		return true
+	}
+
+	logger.Infof("Device of the volume was found again as {%v}, updating the stage info", baseDevice)
+	stageInfo.MpathDevice = baseDevice
+	stageInfo.SysDevices = splitSysDevices(rawSysDevices)
+	if err := d.writeStageInfo(stageInfoPath, stageInfo); err != nil {
+		logger.Errorf("Failed to update the stage info : {%v}", err)
+	}
+	return true
+}
+
+// downSessionsGetter is implemented by the connectivity types which have sessions to the storage, e.g. iSCSI.
+type downSessionsGetter interface {
+	GetDownSessions(arrayIdentifiers []string) (map[string][]string, error) // Returns the portals of the down sessions by target
+}
+
+func (d *NodeService) reconcileSessions(arrayIdentifiersByConnectivity map[string]map[string]bool) {
+	for connectivityType, arrayIdentifiersSet := range arrayIdentifiersByConnectivity {
+		osDeviceConnectivity, ok := d.OsDeviceConnectivityMapping[connectivityType].(downSessionsGetter)
+		if !ok || len(arrayIdentifiersSet) == 0 {
+			continue
+		}
+		arrayIdentifiers := make([]string, 0, len(arrayIdentifiersSet))
+		for arrayIdentifier := range arrayIdentifiersSet {
+			arrayIdentifiers = append(arrayIdentifiers, arrayIdentifier)
+		}
+
+		portalsByTarget, err := osDeviceConnectivity.GetDownSessions(arrayIdentifiers)
+		if err != nil {
+			logger.Errorf("Failed to check the {%v} sessions : {%v}", connectivityType, err)
+			continue
+		}
+		for target, portals := range portalsByTarget {
+			logger.Errorf("{%v} sessions of target {%v} to portals {%v} are down", connectivityType, target, portals)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver_test
+
+import (
+	"errors"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ibm/ibm-block-csi-driver/node/mocks"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
+)
+
+// downSessionsOsDeviceConnectivity adds the optional GetDownSessions of the connectivity types to the connectivity mock
+type downSessionsOsDeviceConnectivity struct {
+	*mocks.MockOsDeviceConnectivityInterface
+	checkedArrayIdentifiers [][]string
+}
+
+func (d *downSessionsOsDeviceConnectivity) GetDownSessions(arrayIdentifiers []string) (map[string][]string, error) {
+	d.checkedArrayIdentifiers = append(d.checkedArrayIdentifiers, arrayIdentifiers)
+	return map[string][]string{}, nil
+}
+
+func TestReconcileStagedVolumes(t *testing.T) {
+	volId := "SVC:6005076810810261F800000000000A5B"
+	arrayIqn := "iqn.1986-03.com.ibm:2145.v7k1.node1"
+	stagingPath := path.Join(driver.KubeletCsiPluginsPath, "pv", "pvc-1", "globalmount")
+	stagingPathWithHostPrefix := GetPodPath(stagingPath)
+	blockStageInfoPath := path.Join(stagingPath, driver.StageInfoFilename)
+	stageInfoPath := path.Join(driver.KubeletCsiPluginsPath, "pv", "pvc-1", driver.StageInfoFilename)
+	newStageInfo := func() *driver.StageInfo {
+		return &driver.StageInfo{
+			VolumeId:        volId,
+			Connectivity:    device_connectivity.ConnectionTypeISCSI,
+			Lun:             1,
+			ArrayInitiators: []string{arrayIqn},
+			MpathDevice:     "dm-2",
+			SysDevices:      []string{"sdb", "sdc"},
+			FsType:          "ext4",
+			AccessType:      "mount",
+		}
+	}
+
+	testCases := []struct {
+		name            string
+		isNotMounted    bool
+		isDeviceFound   bool
+		rescannedDevice string
+		rescanErr       error
+		expStageInfo    *driver.StageInfo
+	}{
+		{
+			name:          "success staged device is mounted",
+			isDeviceFound: true,
+		},
+		{
+			name:          "success staged device is not mounted",
+			isNotMounted:  true,
+			isDeviceFound: true,
+		},
+		{
+			name:            "success device is rescanned and recorded again",
+			rescannedDevice: "/dev/dm-5",
+			expStageInfo: func() *driver.StageInfo {
+				stageInfo := newStageInfo()
+				stageInfo.MpathDevice = "dm-5"
+				stageInfo.SysDevices = []string{"sdd", "sde"}
+				return stageInfo
+			}(),
+		},
+		{
+			name:      "success stale staging path is only logged",
+			rescanErr: errors.New("Dummy error"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+			mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+			sessionsOsDeviceCon := &downSessionsOsDeviceConnectivity{MockOsDeviceConnectivityInterface: mockOsDeviceCon}
+			node := newTestNodeServiceStaging(mockNodeUtils, sessionsOsDeviceCon, nil)
+
+			mockNodeUtils.EXPECT().GetStagingPaths().Return([]string{stagingPath}, nil)
+			mockNodeUtils.EXPECT().StageInfoFileIsExist(blockStageInfoPath).Return(false)
+			mockNodeUtils.EXPECT().StageInfoFileIsExist(stageInfoPath).Return(true)
+			mockNodeUtils.EXPECT().ReadStageInfoFile(stageInfoPath).Return(newStageInfo(), nil)
+			mockNodeUtils.EXPECT().GetPodPath(stagingPath).Return(stagingPathWithHostPrefix)
+			mockNodeUtils.EXPECT().IsNotMountPoint(stagingPathWithHostPrefix).Return(tc.isNotMounted, nil)
+			mockNodeUtils.EXPECT().IsDeviceOfVolume("dm-2", volId).Return(tc.isDeviceFound)
+			if !tc.isDeviceFound {
+				mockOsDeviceCon.EXPECT().RescanDevices(1, []string{arrayIqn}).Return(tc.rescanErr)
+			}
+			if tc.rescannedDevice != "" {
+				mockOsDeviceCon.EXPECT().GetMpathDevice(volId).Return(tc.rescannedDevice, nil)
+				mockNodeUtils.EXPECT().GetSysDevicesFromMpath("dm-5").Return("sdd,sde", nil)
+				mockNodeUtils.EXPECT().WriteStageInfoFile(stageInfoPath, tc.expStageInfo).Return(nil)
+			}
+
+			node.ReconcileStagedVolumes()
+			if !reflect.DeepEqual(sessionsOsDeviceCon.checkedArrayIdentifiers, [][]string{{arrayIqn}}) {
+				t.Fatalf("Expected the sessions of %v to be checked, got %v", arrayIqn, sessionsOsDeviceCon.checkedArrayIdentifiers)
+			}
+		})
+	}
+}
+
+func TestReconcileStagedVolumesSkipsPathsWithoutStageInfo(t *testing.T) {
+	stagingPath := path.Join(driver.KubeletCsiPluginsPath, "volumeDevices", "staging", "pvc-2")
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtl)
+	mockOsDeviceCon := mocks.NewMockOsDeviceConnectivityInterface(mockCtl)
+	node := newTestNodeServiceStaging(mockNodeUtils, mockOsDeviceCon, nil)
+
+	mockNodeUtils.EXPECT().GetStagingPaths().Return([]string{stagingPath}, nil)
+	mockNodeUtils.EXPECT().StageInfoFileIsExist(gomock.Any()).Return(false).Times(2)
+
+	node.ReconcileStagedVolumes()
+}
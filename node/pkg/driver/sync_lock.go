@@ -17,9 +17,12 @@
 package driver
 
 import (
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/ibm/ibm-block-csi-driver/node/logger"
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver/device_connectivity"
 )
 
 //go:generate mockgen -destination=../../mocks/mock_sync_lock.go -package=mocks github.com/ibm/ibm-block-csi-driver/node/pkg/driver SyncLockInterface
@@ -46,9 +49,16 @@ func (s SyncLock) GetSyncMap() *sync.Map {
 	return s.SyncMap
 }
 
+// getVolumeLockKey returns the lowercase uuid of the volume id, so a volume is locked by its uuid too, e.g.
+// SVC:6005076810810261F800000000000A5B and 6005076810810261f800000000000a5b share one lock.
+func getVolumeLockKey(id string) string {
+	idParts := strings.Split(id, device_connectivity.VolumeIdDelimiter)
+	return strings.ToLower(idParts[len(idParts)-1])
+}
+
 func (s SyncLock) AddVolumeLock(id string, msg string) error {
 	logger.Debugf("Lock for action %s, Try to acquire lock for volume", msg)
-	_, exists := s.SyncMap.LoadOrStore(id, 0)
+	_, exists := s.SyncMap.LoadOrStore(getVolumeLockKey(id), 0)
 	if !exists {
 		logger.Debugf("Lock for action %s, Succeed to acquire lock for volume", msg)
 		return nil
@@ -61,9 +71,47 @@ func (s SyncLock) AddVolumeLock(id string, msg string) error {
 func (s SyncLock) RemoveVolumeLock(id string, msg string) {
 	logger.Debugf("Lock for action %s, release lock for volume", msg)
 
-	s.SyncMap.Delete(id)
+	s.SyncMap.Delete(getVolumeLockKey(id))
 }
 
 /*func (s SyncLock) RemoveVolumeLock(id string, msg string) func() {
 	return func() { s.RemoveVolumeLockDo(id, msg) }
 }*/
+
+// TargetLocks serializes the connectivity of the storage targets between requests, so the unstage of a volume does
+// not log out of a target while another volume is being staged through it.
+type TargetLocks struct {
+	locks *sync.Map
+}
+
+func NewTargetLocks() *TargetLocks {
+	return &TargetLocks{
+		locks: &sync.Map{},
+	}
+}
+
+// Lock waits for the locks of the targets and returns the function which releases them. The targets are locked in
+// sorted order, so requests on common targets don't deadlock.
+func (t *TargetLocks) Lock(targets []string, msg string) func() {
+	sortedTargets := make([]string, len(targets))
+	copy(sortedTargets, targets)
+	sort.Strings(sortedTargets)
+
+	var mutexes []*sync.Mutex
+	for i, target := range sortedTargets {
+		if i > 0 && target == sortedTargets[i-1] {
+			continue
+		}
+		lock, _ := t.locks.LoadOrStore(target, &sync.Mutex{})
+		mutex := lock.(*sync.Mutex)
+		logger.Debugf("Lock for action %s, Try to acquire lock for target {%v}", msg, target)
+		mutex.Lock()
+		mutexes = append(mutexes, mutex)
+	}
+	return func() {
+		logger.Debugf("Lock for action %s, release lock for targets {%v}", msg, sortedTargets)
+		for _, mutex := range mutexes {
+			mutex.Unlock()
+		}
+	}
+}
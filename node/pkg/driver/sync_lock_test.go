@@ -0,0 +1,54 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ibm/ibm-block-csi-driver/node/pkg/driver"
+)
+
+func TestTargetLocks(t *testing.T) {
+	targetLocks := driver.NewTargetLocks()
+	unlockStage := targetLocks.Lock([]string{"iqn.target2", "iqn.target1", "iqn.target2"}, "NodeStageVolume")
+
+	isUnstageLocked := make(chan bool)
+	go func() {
+		unlockUnstage := targetLocks.Lock([]string{"iqn.target1"}, "NodeUnstageVolume")
+		isUnstageLocked <- true
+		unlockUnstage()
+	}()
+
+	select {
+	case <-isUnstageLocked:
+		t.Fatalf("Expected the unstage to wait for the lock of the target")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockStage()
+	select {
+	case <-isUnstageLocked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the unstage to lock the target once the stage released it")
+	}
+
+	// an unrelated target is not blocked by the lock of another target
+	unlockStage = targetLocks.Lock([]string{"iqn.target1"}, "NodeStageVolume")
+	defer unlockStage()
+	unlockOther := targetLocks.Lock([]string{"iqn.target3"}, "NodeUnstageVolume")
+	unlockOther()
+}
@@ -0,0 +1,71 @@
+/**
+ * Copyright 2020 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	secretsFieldName   = "secrets"
+	strippedSecretsMsg = "***stripped***"
+)
+
+type strippedSecrets struct {
+	msg interface{}
+}
+
+// StripSecrets returns a wrapper of a gRPC message which formats the message as json,
+// with the values of its secrets fields, in any depth, replaced by a placeholder.
+func StripSecrets(msg interface{}) fmt.Stringer {
+	return &strippedSecrets{msg: msg}
+}
+
+func (s *strippedSecrets) String() string {
+	rawMsg, err := json.Marshal(s.msg)
+	if err != nil {
+		return fmt.Sprintf("<failed to format message: %v>", err)
+	}
+	var parsedMsg interface{}
+	if err := json.Unmarshal(rawMsg, &parsedMsg); err != nil {
+		return fmt.Sprintf("<failed to format message: %v>", err)
+	}
+	stripSecretsFields(parsedMsg)
+	strippedMsg, err := json.Marshal(parsedMsg)
+	if err != nil {
+		return fmt.Sprintf("<failed to format message: %v>", err)
+	}
+	return string(strippedMsg)
+}
+
+func stripSecretsFields(parsedMsg interface{}) {
+	switch value := parsedMsg.(type) {
+	case map[string]interface{}:
+		for key, fieldValue := range value {
+			if key == secretsFieldName {
+				value[key] = strippedSecretsMsg
+				continue
+			}
+			stripSecretsFields(fieldValue)
+		}
+	case []interface{}:
+		for _, item := range value {
+			stripSecretsFields(item)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestStripSecrets(t *testing.T) {
+	testCases := []struct {
+		name   string
+		msg    interface{}
+		expMsg string
+	}{
+		{
+			name: "stage request secrets are stripped",
+			msg: &csi.NodeStageVolumeRequest{
+				VolumeId: "vol-1",
+				Secrets:  map[string]string{"chap_password": "secret"},
+			},
+			expMsg: `{"secrets":"***stripped***","volume_id":"vol-1"}`,
+		},
+		{
+			name: "request without secrets is not changed",
+			msg: &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "vol-1",
+				StagingTargetPath: "/staging",
+			},
+			expMsg: `{"staging_target_path":"/staging","volume_id":"vol-1"}`,
+		},
+		{
+			name:   "nil message",
+			msg:    nil,
+			expMsg: "null",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := StripSecrets(tc.msg).String()
+			if msg != tc.expMsg {
+				t.Fatalf("wrong stripped message: expected %v, got %v", tc.expMsg, msg)
+			}
+		})
+	}
+}
+
+func TestStripSecretsNestedMessage(t *testing.T) {
+	msg := struct {
+		Requests []*csi.NodePublishVolumeRequest `json:"requests"`
+	}{
+		Requests: []*csi.NodePublishVolumeRequest{{Secrets: map[string]string{"password": "secret"}}},
+	}
+
+	strippedMsg := StripSecrets(msg).String()
+	if strings.Contains(strippedMsg, "secret\"") || !strings.Contains(strippedMsg, strippedSecretsMsg) {
+		t.Fatalf("secrets of nested message are not stripped: got %v", strippedMsg)
+	}
+}